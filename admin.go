@@ -0,0 +1,223 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// Reason of the close frame of connections disconnected using the admin handler.
+	adminDisconnectReason = "Disconnected by administrator"
+)
+
+// Registered event as described by the admin handler.
+type adminEvent struct {
+	Name string `json:"name"`
+	// Type of the data taken by the callback, empty if it takes none.
+	Payload string `json:"payload"`
+	// Set for golem's internal events.
+	Internal bool `json:"internal,omitempty"`
+}
+
+// Active connection as described by the admin handler.
+type adminConnection struct {
+	ID             uint64    `json:"id"`
+	RemoteAddr     string    `json:"remoteAddr"`
+	ConnectedSince time.Time `json:"connectedSince"`
+	QueueDepth     int       `json:"queueDepth"`
+	// Joined rooms by name of the room manager.
+	Rooms map[string][]string `json:"rooms,omitempty"`
+}
+
+// Room of a room manager as described by the admin handler.
+type adminRoom struct {
+	Name    string `json:"name"`
+	Members uint   `json:"members"`
+}
+
+// Room manager as described by the admin handler.
+type adminRoomManager struct {
+	Name  string      `json:"name"`
+	Rooms []adminRoom `json:"rooms"`
+}
+
+// Document served by the admin handler.
+type adminInfo struct {
+	Events       []adminEvent       `json:"events"`
+	Connections  []adminConnection  `json:"connections"`
+	RoomManagers []adminRoomManager `json:"roomManagers"`
+}
+
+// Returns the name of the type of the data taken by a callback, empty if it takes none.
+func payloadType(callbackType reflect.Type) string {
+	if callbackType.Kind() != reflect.Func || callbackType.NumIn() < 2 {
+		return ""
+	}
+	return callbackType.In(1).String()
+}
+
+// SetAdminAuth sets the function authorizing requests of the admin handler. If it returns
+// false the request is rejected. By default all requests are rejected.
+func (router *Router) SetAdminAuth(callback func(http.ResponseWriter, *http.Request) bool) {
+	router.adminFunc = callback
+}
+
+// AddRoomManager adds the room manager with the provided name to the admin handler. The room
+// manager needs to be removed using RemoveRoomManager before it is stopped.
+func (router *Router) AddRoomManager(name string, rm *RoomManager) {
+	router.adminLock.Lock()
+	router.roomManagers[name] = rm
+	router.adminLock.Unlock()
+}
+
+// RemoveRoomManager removes the room manager with the provided name from the admin handler.
+func (router *Router) RemoveRoomManager(name string) {
+	router.adminLock.Lock()
+	delete(router.roomManagers, name)
+	router.adminLock.Unlock()
+}
+
+// AdminHandler returns a http.Handler for live introspection of the router, which is protected
+// by the function set with SetAdminAuth. GET requests are answered with a JSON document describing
+// the registered events with their payload types, the active connections and the rooms of the room
+// managers added using AddRoomManager. POST requests allow to:
+//   - force-disconnect a connection by ID using the parameter "disconnect".
+//   - destroy a room using the parameters "destroy" and "manager" naming room and room manager.
+func (router *Router) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !router.adminFunc(w, r) {
+			http.Error(w, "Authorization failed", 403)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(router.adminInfo())
+		case "POST":
+			router.adminAction(w, r)
+		default:
+			http.Error(w, "Method not allowed", 405)
+		}
+	})
+}
+
+// Collects the document served by the admin handler.
+func (router *Router) adminInfo() *adminInfo {
+	info := &adminInfo{
+		Events:       make([]adminEvent, 0, len(router.callbacks)),
+		Connections:  make([]adminConnection, 0),
+		RoomManagers: make([]adminRoomManager, 0),
+	}
+	for name := range router.callbacks {
+		payload, ok := router.payloadTypes[name]
+		info.Events = append(info.Events, adminEvent{Name: name, Payload: payload, Internal: !ok})
+	}
+	sort.Slice(info.Events, func(i, j int) bool { return info.Events[i].Name < info.Events[j].Name })
+
+	router.adminLock.Lock()
+	connections := make([]*Connection, 0, len(router.connections))
+	for _, conn := range router.connections {
+		connections = append(connections, conn)
+	}
+	managers := make(map[string]*RoomManager, len(router.roomManagers))
+	for name, rm := range router.roomManagers {
+		managers[name] = rm
+	}
+	router.adminLock.Unlock()
+
+	// Rooms joined by connection and manager.
+	joined := make(map[*Connection]map[string][]string)
+	for name, rm := range managers {
+		snapshot := rm.takeSnapshot()
+		manager := adminRoomManager{Name: name, Rooms: make([]adminRoom, 0, len(snapshot.rooms))}
+		for room, count := range snapshot.rooms {
+			manager.Rooms = append(manager.Rooms, adminRoom{Name: room, Members: count})
+		}
+		sort.Slice(manager.Rooms, func(i, j int) bool { return manager.Rooms[i].Name < manager.Rooms[j].Name })
+		info.RoomManagers = append(info.RoomManagers, manager)
+		for conn, rooms := range snapshot.members {
+			if len(rooms) == 0 {
+				continue
+			}
+			if joined[conn] == nil {
+				joined[conn] = make(map[string][]string)
+			}
+			sort.Strings(rooms)
+			joined[conn][name] = rooms
+		}
+	}
+	sort.Slice(info.RoomManagers, func(i, j int) bool { return info.RoomManagers[i].Name < info.RoomManagers[j].Name })
+
+	for _, conn := range connections {
+		info.Connections = append(info.Connections, adminConnection{
+			ID:             conn.id,
+			RemoteAddr:     conn.remoteAddr,
+			ConnectedSince: conn.since,
+			QueueDepth:     len(conn.send),
+			Rooms:          joined[conn],
+		})
+	}
+	sort.Slice(info.Connections, func(i, j int) bool { return info.Connections[i].ID < info.Connections[j].ID })
+	return info
+}
+
+// Performs the action requested by a POST request of the admin handler.
+func (router *Router) adminAction(w http.ResponseWriter, r *http.Request) {
+	if id := r.FormValue("disconnect"); id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid connection ID", 400)
+			return
+		}
+		router.adminLock.Lock()
+		conn, ok := router.connections[n]
+		router.adminLock.Unlock()
+		if !ok {
+			http.Error(w, "Connection not found", 404)
+			return
+		}
+		conn.CloseWithReason(websocket.ClosePolicyViolation, adminDisconnectReason)
+		w.WriteHeader(204)
+		return
+	}
+	if room := r.FormValue("destroy"); room != "" {
+		router.adminLock.Lock()
+		rm, ok := router.roomManagers[r.FormValue("manager")]
+		router.adminLock.Unlock()
+		if !ok {
+			http.Error(w, "Room manager not found", 404)
+			return
+		}
+		if _, ok := rm.takeSnapshot().rooms[room]; !ok {
+			http.Error(w, "Room not found", 404)
+			return
+		}
+		rm.Destroy(room)
+		w.WriteHeader(204)
+		return
+	}
+	http.Error(w, "Unknown action", 400)
+}
@@ -0,0 +1,202 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends a request with the authorization header to the admin handler of the router.
+func adminRequest(router *Router, method string, authorization string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/admin", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", authorization)
+	w := httptest.NewRecorder()
+	router.AdminHandler().ServeHTTP(w, r)
+	return w
+}
+
+// Returns a router, whose admin handler accepts requests authorized with "secret".
+func adminRouter() *Router {
+	router := NewRouter()
+	router.SetAdminAuth(func(w http.ResponseWriter, r *http.Request) bool {
+		return r.Header.Get("Authorization") == "secret"
+	})
+	return router
+}
+
+// Returns the document served by the admin handler of the router.
+func adminList(t *testing.T, router *Router) *adminInfo {
+	t.Helper()
+	w := adminRequest(router, "GET", "secret", nil)
+	if w.Code != 200 {
+		t.Fatalf("listing failed with status %d", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+	info := &adminInfo{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatalf("decoding failed: %v", err)
+	}
+	return info
+}
+
+func TestAdminAuth(t *testing.T) {
+	router := NewRouter()
+	if w := adminRequest(router, "GET", "secret", nil); w.Code != 403 {
+		t.Fatalf("expected requests to be rejected by default, status %d", w.Code)
+	}
+
+	router = adminRouter()
+	if w := adminRequest(router, "GET", "wrong", nil); w.Code != 403 {
+		t.Fatalf("expected unauthorized listing to be rejected, status %d", w.Code)
+	}
+	if w := adminRequest(router, "POST", "", url.Values{"disconnect": {"1"}}); w.Code != 403 {
+		t.Fatalf("expected unauthorized action to be rejected, status %d", w.Code)
+	}
+	if w := adminRequest(router, "DELETE", "secret", nil); w.Code != 405 {
+		t.Fatalf("expected unsupported method to be rejected, status %d", w.Code)
+	}
+}
+
+func TestAdminList(t *testing.T) {
+	router := adminRouter()
+	router.On("echo", func(conn *Connection, data *testMessage) {})
+	router.On("ping", func(conn *Connection) {})
+	connected := make(chan *Connection, 1)
+	router.OnConnect(func(conn *Connection, r *http.Request) {
+		connected <- conn
+	})
+	rm := NewRoomManager()
+	defer rm.Stop()
+	router.AddRoomManager("chat", rm)
+	defer router.RemoveRoomManager("chat")
+
+	connectMemory(t, router)
+	conn := <-connected
+	rm.Join("lobby", conn)
+	info := adminList(t, router)
+
+	events := make(map[string]adminEvent)
+	for _, event := range info.Events {
+		events[event.Name] = event
+	}
+	if event := events["echo"]; event.Payload != "*golem.testMessage" || event.Internal {
+		t.Fatalf("unexpected description of event with payload %+v", event)
+	}
+	if event, ok := events["ping"]; !ok || event.Payload != "" || event.Internal {
+		t.Fatalf("unexpected description of event without payload %+v", event)
+	}
+
+	if len(info.Connections) != 1 {
+		t.Fatalf("expected one connection, listed %+v", info.Connections)
+	}
+	listed := info.Connections[0]
+	if listed.ID != conn.id || listed.RemoteAddr != "192.0.2.1:1234" || listed.ConnectedSince.IsZero() {
+		t.Fatalf("unexpected description of connection %+v", listed)
+	}
+	if rooms := listed.Rooms["chat"]; len(rooms) != 1 || rooms[0] != "lobby" {
+		t.Fatalf("expected connection to be listed in the joined room, listed %+v", listed.Rooms)
+	}
+
+	if len(info.RoomManagers) != 1 || info.RoomManagers[0].Name != "chat" {
+		t.Fatalf("expected room manager to be listed, listed %+v", info.RoomManagers)
+	}
+	if rooms := info.RoomManagers[0].Rooms; len(rooms) != 1 || rooms[0] != (adminRoom{Name: "lobby", Members: 1}) {
+		t.Fatalf("unexpected rooms %+v", rooms)
+	}
+}
+
+func TestAdminDisconnect(t *testing.T) {
+	router := adminRouter()
+	router.On("ping", func(conn *Connection) {
+		conn.Emit("pong", nil)
+	})
+	connected := make(chan *Connection, 1)
+	router.OnConnect(func(conn *Connection, r *http.Request) {
+		connected <- conn
+	})
+	client := connectMemory(t, router)
+	conn := <-connected
+	// Wait until the connection is running, closing it before is not noticed by the hub.
+	client.WriteFrame(TextMode, []byte(`ping null`))
+	readMemory(t, client)
+
+	for _, test := range []struct {
+		id     string
+		status int
+	}{
+		{"x", 400},
+		{"12345", 404},
+	} {
+		if w := adminRequest(router, "POST", "secret", url.Values{"disconnect": {test.id}}); w.Code != test.status {
+			t.Fatalf("expected disconnecting %q to fail with status %d, status %d", test.id, test.status, w.Code)
+		}
+	}
+	if w := adminRequest(router, "POST", "secret", url.Values{"unknown": {"1"}}); w.Code != 400 {
+		t.Fatalf("expected unknown action to be rejected, status %d", w.Code)
+	}
+
+	id := url.Values{"disconnect": {strconv.FormatUint(conn.id, 10)}}
+	if w := adminRequest(router, "POST", "secret", id); w.Code != 204 {
+		t.Fatalf("disconnecting failed with status %d", w.Code)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := client.ReadFrame()
+	if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != 1008 || closeErr.Text != adminDisconnectReason {
+		t.Fatalf("expected close frame of the administrator, read %v", err)
+	}
+}
+
+func TestAdminDestroy(t *testing.T) {
+	router := adminRouter()
+	connected := make(chan *Connection, 1)
+	router.OnConnect(func(conn *Connection, r *http.Request) {
+		connected <- conn
+	})
+	rm := NewRoomManager()
+	defer rm.Stop()
+	router.AddRoomManager("chat", rm)
+	defer router.RemoveRoomManager("chat")
+	connectMemory(t, router)
+	rm.Join("lobby", <-connected)
+
+	for _, form := range []url.Values{
+		{"destroy": {"lobby"}, "manager": {"unknown"}},
+		{"destroy": {"unknown"}, "manager": {"chat"}},
+	} {
+		if w := adminRequest(router, "POST", "secret", form); w.Code != 404 {
+			t.Fatalf("expected destroying %v to fail with status 404, status %d", form, w.Code)
+		}
+	}
+	if w := adminRequest(router, "POST", "secret", url.Values{"destroy": {"lobby"}, "manager": {"chat"}}); w.Code != 204 {
+		t.Fatalf("destroying failed with status %d", w.Code)
+	}
+	if rooms := adminList(t, router).RoomManagers[0].Rooms; len(rooms) != 0 {
+		t.Fatalf("expected room to be destroyed, listed %+v", rooms)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdmissionLimits limit the connections a router accepts. Requests exceeding the limits are
+// rejected before the handshake callback is called and the connection is upgraded. The zero
+// value of a limit disables it.
+type AdmissionLimits struct {
+	// Maximum number of concurrent connections, further requests are rejected with 503.
+	MaxConnections int
+	// Maximum number of concurrent connections per client IP, further requests of the client
+	// are rejected with 429.
+	MaxConnectionsPerIP int
+	// Connections accepted per second on average and in a burst, e.g. to protect against
+	// reconnect storms after a deploy. Further requests are rejected with 503 and Retry-After.
+	// Requests rejected because of their origin or by the handshake callback do not count.
+	UpgradeRate  float64
+	UpgradeBurst int
+	// Header, that proxies set to the client IP, e.g. "X-Forwarded-For". If set, the client IP is
+	// the rightmost address of the header, that is not a trusted proxy. The header is only
+	// honoured for requests of trusted proxies.
+	ProxyHeader string
+	// IPs or CIDRs of trusted proxies, required if ProxyHeader is set.
+	TrustedProxies []string
+}
+
+// Admission state of a router.
+type admission struct {
+	limits  AdmissionLimits
+	proxies []*net.IPNet
+	// Guards the fields below.
+	lock sync.Mutex
+	// Number of connections in total and by client IP.
+	total int
+	perIP map[string]int
+	// Bucket of the upgrade rate, nil if unlimited.
+	upgrades *tokenBucket
+}
+
+// Ticket of an admitted connection, which needs to be released once the connection is
+// closed or was not established. A nil ticket can be released as well.
+type admissionTicket struct {
+	admission *admission
+	ip        string
+	once      sync.Once
+}
+
+// SetAdmissionLimits sets the limits of connections accepted by the router. By default all
+// connections are accepted. The limits apply to the Handler, Serve and the SSE and long-polling
+// fallbacks. Returns an error if a trusted proxy is invalid or the proxy header is set without
+// trusted proxies.
+func (router *Router) SetAdmissionLimits(limits AdmissionLimits) error {
+	if limits.ProxyHeader != "" && len(limits.TrustedProxies) == 0 {
+		return errors.New("Proxy header " + limits.ProxyHeader + " requires trusted proxies.")
+	}
+	a := &admission{
+		limits:   limits,
+		perIP:    make(map[string]int),
+		upgrades: newTokenBucket(RateLimit{Rate: limits.UpgradeRate, Burst: limits.UpgradeBurst}),
+	}
+	for _, proxy := range limits.TrustedProxies {
+		cidr := proxy
+		if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else if ip != nil {
+			cidr += "/128"
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.New("Invalid trusted proxy " + proxy + ".")
+		}
+		a.proxies = append(a.proxies, network)
+	}
+	router.admission = a
+	return nil
+}
+
+// Returns whether the IP is a trusted proxy.
+func (a *admission) trusted(ip net.IP) bool {
+	for _, network := range a.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the IP of the client of the request, honouring the proxy header.
+func (a *admission) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if a.limits.ProxyHeader == "" {
+		return host
+	}
+	if remote := net.ParseIP(host); remote == nil || !a.trusted(remote) {
+		return host
+	}
+	entries := strings.Split(strings.Join(r.Header.Values(a.limits.ProxyHeader), ","), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(entries[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !a.trusted(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// Admits a connection of the request. Otherwise returns the reason, status and the time after
+// which the client may retry, if known.
+func (a *admission) admit(r *http.Request) (*admissionTicket, string, int, time.Duration) {
+	ip := a.clientIP(r)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.limits.MaxConnections > 0 && a.total >= a.limits.MaxConnections {
+		return nil, "connections", 503, 0
+	}
+	if a.limits.MaxConnectionsPerIP > 0 && a.perIP[ip] >= a.limits.MaxConnectionsPerIP {
+		return nil, "ip", 429, 0
+	}
+	if a.upgrades != nil {
+		if wait := a.upgrades.wait(time.Now()); wait > 0 {
+			return nil, "rate", 503, wait
+		}
+		a.upgrades.tokens--
+	}
+	a.total++
+	a.perIP[ip]++
+	return &admissionTicket{admission: a, ip: ip}, "", 0, 0
+}
+
+// Releases the connection of the ticket.
+func (t *admissionTicket) release() {
+	t.done(false)
+}
+
+// Releases the connection of the ticket, which was rejected after it was admitted, e.g. by the
+// handshake callback. Its token of the upgrade rate is returned.
+func (t *admissionTicket) reject() {
+	t.done(true)
+}
+
+// Releases the connection of the ticket once and returns the token of the upgrade rate if requested.
+func (t *admissionTicket) done(refund bool) {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		a := t.admission
+		a.lock.Lock()
+		if refund && a.upgrades != nil {
+			if a.upgrades.tokens++; a.upgrades.tokens > float64(a.upgrades.limit.Burst) {
+				a.upgrades.tokens = float64(a.upgrades.limit.Burst)
+			}
+		}
+		a.total--
+		if a.perIP[t.ip]--; a.perIP[t.ip] <= 0 {
+			delete(a.perIP, t.ip)
+		}
+		a.lock.Unlock()
+	})
+}
+
+// Checks the admission limits. Responds with an error and returns false if the connection is
+// not admitted, otherwise the ticket needs to be released once the connection is closed.
+func (router *Router) admit(w http.ResponseWriter, r *http.Request) (*admissionTicket, bool) {
+	if router.admission == nil {
+		return nil, true
+	}
+	ticket, reason, status, wait := router.admission.admit(r)
+	if ticket != nil {
+		return ticket, true
+	}
+	router.rejected(r, reason)
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	}
+	http.Error(w, http.StatusText(status), status)
+	return nil, false
+}
+
+// Checks the admission limits for a connection served without HTTP response. Connections, that
+// are not admitted, are closed with a close frame. Otherwise the ticket needs to be released once
+// the connection is closed.
+func (router *Router) admitTransport(t Transport, r *http.Request) (*admissionTicket, bool) {
+	if router.admission == nil {
+		return nil, true
+	}
+	ticket, reason, status, _ := router.admission.admit(r)
+	if ticket != nil {
+		return ticket, true
+	}
+	router.rejected(r, reason)
+	go func() { // Do not block accepting.
+		t.SetWriteDeadline(time.Now().Add(writeWait))
+		t.WriteClose(netRejectedCode, http.StatusText(status))
+		t.Close()
+	}()
+	return nil, false
+}
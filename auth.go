@@ -0,0 +1,386 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoToken is returned if the request carries no token.
+	ErrNoToken = errors.New("No token provided.")
+	// ErrInvalidToken is returned if the token is malformed or its signature is invalid.
+	ErrInvalidToken = errors.New("Invalid token.")
+	// ErrTokenExpired is returned if the token is expired.
+	ErrTokenExpired = errors.New("Token expired.")
+	// ErrTokenNotYetValid is returned if the token is not valid yet.
+	ErrTokenNotYetValid = errors.New("Token not yet valid.")
+	// ErrInvalidAudience is returned if the token is not issued for the audience.
+	ErrInvalidAudience = errors.New("Invalid audience.")
+)
+
+// Claims are the verified claims of a token.
+type Claims map[string]interface{}
+
+// Subject returns the "sub" claim identifying the principal, empty if missing.
+func (c Claims) Subject() string {
+	sub, _ := c["sub"].(string)
+	return sub
+}
+
+// Returns a numeric date claim.
+func (c Claims) time(name string) (time.Time, bool) {
+	if v, ok := c[name].(float64); ok {
+		return time.Unix(int64(v), 0), true
+	}
+	return time.Time{}, false
+}
+
+// ExpiresAt returns the "exp" claim, the zero time if missing.
+func (c Claims) ExpiresAt() time.Time {
+	t, _ := c.time("exp")
+	return t
+}
+
+// Checks the types of the registered claims, that are verified. The claims exp and nbf need to be
+// numbers, aud a string or a list of strings, if present.
+func (c Claims) checkTypes() error {
+	for _, name := range []string{"exp", "nbf"} {
+		if v, ok := c[name]; ok {
+			if _, ok := v.(float64); !ok {
+				return ErrInvalidToken
+			}
+		}
+	}
+	if v, ok := c["aud"]; ok {
+		switch aud := v.(type) {
+		case string:
+		case []interface{}:
+			for _, a := range aud {
+				if _, ok := a.(string); !ok {
+					return ErrInvalidToken
+				}
+			}
+		default:
+			return ErrInvalidToken
+		}
+	}
+	return nil
+}
+
+// Returns whether the "aud" claim, a string or a list of strings, contains the audience.
+func (c Claims) hasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Key of the handshake state in the context of requests.
+type handshakeKey struct{}
+
+// State of a handshake, that is passed from the handshake callback to the connection.
+type handshakeState struct {
+	claims Claims
+	// Subprotocol carrying the token, which is not selected as protocol of the connection.
+	tokenProtocol string
+}
+
+// Returns the request carrying a handshake state, which allows the handshake callback to
+// pass claims to the connection.
+func withHandshakeState(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(handshakeKey{}).(*handshakeState); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), handshakeKey{}, &handshakeState{}))
+}
+
+// SetHandshakeClaims stores the claims of the handshake request, they are available using
+// Claims of the connection established by the request. It is used by the authenticators and can
+// be used by custom handshake callbacks.
+func SetHandshakeClaims(r *http.Request, claims Claims) {
+	if state, ok := r.Context().Value(handshakeKey{}).(*handshakeState); ok {
+		state.claims = claims
+	}
+}
+
+// Returns the subprotocol of the handshake request carrying the token, empty if none.
+func handshakeTokenProtocol(r *http.Request) string {
+	if state, ok := r.Context().Value(handshakeKey{}).(*handshakeState); ok {
+		return state.tokenProtocol
+	}
+	return ""
+}
+
+// Returns the claims stored for the handshake request, nil if none.
+func handshakeClaims(r *http.Request) Claims {
+	if state, ok := r.Context().Value(handshakeKey{}).(*handshakeState); ok {
+		return state.claims
+	}
+	return nil
+}
+
+// TokenSource extracts a token from a handshake request, empty if the request carries none.
+type TokenSource func(*http.Request) string
+
+// TokenFromQuery reads the token from the query parameter.
+func TokenFromQuery(name string) TokenSource {
+	return func(r *http.Request) string {
+		return r.URL.Query().Get(name)
+	}
+}
+
+// TokenFromCookie reads the token from the cookie.
+func TokenFromCookie(name string) TokenSource {
+	return func(r *http.Request) string {
+		if cookie, err := r.Cookie(name); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+}
+
+// TokenFromAuthorization reads a bearer token from the Authorization header.
+func TokenFromAuthorization() TokenSource {
+	return func(r *http.Request) string {
+		header := r.Header.Get("Authorization")
+		if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+			return strings.TrimSpace(header[7:])
+		}
+		return ""
+	}
+}
+
+// TokenFromProtocol reads the token from the first subprotocol of the Sec-WebSocket-Protocol
+// header with the prefix, because browsers cannot set other headers of WebSocket requests, e.g.
+// the client offers the protocols "bearer.<token>" and "chat" using the prefix "bearer.". The
+// subprotocol carrying the token is never selected as protocol of the connection.
+func TokenFromProtocol(prefix string) TokenSource {
+	return func(r *http.Request) string {
+		for _, protocol := range websocket.Subprotocols(r) {
+			if strings.HasPrefix(protocol, prefix) {
+				if state, ok := r.Context().Value(handshakeKey{}).(*handshakeState); ok {
+					state.tokenProtocol = protocol
+				}
+				return protocol[len(prefix):]
+			}
+		}
+		return ""
+	}
+}
+
+// JWTKeys are the local keys verifying JSON Web Tokens. Tokens are only accepted if a key of
+// the algorithm in their header is set.
+type JWTKeys struct {
+	// Secret of HS256.
+	HMAC []byte
+	// Public key of RS256.
+	RSA *rsa.PublicKey
+	// Public key of EdDSA.
+	Ed25519 ed25519.PublicKey
+}
+
+// Authenticator verifies tokens of handshake requests. Its Handshake method can be used as
+// handshake callback of a router:
+//     auth := golem.NewJWTAuthenticator(golem.JWTKeys{HMAC: secret})
+//     auth.SetAudience("chat")
+//     router.OnHandshake(auth.Handshake)
+// The claims of the token are available using Claims of the connection afterwards.
+type Authenticator struct {
+	// Verifies the signature of a token and returns its claims.
+	verify func(string) (Claims, error)
+	// Sources tried in order to extract the token.
+	sources []TokenSource
+	// Required audience, empty if not checked.
+	audience string
+	// Tolerated clock skew of exp and nbf.
+	leeway time.Duration
+}
+
+// Creates an authenticator using the verification function, reading tokens from the
+// Authorization header and the query parameter "access_token" by default.
+func newAuthenticator(verify func(string) (Claims, error)) *Authenticator {
+	return &Authenticator{
+		verify:  verify,
+		sources: []TokenSource{TokenFromAuthorization(), TokenFromQuery("access_token")},
+	}
+}
+
+// NewJWTAuthenticator creates an authenticator of JSON Web Tokens signed using HS256, RS256 or
+// EdDSA with the provided keys. The claims exp and nbf are checked if present.
+func NewJWTAuthenticator(keys JWTKeys) *Authenticator {
+	return newAuthenticator(func(token string) (Claims, error) {
+		return verifyJWT(keys, token)
+	})
+}
+
+// NewHMACAuthenticator creates an authenticator of compact HMAC tokens, which consist of the
+// base64url encoded JSON claims and their base64url encoded HMAC-SHA256 signature, separated by
+// a dot. The claims exp and nbf are checked if present.
+func NewHMACAuthenticator(key []byte) *Authenticator {
+	return newAuthenticator(func(token string) (Claims, error) {
+		parts := strings.Split(token, ".")
+		if len(parts) != 2 {
+			return nil, ErrInvalidToken
+		}
+		signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil || len(key) == 0 || !hmac.Equal(signature, hmacSHA256(key, parts[0])) {
+			return nil, ErrInvalidToken
+		}
+		return decodeClaims(parts[0])
+	})
+}
+
+// SetTokenSources sets the sources tried in order to extract the token of requests.
+func (a *Authenticator) SetTokenSources(sources ...TokenSource) {
+	a.sources = sources
+}
+
+// SetAudience sets the audience, that the "aud" claim of tokens needs to contain. By default
+// the audience is not checked.
+func (a *Authenticator) SetAudience(audience string) {
+	a.audience = audience
+}
+
+// SetLeeway sets the tolerated clock skew when checking exp and nbf, by default none.
+func (a *Authenticator) SetLeeway(leeway time.Duration) {
+	a.leeway = leeway
+}
+
+// Verify verifies the token and checks its claims, returning them if valid. Tokens with claims
+// exp, nbf or aud of invalid types are rejected.
+func (a *Authenticator) Verify(token string) (Claims, error) {
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := claims.checkTypes(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if exp, ok := claims.time("exp"); ok && now.After(exp.Add(a.leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(a.leeway).Before(nbf) {
+		return nil, ErrTokenNotYetValid
+	}
+	if a.audience != "" && !claims.hasAudience(a.audience) {
+		return nil, ErrInvalidAudience
+	}
+	return claims, nil
+}
+
+// Authenticate verifies the token of the request, using the first token source providing one.
+func (a *Authenticator) Authenticate(r *http.Request) (Claims, error) {
+	for _, source := range a.sources {
+		if token := source(r); token != "" {
+			return a.Verify(token)
+		}
+	}
+	return nil, ErrNoToken
+}
+
+// Handshake authenticates the request and stores the claims for the connection. It returns
+// false if authentication failed and can be used as handshake callback of routers.
+func (a *Authenticator) Handshake(w http.ResponseWriter, r *http.Request) bool {
+	claims, err := a.Authenticate(r)
+	if err != nil {
+		return false
+	}
+	SetHandshakeClaims(r, claims)
+	return true
+}
+
+// Returns the HMAC-SHA256 of the data.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Decodes base64url encoded JSON claims.
+func decodeClaims(encoded string) (Claims, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(data, &claims); err != nil || claims == nil {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// Verifies the signature of a JSON Web Token and returns its claims.
+func verifyJWT(keys JWTKeys, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signed := parts[0] + "." + parts[1]
+	valid := false
+	switch header.Alg {
+	case "HS256":
+		valid = len(keys.HMAC) > 0 && hmac.Equal(signature, hmacSHA256(keys.HMAC, signed))
+	case "RS256":
+		if keys.RSA != nil {
+			digest := sha256.Sum256([]byte(signed))
+			valid = rsa.VerifyPKCS1v15(keys.RSA, crypto.SHA256, digest[:], signature) == nil
+		}
+	case "EdDSA":
+		valid = len(keys.Ed25519) == ed25519.PublicKeySize && ed25519.Verify(keys.Ed25519, []byte(signed), signature)
+	}
+	if !valid {
+		return nil, ErrInvalidToken
+	}
+	return decodeClaims(parts[1])
+}
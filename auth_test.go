@@ -0,0 +1,175 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("secret")
+
+// Returns a JWT with the claims signed using the function.
+func testJWT(alg string, claims map[string]interface{}, sign func([]byte) []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(input)))
+}
+
+func signHS256(input []byte) []byte {
+	mac := hmac.New(sha256.New, testSecret)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key failed: %v", err)
+	}
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating Ed25519 key failed: %v", err)
+	}
+	signRS256 := func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		return signature
+	}
+	signEdDSA := func(input []byte) []byte {
+		return ed25519.Sign(edPrivate, input)
+	}
+	claims := map[string]interface{}{"sub": "alice", "aud": []string{"other", "chat"}, "exp": time.Now().Unix() + 60}
+
+	a := NewJWTAuthenticator(JWTKeys{HMAC: testSecret, RSA: &rsaKey.PublicKey, Ed25519: edPublic})
+	a.SetAudience("chat")
+	for _, token := range []string{testJWT("HS256", claims, signHS256), testJWT("RS256", claims, signRS256), testJWT("EdDSA", claims, signEdDSA)} {
+		if verified, err := a.Verify(token); err != nil || verified.Subject() != "alice" {
+			t.Fatalf("verifying %s failed: %v", token, err)
+		}
+	}
+	if _, err := a.Verify(testJWT("none", claims, func([]byte) []byte { return nil })); err != ErrInvalidToken {
+		t.Fatalf("expected unsigned token to be rejected, received %v", err)
+	}
+	// Algorithms are only accepted if the key of the algorithm is configured.
+	rsaOnly := NewJWTAuthenticator(JWTKeys{RSA: &rsaKey.PublicKey})
+	if _, err := rsaOnly.Verify(testJWT("HS256", claims, signHS256)); err != ErrInvalidToken {
+		t.Fatalf("expected HS256 to be rejected without HMAC key, received %v", err)
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	now := time.Now().Unix()
+	a := NewJWTAuthenticator(JWTKeys{HMAC: testSecret})
+	a.SetAudience("chat")
+	tests := []struct {
+		claims   map[string]interface{}
+		expected error
+	}{
+		{map[string]interface{}{"aud": "chat", "exp": now - 10}, ErrTokenExpired},
+		{map[string]interface{}{"aud": "chat", "nbf": now + 100}, ErrTokenNotYetValid},
+		{map[string]interface{}{"aud": "other"}, ErrInvalidAudience},
+		{map[string]interface{}{"aud": "chat", "exp": "never"}, ErrInvalidToken},
+		{map[string]interface{}{"aud": "chat", "nbf": true}, ErrInvalidToken},
+		{map[string]interface{}{"aud": 5}, ErrInvalidToken},
+		{map[string]interface{}{"aud": []interface{}{"chat", 1}}, ErrInvalidToken},
+	}
+	for _, test := range tests {
+		if _, err := a.Verify(testJWT("HS256", test.claims, signHS256)); err != test.expected {
+			t.Errorf("claims %v: expected %v, received %v", test.claims, test.expected, err)
+		}
+	}
+}
+
+func TestHMACKeyRequired(t *testing.T) {
+	signEmpty := func(input []byte) []byte {
+		mac := hmac.New(sha256.New, nil)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+	token := testJWT("HS256", map[string]interface{}{"sub": "alice"}, signEmpty)
+	if _, err := NewJWTAuthenticator(JWTKeys{HMAC: []byte{}}).Verify(token); err != ErrInvalidToken {
+		t.Fatalf("expected token signed with empty key to be rejected, received %v", err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice"}`))
+	if _, err := NewHMACAuthenticator(nil).Verify(payload + "." + base64.RawURLEncoding.EncodeToString(signEmpty([]byte(payload)))); err != ErrInvalidToken {
+		t.Fatalf("expected HMAC authenticator without key to reject tokens, received %v", err)
+	}
+	if claims, err := NewHMACAuthenticator(testSecret).Verify(payload + "." + base64.RawURLEncoding.EncodeToString(signHS256([]byte(payload)))); err != nil || claims.Subject() != "alice" {
+		t.Fatalf("verifying HMAC token failed: %v", err)
+	}
+}
+
+func TestHandshakeTokenSources(t *testing.T) {
+	a := NewJWTAuthenticator(JWTKeys{HMAC: testSecret})
+	a.SetTokenSources(TokenFromProtocol("bearer."), TokenFromCookie("token"), TokenFromQuery("access_token"))
+	router := NewRouter()
+	router.OnHandshake(a.Handshake)
+	subjects := make(chan string, 1)
+	router.On("who", func(conn *Connection) {
+		subjects <- conn.Claims().Subject()
+	})
+	server := httptest.NewServer(http.HandlerFunc(router.Handler()))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	token := testJWT("HS256", map[string]interface{}{"sub": "alice"}, signHS256)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"bearer." + token, "chat"}}
+	socket, res, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dialing with token in subprotocol failed: %v", err)
+	}
+	if protocol := res.Header.Get("Sec-Websocket-Protocol"); protocol != "chat" {
+		t.Fatalf("expected subprotocol chat to be selected, received %q", protocol)
+	}
+	socket.WriteMessage(websocket.TextMessage, []byte("who null"))
+	if subject := <-subjects; subject != "alice" {
+		t.Fatalf("expected subject alice, received %q", subject)
+	}
+	socket.Close()
+
+	header := http.Header{}
+	header.Set("Cookie", "token="+token)
+	for _, dial := range []struct {
+		url    string
+		header http.Header
+	}{{url, header}, {url + "?access_token=" + token, nil}} {
+		socket, _, err := websocket.DefaultDialer.Dial(dial.url, dial.header)
+		if err != nil {
+			t.Fatalf("dialing %s failed: %v", dial.url, err)
+		}
+		socket.Close()
+	}
+	if _, res, err := websocket.DefaultDialer.Dial(url+"?access_token=invalid", nil); err == nil || res.StatusCode != 403 {
+		t.Fatalf("expected invalid token to be rejected, received %v", err)
+	}
+}
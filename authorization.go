@@ -0,0 +1,183 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"strings"
+)
+
+// Policy decides whether the principal of the connection is authorized, e.g. to emit an event
+// or to join a room. The principal is available using Claims of the connection.
+type Policy func(*Connection) bool
+
+// AuthorizationError is reported to the error callback if a connection was denied to emit an
+// event or to join a room.
+type AuthorizationError struct {
+	// Event denied to be emitted, empty if a room was denied to be joined.
+	Event string
+	// Room denied to be joined, empty if an event was denied to be emitted.
+	Room string
+}
+
+// Error describes the denied attempt.
+func (e *AuthorizationError) Error() string {
+	if e.Room != "" {
+		return "Not authorized to join room " + e.Room + "."
+	}
+	return "Not authorized to emit event " + e.Event + "."
+}
+
+// Roles returns the "roles" claim, a string or a list of strings.
+func (c Claims) Roles() []string {
+	return c.strings("roles", false)
+}
+
+// Scopes returns the scopes of the "scope" claim, a space separated string, or of the "scp"
+// claim, a list of strings.
+func (c Claims) Scopes() []string {
+	if scopes := c.strings("scope", true); scopes != nil {
+		return scopes
+	}
+	return c.strings("scp", true)
+}
+
+// Returns the strings of the claim, which is a list or a string, that is split at spaces
+// if requested.
+func (c Claims) strings(name string, split bool) []string {
+	switch v := c[name].(type) {
+	case string:
+		if split {
+			return strings.Fields(v)
+		}
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, value := range v {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Returns whether the values contain any of the required ones.
+func containsAny(values []string, required []string) bool {
+	for _, r := range required {
+		for _, v := range values {
+			if v == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequireRoles returns a policy authorizing connections, whose principal has any of the roles.
+// Without roles all connections are authorized, as by RequireScopes without scopes.
+func RequireRoles(roles ...string) Policy {
+	return func(conn *Connection) bool {
+		return len(roles) == 0 || containsAny(conn.Claims().Roles(), roles)
+	}
+}
+
+// RequireScopes returns a policy authorizing connections, whose principal has all of the scopes.
+// Without scopes all connections are authorized.
+func RequireScopes(scopes ...string) Policy {
+	return func(conn *Connection) bool {
+		granted := conn.Claims().Scopes()
+		for _, scope := range scopes {
+			if !containsAny(granted, []string{scope}) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Returns whether all policies authorize the connection.
+func authorized(conn *Connection, policies []Policy) bool {
+	for _, policy := range policies {
+		if !policy(conn) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sets the policies of the event, removes them if there are none.
+func (router *Router) setPolicies(event string, policies []Policy) {
+	if len(policies) > 0 {
+		router.policies[event] = policies
+	} else {
+		delete(router.policies, event)
+	}
+}
+
+// Checks the policies of the event registered using On or OnStream. Reports the denied attempt and returns
+// false if the connection is not authorized.
+func (router *Router) authorize(conn *Connection, event string) bool {
+	if authorized(conn, router.policies[event]) {
+		return true
+	}
+	router.reportError(conn, &AuthorizationError{Event: event})
+	return false
+}
+
+// SetRoomPolicy sets the policies connections need to satisfy to join the room. Names ending
+// with "*" match all rooms with the preceding prefix, e.g. "mod:*", the policies of the longest
+// matching name apply. Denied attempts to join are reported to the error callback of the router
+// of the connection. Without policies all connections may join the room.
+func (rm *RoomManager) SetRoomPolicy(name string, policies ...Policy) {
+	rm.policyLock.Lock()
+	defer rm.policyLock.Unlock()
+	if len(policies) == 0 {
+		delete(rm.policies, name)
+		return
+	}
+	rm.policies[name] = policies
+}
+
+// Returns the policies of the room.
+func (rm *RoomManager) roomPolicies(room string) []Policy {
+	rm.policyLock.RLock()
+	defer rm.policyLock.RUnlock()
+	if policies, ok := rm.policies[room]; ok {
+		return policies
+	}
+	var match string
+	var policies []Policy
+	for name, p := range rm.policies {
+		if strings.HasSuffix(name, "*") && strings.HasPrefix(room, name[:len(name)-1]) && len(name) > len(match) {
+			match, policies = name, p
+		}
+	}
+	return policies
+}
+
+// Checks the policies of the room. Reports the denied attempt and returns false if the
+// connection is not authorized.
+func (rm *RoomManager) authorize(room string, conn *Connection) bool {
+	if authorized(conn, rm.roomPolicies(room)) {
+		return true
+	}
+	conn.router.reportError(conn, &AuthorizationError{Room: room})
+	return false
+}
@@ -0,0 +1,184 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Connects a memory transport to the router, whose connection has the claims, and returns the
+// end of the client.
+func connectClaims(t *testing.T, router *Router, claims Claims) *MemoryTransport {
+	client, server := NewMemoryTransportPair()
+	r := withHandshakeState(httptest.NewRequest("GET", "/", nil))
+	SetHandshakeClaims(r, claims)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeTransport(server, r)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+// Returns a router with policies on the events "kick" and "post" reporting errors to the channel.
+func policyRouter(errs chan error) *Router {
+	router := NewRouter()
+	router.SetErrorEvent("error")
+	router.OnError(func(conn *Connection, err error) {
+		errs <- err
+	})
+	router.On("kick", func(conn *Connection) {
+		conn.Emit("kicked", nil)
+	}, RequireRoles("moderator", "admin"))
+	router.On("post", func(conn *Connection, data *testMessage) {
+		conn.Emit("posted", data)
+	}, RequireScopes("chat:read", "chat:write"))
+	router.On("ping", func(conn *Connection) {
+		conn.Emit("pong", nil)
+	})
+	return router
+}
+
+func TestEventPolicies(t *testing.T) {
+	errs := make(chan error, 4)
+	router := policyRouter(errs)
+
+	client := connectClaims(t, router, Claims{"roles": "user", "scope": "chat:read"})
+	writeMemory(client, `kick null`, `post {"text":"hi"}`, `ping null`)
+	for _, expected := range []string{
+		`error {"error":"Not authorized to emit event kick.","event":"kick"}`,
+		`error {"error":"Not authorized to emit event post.","event":"post"}`,
+		`pong null`,
+	} {
+		if data := readMemory(t, client); data != expected {
+			t.Fatalf("expected %q, read %q", expected, data)
+		}
+	}
+	for _, event := range []string{"kick", "post"} {
+		select {
+		case err := <-errs:
+			if authErr, ok := err.(*AuthorizationError); !ok || authErr.Event != event {
+				t.Fatalf("expected authorization error of event %s, received %v", event, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("denied event %s not reported", event)
+		}
+	}
+
+	client = connectClaims(t, router, Claims{"roles": []interface{}{"user", "admin"}, "scp": []interface{}{"chat:write", "chat:read"}})
+	writeMemory(client, `kick null`, `post {"text":"hi"}`)
+	for _, expected := range []string{`kicked null`, `posted {"text":"hi"}`} {
+		if data := readMemory(t, client); data != expected {
+			t.Fatalf("expected authorized event to be handled, read %q instead of %q", data, expected)
+		}
+	}
+
+	// Registering the callback again without policies removes them.
+	router = policyRouter(errs)
+	router.On("kick", func(conn *Connection) {
+		conn.Emit("kicked", nil)
+	})
+	client = connectClaims(t, router, nil)
+	writeMemory(client, `kick null`)
+	if data := readMemory(t, client); data != `kicked null` {
+		t.Fatalf("expected policies to be removed, read %q", data)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("expected no further errors, received %v", <-errs)
+	}
+}
+
+func TestRequirePolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy Policy
+		claims Claims
+		allow  bool
+	}{
+		{RequireRoles(), nil, true},
+		{RequireRoles("admin"), nil, false},
+		{RequireRoles("admin"), Claims{"roles": "admin"}, true},
+		{RequireRoles("admin"), Claims{"roles": "admin user"}, false},
+		{RequireRoles("admin", "moderator"), Claims{"roles": []interface{}{"user", "moderator"}}, true},
+		{RequireScopes(), nil, true},
+		{RequireScopes("read"), Claims{"scope": "write read"}, true},
+		{RequireScopes("read", "write"), Claims{"scope": "read"}, false},
+		{RequireScopes("read", "write"), Claims{"scp": []interface{}{"write", "read"}}, true},
+		{RequireScopes("read"), Claims{"scp": []interface{}{"read write"}}, false},
+	} {
+		conn := &Connection{claims: test.claims}
+		if allow := test.policy(conn); allow != test.allow {
+			t.Fatalf("expected policy to return %v for claims %v, returned %v", test.allow, test.claims, allow)
+		}
+	}
+}
+
+func TestRoomPolicies(t *testing.T) {
+	errs := make(chan error, 4)
+	router := NewRouter()
+	router.OnError(func(conn *Connection, err error) {
+		errs <- err
+	})
+	connected := make(chan *Connection, 1)
+	router.OnConnect(func(conn *Connection, r *http.Request) {
+		connected <- conn
+	})
+	connectClaims(t, router, Claims{"roles": "moderator"})
+	conn := <-connected
+
+	rm := NewRoomManager()
+	defer rm.Stop()
+	rm.SetRoomPolicy("mod:*", RequireRoles("moderator"))
+	rm.SetRoomPolicy("mod:admin:*", RequireRoles("admin"))
+	rm.SetRoomPolicy("mod:admin:lobby", RequireRoles("moderator"))
+	for _, test := range []struct {
+		room  string
+		allow bool
+	}{
+		{"lobby", true},
+		{"mod:chat", true},
+		{"mod:admin:chat", false},
+		{"mod:admin:lobby", true},
+	} {
+		if allow := rm.TryJoin(test.room, conn); allow != test.allow {
+			t.Fatalf("expected joining room %s to return %v, returned %v", test.room, test.allow, allow)
+		}
+	}
+	if err, ok := (<-errs).(*AuthorizationError); !ok || err.Room != "mod:admin:chat" {
+		t.Fatalf("expected denied join to be reported, received %v", err)
+	}
+	if rooms := rm.takeSnapshot().rooms; len(rooms) != 3 || rooms["mod:admin:chat"] != 0 {
+		t.Fatalf("expected connection to join the allowed rooms only, joined %v", rooms)
+	}
+
+	rm.Join("mod:admin:other", conn)
+	if err, ok := (<-errs).(*AuthorizationError); !ok || err.Room != "mod:admin:other" {
+		t.Fatalf("expected denied join to be reported, received %v", err)
+	}
+	rm.SetRoomPolicy("mod:admin:*")
+	if !rm.TryJoin("mod:admin:other", conn) {
+		t.Fatal("expected policies of the room to be removed")
+	}
+}
@@ -0,0 +1,231 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+const (
+	// BinaryFlagEventID is set if the event is encoded as registered ID instead of by name.
+	BinaryFlagEventID = 1 << 0
+	// BinaryFlagMessageID is set if the frame carries a message ID.
+	BinaryFlagMessageID = 1 << 1
+	// BinaryFlagRaw is set if the payload is raw bytes instead of JSON.
+	BinaryFlagRaw = 1 << 2
+	// BinaryFlagTraceParent is set if the frame carries a W3C traceparent.
+	BinaryFlagTraceParent = 1 << 3
+)
+
+// BinaryFrame is a decoded frame of the BinaryFrameProtocol. Handlers taking interface{}
+// as data receive incoming frames directly. Emitting a frame allows setting a message ID,
+// the payload is written verbatim.
+type BinaryFrame struct {
+	// Flags of the frame, BinaryFlagEventID is set automatically.
+	Flags byte
+	// Message ID, only valid if BinaryFlagMessageID is set.
+	ID uint64
+	// W3C traceparent, only valid if BinaryFlagTraceParent is set.
+	TraceParent string
+	// Payload of the frame, for incoming frames it references the received data.
+	Payload []byte
+}
+
+// BinaryFrameProtocol is a compact binary protocol, which allows any event names and binary
+// payloads. Every frame starts with a header followed by the payload:
+//
+//	flags (1 byte)
+//	event: uvarint ID if BinaryFlagEventID is set, otherwise uvarint length followed by the name
+//	message ID: uvarint, only if BinaryFlagMessageID is set
+//	traceparent: uvarint length followed by the traceparent, only if BinaryFlagTraceParent is set
+//	payload: remaining bytes, JSON unless BinaryFlagRaw is set
+//
+// Events registered with an ID are send using the ID. Handlers taking []byte receive the payload
+// without copying and emitted byte slices are written verbatim, all other data is marshalled as JSON.
+type BinaryFrameProtocol struct {
+	// Event names by ID.
+	names map[uint64]string
+	// Event IDs by name.
+	ids map[string]uint64
+	// Guards names and ids.
+	lock sync.RWMutex
+}
+
+// NewBinaryFrameProtocol initialises a new instance and returns the pointer.
+func NewBinaryFrameProtocol() *BinaryFrameProtocol {
+	return &BinaryFrameProtocol{
+		names: make(map[uint64]string),
+		ids:   make(map[string]uint64),
+	}
+}
+
+// RegisterEvent associates the event name with a numeric ID, which is used instead of the name
+// in the header of outgoing frames and accepted for incoming frames. Both sides need to agree on
+// the registered IDs.
+func (p *BinaryFrameProtocol) RegisterEvent(id uint64, name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.names[id] = name
+	p.ids[name] = id
+}
+
+// Unpack decodes the header and returns the event name and the frame as interstage product.
+func (p *BinaryFrameProtocol) Unpack(data []byte) (string, interface{}, error) {
+	if len(data) < 1 {
+		return "", nil, errors.New("Binary frame without header.")
+	}
+	frame := &BinaryFrame{Flags: data[0]}
+	rest := data[1:]
+	var name string
+	if frame.Flags&BinaryFlagEventID != 0 {
+		id, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return "", nil, errors.New("Invalid event ID in binary frame.")
+		}
+		rest = rest[n:]
+		p.lock.RLock()
+		registered, ok := p.names[id]
+		p.lock.RUnlock()
+		if !ok {
+			return "", nil, errors.New("Unknown event ID in binary frame.")
+		}
+		name = registered
+	} else {
+		length, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < length {
+			return "", nil, errors.New("Invalid event name in binary frame.")
+		}
+		name = string(rest[n : n+int(length)])
+		rest = rest[n+int(length):]
+	}
+	if frame.Flags&BinaryFlagMessageID != 0 {
+		id, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return "", nil, errors.New("Invalid message ID in binary frame.")
+		}
+		frame.ID = id
+		rest = rest[n:]
+	}
+	if frame.Flags&BinaryFlagTraceParent != 0 {
+		length, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < length {
+			return "", nil, errors.New("Invalid traceparent in binary frame.")
+		}
+		frame.TraceParent = string(rest[n : n+int(length)])
+		rest = rest[n+int(length):]
+	}
+	frame.Payload = rest
+	return name, frame, nil
+}
+
+// Unmarshal forwards the payload to byte slices and unmarshals JSON into any other structure.
+func (_ *BinaryFrameProtocol) Unmarshal(data interface{}, typePtr interface{}) error {
+	frame := data.(*BinaryFrame)
+	if raw, ok := typePtr.(*[]byte); ok {
+		*raw = frame.Payload
+		return nil
+	}
+	return json.Unmarshal(frame.Payload, typePtr)
+}
+
+// MarshalAndPack writes the header followed by the payload. Byte slices and the payload of
+// frames are written verbatim, any other data is marshalled as JSON.
+func (p *BinaryFrameProtocol) MarshalAndPack(name string, data interface{}) ([]byte, error) {
+	var frame BinaryFrame
+	switch d := data.(type) {
+	case *BinaryFrame:
+		frame = *d
+	case []byte:
+		frame.Flags = BinaryFlagRaw
+		frame.Payload = d
+	default:
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		frame.Payload = payload
+	}
+
+	p.lock.RLock()
+	id, registered := p.ids[name]
+	p.lock.RUnlock()
+	frame.Flags &^= BinaryFlagEventID
+	if registered {
+		frame.Flags |= BinaryFlagEventID
+	}
+
+	out := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(name)+len(frame.Payload))
+	out = append(out, frame.Flags)
+	if registered {
+		out = appendUvarint(out, id)
+	} else {
+		out = appendUvarint(out, uint64(len(name)))
+		out = append(out, name...)
+	}
+	if frame.Flags&BinaryFlagMessageID != 0 {
+		out = appendUvarint(out, frame.ID)
+	}
+	if frame.Flags&BinaryFlagTraceParent != 0 {
+		out = appendUvarint(out, uint64(len(frame.TraceParent)))
+		out = append(out, frame.TraceParent...)
+	}
+	return append(out, frame.Payload...), nil
+}
+
+// Appends the uvarint encoding of v.
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// PackChunk transmits chunks of streams raw using the stream ID as message ID.
+func (_ *BinaryFrameProtocol) PackChunk(id uint64, chunk []byte) interface{} {
+	return &BinaryFrame{Flags: BinaryFlagMessageID | BinaryFlagRaw, ID: id, Payload: chunk}
+}
+
+// UnpackChunk returns the message ID and payload of frames carrying a message ID.
+func (_ *BinaryFrameProtocol) UnpackChunk(data interface{}) (uint64, []byte, bool) {
+	frame, ok := data.(*BinaryFrame)
+	if !ok || frame.Flags&BinaryFlagMessageID == 0 {
+		return 0, nil, false
+	}
+	return frame.ID, frame.Payload, true
+}
+
+// UnpackTrace returns the traceparent of frames carrying one, the frame is passed on as is.
+func (_ *BinaryFrameProtocol) UnpackTrace(name string, data interface{}) (string, interface{}, string) {
+	if frame, ok := data.(*BinaryFrame); ok && frame.Flags&BinaryFlagTraceParent != 0 {
+		return name, data, frame.TraceParent
+	}
+	return name, data, ""
+}
+
+// Return BinaryMode because frames are transmitted using the binary mode of WebSockets.
+func (_ *BinaryFrameProtocol) GetReadMode() int {
+	return BinaryMode
+}
+
+// Return BinaryMode because frames are transmitted using the binary mode of WebSockets.
+func (_ *BinaryFrameProtocol) GetWriteMode() int {
+	return BinaryMode
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2013 Niklas Voss
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package golem
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"testing"
+	"time"
+)
+
+func TestBinaryFrameRoundTrip(t *testing.T) {
+	p := NewBinaryFrameProtocol()
+	p.RegisterEvent(7, "registered")
+	frames := []struct {
+		name  string
+		data  interface{}
+		frame BinaryFrame
+	}{
+		{"echo", &testMessage{Text: "hi"}, BinaryFrame{Payload: []byte(`{"text":"hi"}`)}},
+		{"", []byte{0, 1, 2}, BinaryFrame{Flags: BinaryFlagRaw, Payload: []byte{0, 1, 2}}},
+		{"registered", []byte("raw"), BinaryFrame{Flags: BinaryFlagEventID | BinaryFlagRaw, Payload: []byte("raw")}},
+		{"ids", &BinaryFrame{Flags: BinaryFlagMessageID, ID: 1 << 40, Payload: []byte("1")},
+			BinaryFrame{Flags: BinaryFlagMessageID, ID: 1 << 40, Payload: []byte("1")}},
+		{"registered", &BinaryFrame{Flags: BinaryFlagMessageID | BinaryFlagTraceParent, ID: 3, TraceParent: testTraceParent},
+			BinaryFrame{Flags: BinaryFlagEventID | BinaryFlagMessageID | BinaryFlagTraceParent, ID: 3, TraceParent: testTraceParent}},
+	}
+	for _, f := range frames {
+		packed, err := p.MarshalAndPack(f.name, f.data)
+		if err != nil {
+			t.Fatalf("packing %q failed: %v", f.name, err)
+		}
+		name, data, err := p.Unpack(packed)
+		if err != nil {
+			t.Fatalf("unpacking %q failed: %v", f.name, err)
+		}
+		frame := data.(*BinaryFrame)
+		if name != f.name || frame.Flags != f.frame.Flags || frame.ID != f.frame.ID ||
+			frame.TraceParent != f.frame.TraceParent || !bytes.Equal(frame.Payload, f.frame.Payload) {
+			t.Fatalf("expected %q %+v, received %q %+v", f.name, f.frame, name, frame)
+		}
+	}
+}
+
+func TestBinaryFrameMalformed(t *testing.T) {
+	p := NewBinaryFrameProtocol()
+	p.RegisterEvent(7, "registered")
+	frames := [][]byte{
+		{},               // No header.
+		{0},              // No event name length.
+		{0, 5, 'e', 'c'}, // Truncated event name.
+		{0, 0x80},        // Truncated uvarint.
+		{0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, // Overflowing uvarint.
+		{BinaryFlagEventID},                                          // No event ID.
+		{BinaryFlagEventID, 8},                                       // Unknown event ID.
+		{BinaryFlagEventID | BinaryFlagMessageID, 7},                 // No message ID.
+		{BinaryFlagEventID | BinaryFlagMessageID, 7, 0x80},           // Truncated message ID.
+		{BinaryFlagEventID | BinaryFlagTraceParent, 7},               // No traceparent length.
+		{BinaryFlagEventID | BinaryFlagTraceParent, 7, 55, '0', '0'}, // Truncated traceparent.
+	}
+	for _, frame := range frames {
+		if name, _, err := p.Unpack(frame); err == nil {
+			t.Fatalf("expected error for frame %v, unpacked %q", frame, name)
+		}
+	}
+}
+
+func TestBinaryFrameRouter(t *testing.T) {
+	router := NewRouter()
+	p := NewBinaryFrameProtocol()
+	p.RegisterEvent(1, "echo")
+	router.SetProtocol(p)
+	router.On("echo", func(conn *Connection, data []byte) {
+		conn.Emit("echo", data)
+	})
+	router.On("json", func(conn *Connection, data *testMessage) {
+		conn.Emit("reply", data)
+	})
+	socket := dialTest(t, router.Handler(), "/")
+
+	write := func(data []byte) {
+		if err := socket.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatalf("writing failed: %v", err)
+		}
+	}
+	write([]byte{0, 2, 'e', 'c'}) // Truncated frames are dropped.
+	write([]byte{BinaryFlagEventID, 9})
+	write([]byte{BinaryFlagEventID | BinaryFlagRaw, 1, 0xde, 0xad})
+	if answer := readTest(t, socket); answer != string([]byte{BinaryFlagEventID | BinaryFlagRaw, 1, 0xde, 0xad}) {
+		t.Fatalf("unexpected answer %v", []byte(answer))
+	}
+	write(append([]byte{0, 4, 'j', 's', 'o', 'n'}, `{"text":"hi"}`...))
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	mode, answer, err := socket.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading failed: %v", err)
+	}
+	if mode != websocket.BinaryMessage || string(answer) != "\x00\x05reply"+`{"text":"hi"}` {
+		t.Fatalf("unexpected answer %q", answer)
+	}
+}
@@ -0,0 +1,439 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/trevex/golem"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// Time allowed to write a message to the server.
+	writeWait = 10 * time.Second
+	// Time waited for the server to confirm the close frame.
+	closeWait = time.Second
+	// Outgoing default channel size.
+	defaultSendBufferSize = 512
+)
+
+var (
+	// ErrClosed is returned when emitting on a closed connection.
+	ErrClosed = errors.New("Connection closed.")
+)
+
+// Options configure a client connection, the zero value uses the defaults.
+type Options struct {
+	// Protocol used to pack and unpack messages, it has to match the protocol of the
+	// router. Defaults to golem.DefaultJSONProtocol.
+	Protocol golem.Protocol
+	// Header send with the handshake, e.g. for cookies or authorization.
+	Header http.Header
+	// Dialer used for the handshake, defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+	// OnOpen is called before the connection starts reading, handlers registered in it
+	// do not miss messages emitted by the connection callback of the server.
+	OnOpen func(*Conn)
+	// Interval of pings send by the client, zero disables pings. The router answers pings
+	// independent of its heartbeat setting.
+	PingInterval time.Duration
+	// Time allowed between incoming messages, pings and pongs, zero disables the timeout.
+	// If the router uses heartbeats it pings every 54 seconds, so a timeout of 60 seconds
+	// detects dead connections without pinging.
+	ReadTimeout time.Duration
+	// Maximum size of incoming messages, zero means no limit.
+	MaxMessageSize int64
+	// Size of the buffer of outgoing messages, defaults to 512.
+	SendBufferSize int
+}
+
+// Conn is a client connection to a golem router.
+type Conn struct {
+	// The underlying transport.
+	transport golem.Transport
+	// Protocol and options of the connection.
+	protocol golem.Protocol
+	opts     Options
+	// Handlers by event, protocol extensions and close callback.
+	callbacks  map[string]func(interface{})
+	extensions map[reflect.Type]reflect.Value
+	closeFunc  func(error)
+	// Guards callbacks, extensions and closeFunc.
+	lock sync.RWMutex
+	// Buffered channel of packed outbound messages.
+	send chan []byte
+	// Closed when the connection shuts down and when reading stopped.
+	done       chan struct{}
+	readerDone chan struct{}
+	closeOnce  sync.Once
+	// Status code and reason of the close frame and error the connection closed with.
+	closeCode   int
+	closeReason string
+	err         error
+}
+
+// Dial establishes a WebSocket connection to the router at the URL. The context only
+// limits the handshake.
+func Dial(ctx context.Context, url string, opts *Options) (*Conn, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	dialer := opts.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	socket, _, err := dialer.DialContext(ctx, url, opts.Header)
+	if err != nil {
+		return nil, err
+	}
+	transport := golem.NewWebSocketTransport(socket)
+	// Pings of the server extend the read timeout like any other incoming data.
+	socket.SetPingHandler(func(data string) error {
+		if opts.ReadTimeout > 0 {
+			transport.SetReadDeadline(time.Now().Add(opts.ReadTimeout))
+		}
+		err := socket.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+		if err == websocket.ErrCloseSent {
+			return nil
+		} else if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil
+		}
+		return err
+	})
+	return NewConn(transport, opts), nil
+}
+
+// NewConn creates a client connection using an established transport, e.g. a stream
+// connection served by Router.Serve using golem.NewNetTransport.
+func NewConn(transport golem.Transport, opts *Options) *Conn {
+	if opts == nil {
+		opts = &Options{}
+	}
+	conn := &Conn{
+		transport:  transport,
+		protocol:   opts.Protocol,
+		opts:       *opts,
+		callbacks:  make(map[string]func(interface{})),
+		extensions: make(map[reflect.Type]reflect.Value),
+		closeFunc:  func(error) {},
+		done:       make(chan struct{}),
+		readerDone: make(chan struct{}),
+	}
+	if conn.protocol == nil {
+		conn.protocol = &golem.DefaultJSONProtocol{}
+	}
+	size := opts.SendBufferSize
+	if size <= 0 {
+		size = defaultSendBufferSize
+	}
+	conn.send = make(chan []byte, size)
+	if opts.OnOpen != nil {
+		opts.OnOpen(conn)
+	}
+	go conn.writePump()
+	go conn.readPump()
+	return conn
+}
+
+// On adds the callback for the event. Like the handlers of the router, callbacks of the types
+//
+//	func()
+//	func(interface{})
+//	func([]byte)
+//	func(*T)
+//
+// are accepted, where interface{} receives the interstage data of the protocol, []byte the raw data
+// and *T the data unmarshalled by the protocol. Types of registered protocol extensions are parsed
+// using the extension instead. Callbacks are called one after another by the reading goroutine.
+func (conn *Conn) On(name string, callback interface{}) error {
+	callbackValue := reflect.ValueOf(callback)
+	callbackType := callbackValue.Type()
+	if callbackType.Kind() != reflect.Func || callbackType.NumIn() > 1 {
+		return errors.New("On cannot accept a callback of the type " + callbackType.String() + ".")
+	}
+
+	var handler func(interface{})
+	if callbackType.NumIn() == 0 {
+		// NO DATA
+		handler = func(interface{}) {
+			callbackValue.Call(nil)
+		}
+	} else if cb, ok := callback.(func(interface{})); ok {
+		// INTERFACE
+		handler = cb
+	} else if cb, ok := callback.(func([]byte)); ok {
+		// RAW
+		handler = func(data interface{}) {
+			if raw, ok := conn.raw(data); ok {
+				cb(raw)
+			}
+		}
+	} else {
+		conn.lock.RLock()
+		parser, ok := conn.extensions[callbackType.In(0)]
+		conn.lock.RUnlock()
+		if ok {
+			// PROTOCOL EXTENSION
+			handler = func(data interface{}) {
+				if result := parser.Call([]reflect.Value{reflect.ValueOf(data)}); result[1].Bool() {
+					callbackValue.Call([]reflect.Value{result[0]})
+				}
+			}
+		} else if callbackType.In(0).Kind() == reflect.Ptr {
+			// PROTOCOL
+			callbackDataElem := callbackType.In(0).Elem()
+			handler = func(data interface{}) {
+				result := reflect.New(callbackDataElem)
+				if err := conn.protocol.Unmarshal(data, result.Interface()); err == nil {
+					callbackValue.Call([]reflect.Value{result})
+				}
+			}
+		} else {
+			return errors.New("On cannot accept a callback of the type " + callbackType.String() + ".")
+		}
+	}
+
+	conn.lock.Lock()
+	conn.callbacks[name] = handler
+	conn.lock.Unlock()
+	return nil
+}
+
+// AddProtocolExtension adds a parser for callbacks taking its result type, see the method of the
+// same name of the router. Extensions have to be added before the callbacks using them.
+func (conn *Conn) AddProtocolExtension(extensionFunc interface{}) error {
+	extensionValue := reflect.ValueOf(extensionFunc)
+	extensionType := extensionValue.Type()
+
+	if extensionType.Kind() != reflect.Func || extensionType.NumIn() != 1 {
+		return errors.New("Cannot add function(" + extensionType.String() + ") as parser: To many arguments!")
+	}
+	if extensionType.NumOut() != 2 {
+		return errors.New("Cannot add function(" + extensionType.String() + ") as parser: Wrong number of return values!")
+	}
+	if extensionType.Out(1).Kind() != reflect.Bool {
+		return errors.New("Cannot add function(" + extensionType.String() + ") as parser: Second return value is not Bool!")
+	}
+
+	conn.lock.Lock()
+	conn.extensions[extensionType.Out(0)] = extensionValue
+	conn.lock.Unlock()
+	return nil
+}
+
+// OnClose sets the callback called once the connection closed. The error is nil if the
+// connection was closed using Close, a *golem.CloseError if the server closed the connection
+// and the cause otherwise.
+func (conn *Conn) OnClose(callback func(error)) {
+	conn.lock.Lock()
+	conn.closeFunc = callback
+	conn.lock.Unlock()
+}
+
+// Emit packs the data using the protocol and queues it for sending. It blocks while the
+// outgoing buffer is full and fails if packing failed or the connection is closed.
+func (conn *Conn) Emit(event string, data interface{}) error {
+	packed, err := conn.protocol.MarshalAndPack(event, data)
+	if err != nil {
+		return err
+	}
+	return conn.emitPacked(packed)
+}
+
+// Queues a packed message for sending, blocking while the outgoing buffer is full.
+func (conn *Conn) emitPacked(packed []byte) error {
+	select {
+	case <-conn.done:
+		return ErrClosed
+	default:
+	}
+	select {
+	case conn.send <- packed:
+		return nil
+	case <-conn.done:
+		return ErrClosed
+	}
+}
+
+// Close closes the connection with a normal closure.
+func (conn *Conn) Close() error {
+	return conn.CloseWithReason(websocket.CloseNormalClosure, "")
+}
+
+// CloseWithReason closes the connection sending the status code and reason to the server.
+// Messages still in the outgoing buffer are dropped.
+func (conn *Conn) CloseWithReason(code int, reason string) error {
+	if !conn.shutdown(nil, code, reason) {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Done returns a channel, that is closed once the connection closed.
+func (conn *Conn) Done() <-chan struct{} {
+	return conn.done
+}
+
+// Err returns the error the connection was closed with, see OnClose.
+func (conn *Conn) Err() error {
+	select {
+	case <-conn.done:
+		return conn.err
+	default:
+		return nil
+	}
+}
+
+// Copies handlers and protocol extensions of the template.
+func (conn *Conn) inherit(template *Conn) {
+	template.lock.RLock()
+	defer template.lock.RUnlock()
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	for name, handler := range template.callbacks {
+		conn.callbacks[name] = handler
+	}
+	for t, parser := range template.extensions {
+		conn.extensions[t] = parser
+	}
+}
+
+// Shuts the connection down once and calls the close callback. Returns false if
+// the connection was already shut down.
+func (conn *Conn) shutdown(err error, code int, reason string) (ok bool) {
+	conn.closeOnce.Do(func() {
+		conn.err = err
+		conn.closeCode = code
+		conn.closeReason = reason
+		close(conn.done)
+		ok = true
+	})
+	if ok {
+		conn.lock.RLock()
+		closeFunc := conn.closeFunc
+		conn.lock.RUnlock()
+		closeFunc(err)
+	}
+	return
+}
+
+// Returns the raw bytes of interstage data, see the method of the same name of the router.
+func (conn *Conn) raw(data interface{}) ([]byte, bool) {
+	if raw, ok := data.([]byte); ok {
+		return raw, true
+	}
+	var raw []byte
+	if err := conn.protocol.Unmarshal(data, &raw); err != nil {
+		return nil, false
+	}
+	return raw, true
+}
+
+// Extends the read deadline if a timeout is configured.
+func (conn *Conn) extendDeadline() {
+	if conn.opts.ReadTimeout > 0 {
+		conn.transport.SetReadDeadline(time.Now().Add(conn.opts.ReadTimeout))
+	}
+}
+
+// Reads and dispatches messages until the transport fails or the server closes the connection.
+// The router writes in the write mode of the protocol, so it is read in that mode.
+func (conn *Conn) readPump() {
+	defer close(conn.readerDone)
+	if conn.opts.MaxMessageSize > 0 {
+		conn.transport.SetReadLimit(conn.opts.MaxMessageSize)
+	}
+	conn.transport.SetPongHandler(conn.extendDeadline)
+	conn.extendDeadline()
+	mode := conn.protocol.GetWriteMode()
+	for {
+		frameMode, data, err := conn.transport.ReadFrame()
+		if err != nil {
+			if ce, ok := err.(*golem.CloseError); ok {
+				conn.shutdown(err, ce.Code, ce.Text)
+			} else {
+				conn.shutdown(err, websocket.CloseAbnormalClosure, "")
+			}
+			conn.transport.Close()
+			return
+		}
+		conn.extendDeadline()
+		if frameMode != mode {
+			continue
+		}
+		name, interstage, err := conn.protocol.Unpack(data)
+		if err != nil {
+			continue // TODO: Proper debug output!
+		}
+		conn.lock.RLock()
+		handler, ok := conn.callbacks[name]
+		conn.lock.RUnlock()
+		if ok {
+			handler(interstage)
+		}
+	}
+}
+
+// Writes queued messages and pings. Once the connection shuts down the close frame is
+// written and the transport is closed, after the server confirmed it or closeWait passed.
+// The router reads in the read mode of the protocol, so it is written in that mode.
+func (conn *Conn) writePump() {
+	var ticks <-chan time.Time
+	if conn.opts.PingInterval > 0 {
+		ticker := time.NewTicker(conn.opts.PingInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	mode := conn.protocol.GetReadMode()
+	for {
+		select {
+		case data := <-conn.send:
+			conn.transport.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.transport.WriteFrame(mode, data); err != nil {
+				conn.shutdown(err, websocket.CloseAbnormalClosure, "")
+				conn.transport.Close()
+				return
+			}
+		case <-ticks:
+			conn.transport.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.transport.WritePing(); err != nil {
+				conn.shutdown(err, websocket.CloseAbnormalClosure, "")
+				conn.transport.Close()
+				return
+			}
+		case <-conn.done:
+			if conn.closeCode != websocket.CloseAbnormalClosure {
+				conn.transport.SetWriteDeadline(time.Now().Add(writeWait))
+				conn.transport.WriteClose(conn.closeCode, conn.closeReason)
+			}
+			select {
+			case <-conn.readerDone:
+			case <-time.After(closeWait):
+			}
+			conn.transport.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,243 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package client
+
+import (
+	"context"
+	"github.com/trevex/golem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testMessage struct {
+	Text string `json:"text"`
+}
+
+// Starts a server for the router and returns the WebSocket URL.
+func serveTest(t *testing.T, router *golem.Router) string {
+	server := httptest.NewServer(http.HandlerFunc(router.Handler()))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// Returns a router echoing messages and closing connections emitting "bye".
+func echoRouter() *golem.Router {
+	router := golem.NewRouter()
+	router.On("echo", func(conn *golem.Connection, data *testMessage) {
+		conn.Emit("echo", data)
+	})
+	router.On("bye", func(conn *golem.Connection) {
+		conn.CloseWithReason(4000, "Bye")
+	})
+	return router
+}
+
+// Waits for a value of the channel, failing the test if none arrives within a second.
+func receive[T any](t *testing.T, c <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-c:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting")
+	}
+	panic("unreachable")
+}
+
+func TestDial(t *testing.T) {
+	received := make(chan string, 4)
+	conn, err := Dial(context.Background(), serveTest(t, echoRouter()), &Options{
+		OnOpen: func(conn *Conn) {
+			conn.On("echo", func(data *testMessage) {
+				received <- "typed " + data.Text
+			})
+		},
+	})
+	if err != nil {
+		t.Fatalf("dialing failed: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Emit("echo", &testMessage{Text: "hi"}); err != nil {
+		t.Fatalf("emitting failed: %v", err)
+	}
+	if data := receive(t, received); data != "typed hi" {
+		t.Fatalf("unexpected data %q", data)
+	}
+	for _, callback := range []interface{}{
+		func() { received <- "none" },
+		func(data interface{}) { received <- "interface " + string(data.([]byte)) },
+		func(data []byte) { received <- "raw " + string(data) },
+	} {
+		if err := conn.On("echo", callback); err != nil {
+			t.Fatalf("registering callback of type %T failed: %v", callback, err)
+		}
+		conn.Emit("echo", &testMessage{Text: "hi"})
+		receive(t, received)
+	}
+	conn.On("echo", func(data []byte) { received <- "raw " + string(data) })
+	conn.Emit("echo", &testMessage{Text: "hi"})
+	if data := receive(t, received); data != `raw {"text":"hi"}` {
+		t.Fatalf("unexpected data %q", data)
+	}
+}
+
+func TestDialFails(t *testing.T) {
+	router := golem.NewRouter()
+	router.OnHandshake(func(w http.ResponseWriter, r *http.Request) bool { return false })
+	if _, err := Dial(context.Background(), serveTest(t, router), nil); err == nil {
+		t.Fatal("expected rejected handshake to fail")
+	}
+}
+
+func TestOnRejectsCallback(t *testing.T) {
+	conn := NewConn(newPipe(t), nil)
+	defer conn.Close()
+	for _, callback := range []interface{}{
+		"echo",
+		func(a, b *testMessage) {},
+		func(data testMessage) {},
+	} {
+		if err := conn.On("echo", callback); err == nil {
+			t.Fatalf("expected callback of type %T to be rejected", callback)
+		}
+	}
+}
+
+func TestProtocolExtension(t *testing.T) {
+	received := make(chan string, 1)
+	conn, err := Dial(context.Background(), serveTest(t, echoRouter()), &Options{
+		OnOpen: func(conn *Conn) {
+			conn.AddProtocolExtension(func(data []byte) (string, bool) {
+				return strings.ToUpper(string(data)), true
+			})
+			conn.On("echo", func(data string) {
+				received <- data
+			})
+		},
+	})
+	if err != nil {
+		t.Fatalf("dialing failed: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.AddProtocolExtension(func(a, b []byte) (string, bool) { return "", false }); err == nil {
+		t.Fatal("expected extension with two arguments to be rejected")
+	}
+
+	conn.Emit("echo", &testMessage{Text: "hi"})
+	if data := receive(t, received); data != `{"TEXT":"HI"}` {
+		t.Fatalf("unexpected data %q", data)
+	}
+}
+
+// Returns the client end of an in-memory connection served by an echo router.
+func newPipe(t *testing.T) golem.Transport {
+	client, server := golem.NewMemoryTransportPair()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		echoRouter().ServeTransport(server, httptest.NewRequest("GET", "/", nil))
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+func TestCloseByServer(t *testing.T) {
+	closed := make(chan error, 1)
+	conn := NewConn(newPipe(t), &Options{
+		OnOpen: func(conn *Conn) {
+			conn.OnClose(func(err error) {
+				closed <- err
+			})
+		},
+	})
+
+	conn.Emit("bye", nil)
+	err := receive(t, closed)
+	if closeErr, ok := err.(*golem.CloseError); !ok || closeErr.Code != 4000 || closeErr.Text != "Bye" {
+		t.Fatalf("expected close error with code 4000, received %v", err)
+	}
+	receive(t, conn.Done())
+	if conn.Err() != err {
+		t.Fatalf("expected Err to return the close error, returned %v", conn.Err())
+	}
+	if err := conn.Emit("echo", nil); err != ErrClosed {
+		t.Fatalf("expected emitting on closed connection to fail, returned %v", err)
+	}
+	if err := conn.Close(); err != ErrClosed {
+		t.Fatalf("expected closing twice to fail, returned %v", err)
+	}
+}
+
+func TestCloseByClient(t *testing.T) {
+	router := echoRouter()
+	serverClosed := make(chan bool, 1)
+	router.OnClose(func(conn *golem.Connection) {
+		serverClosed <- true
+	})
+	closed := make(chan error, 1)
+	conn, err := Dial(context.Background(), serveTest(t, router), &Options{
+		OnOpen: func(conn *Conn) {
+			conn.OnClose(func(err error) {
+				closed <- err
+			})
+		},
+	})
+	if err != nil {
+		t.Fatalf("dialing failed: %v", err)
+	}
+
+	if conn.Err() != nil {
+		t.Fatalf("expected no error while open, returned %v", conn.Err())
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("closing failed: %v", err)
+	}
+	if err := receive(t, closed); err != nil {
+		t.Fatalf("expected close callback without error, received %v", err)
+	}
+	receive(t, serverClosed)
+}
+
+func TestCloseAbnormal(t *testing.T) {
+	client, server := golem.NewMemoryTransportPair()
+	closed := make(chan error, 1)
+	conn := NewConn(client, &Options{
+		OnOpen: func(conn *Conn) {
+			conn.OnClose(func(err error) {
+				closed <- err
+			})
+		},
+	})
+
+	server.Close() // Without close frame.
+	err := receive(t, closed)
+	if _, ok := err.(*golem.CloseError); ok || err == nil {
+		t.Fatalf("expected error of the transport, received %v", err)
+	}
+	if conn.Err() != err {
+		t.Fatalf("expected Err to return the error, returned %v", conn.Err())
+	}
+}
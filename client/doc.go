@@ -0,0 +1,34 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package client is a Go client for golem routers. It mirrors the API of the server:
+// handlers are registered using On, messages are send using Emit and the same Protocol
+// implementations and protocol extensions are used to pack and unpack messages.
+//
+//	conn, err := client.Dial(ctx, "ws://127.0.0.1:8080/ws", &client.Options{
+//		OnOpen: func(conn *client.Conn) {
+//			conn.On("answer", func(data *Answer) {
+//				fmt.Println(data.Msg)
+//			})
+//		},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	conn.Emit("hello", &Hello{From: "Client"})
+package client
@@ -0,0 +1,398 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/trevex/golem"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// Default delays between reconnection attempts.
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+	// Default size of the queue of messages emitted while disconnected.
+	defaultQueueSize = 256
+)
+
+var (
+	// ErrQueueFull is returned by Emit if the queue is full and the overflow policy is OverflowError.
+	ErrQueueFull = errors.New("Queue of outgoing messages is full.")
+)
+
+// State of a reconnecting client.
+type State int
+
+const (
+	// StateConnecting is the state while the first connection is established.
+	StateConnecting State = iota
+	// StateOpen is the state while connected.
+	StateOpen
+	// StateReconnecting is the state after the connection was lost until it is re-established.
+	StateReconnecting
+	// StateClosed is the final state after Close was called or reconnecting was given up.
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateOpen:
+		return "open"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// OverflowPolicy decides what happens to messages emitted while the queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest discards the oldest queued message to make room.
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowDropNewest discards the emitted message.
+	OverflowDropNewest
+	// OverflowError discards the emitted message and Emit returns ErrQueueFull.
+	OverflowError
+)
+
+// ReconnectOptions configure a reconnecting client, the zero value uses the defaults.
+type ReconnectOptions struct {
+	// Options used for every connection. OnOpen is called for every connection.
+	Options
+	// Delay before the first reconnection attempt, doubled for every further attempt up to
+	// MaxBackoff. Default to 500 milliseconds and 30 seconds.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Fraction of the delay, that is randomised to spread reconnecting clients, between 0 and 1.
+	Jitter float64
+	// Number of failed attempts in a row after which reconnecting is given up, zero means never.
+	MaxAttempts int
+	// ShouldReconnect decides if the connection is re-established after it closed with the
+	// error, by default it always is.
+	ShouldReconnect func(error) bool
+	// Size of the queue of messages emitted while disconnected, defaults to 256.
+	QueueSize int
+	// Overflow policy of the queue.
+	Overflow OverflowPolicy
+	// Resubscribe is called on every new connection before queued messages are send, e.g.
+	// to emit the events joining the rooms again.
+	Resubscribe func(*Conn)
+	// OnStateChange is called whenever the state changes, with the error causing the change if any.
+	OnStateChange func(State, error)
+}
+
+// Client is a client, that connects to a router and reconnects with exponential backoff whenever
+// the connection is lost. Handlers are kept across connections and messages emitted while
+// disconnected are queued until the connection is re-established.
+type Client struct {
+	url  string
+	opts ReconnectOptions
+	// Unstarted connection holding handlers and protocol extensions for all connections.
+	template *Conn
+	// Guards the fields below.
+	lock sync.Mutex
+	// Current connection and its state.
+	conn  *Conn
+	state State
+	// Set once queued messages were send on the current connection.
+	flushed bool
+	// Messages emitted while disconnected.
+	queue [][]byte
+	// Closed by Close.
+	closed    chan struct{}
+	closeOnce sync.Once
+	cancel    context.CancelFunc
+}
+
+// New creates a client connecting to the router at the URL in the background.
+func New(url string, opts *ReconnectOptions) *Client {
+	if opts == nil {
+		opts = &ReconnectOptions{}
+	}
+	c := &Client{
+		url:  url,
+		opts: *opts,
+		template: &Conn{
+			protocol:   opts.Protocol,
+			callbacks:  make(map[string]func(interface{})),
+			extensions: make(map[reflect.Type]reflect.Value),
+		},
+		closed: make(chan struct{}),
+	}
+	if c.template.protocol == nil {
+		c.template.protocol = &golem.DefaultJSONProtocol{}
+	}
+	if c.opts.MinBackoff <= 0 {
+		c.opts.MinBackoff = defaultMinBackoff
+	}
+	if c.opts.MaxBackoff < c.opts.MinBackoff {
+		c.opts.MaxBackoff = defaultMaxBackoff
+		if c.opts.MaxBackoff < c.opts.MinBackoff {
+			c.opts.MaxBackoff = c.opts.MinBackoff
+		}
+	}
+	if c.opts.QueueSize <= 0 {
+		c.opts.QueueSize = defaultQueueSize
+	}
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	go c.run(ctx)
+	return c
+}
+
+// On adds the callback for the event to current and future connections, see Conn.On.
+func (c *Client) On(name string, callback interface{}) error {
+	if err := c.template.On(name, callback); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	conn := c.conn
+	c.lock.Unlock()
+	if conn != nil {
+		conn.inherit(c.template)
+	}
+	return nil
+}
+
+// AddProtocolExtension adds a parser for callbacks taking its result type, see Conn.AddProtocolExtension.
+func (c *Client) AddProtocolExtension(extensionFunc interface{}) error {
+	return c.template.AddProtocolExtension(extensionFunc)
+}
+
+// State returns the current state of the client.
+func (c *Client) State() State {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state
+}
+
+// Emit packs the data and sends it on the current connection. While disconnected the message
+// is queued and send once the connection is re-established, according to the overflow policy
+// if the queue is full.
+func (c *Client) Emit(event string, data interface{}) error {
+	packed, err := c.template.protocol.MarshalAndPack(event, data)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	if c.state == StateClosed {
+		c.lock.Unlock()
+		return ErrClosed
+	}
+	if conn := c.conn; conn != nil && c.flushed {
+		c.lock.Unlock()
+		if err := conn.emitPacked(packed); err != ErrClosed {
+			return err
+		}
+		c.lock.Lock() // Lost the connection meanwhile, so queue the message.
+	}
+	defer c.lock.Unlock()
+	return c.enqueue(packed)
+}
+
+// Queues a packed message applying the overflow policy, lock has to be held.
+func (c *Client) enqueue(packed []byte) error {
+	if len(c.queue) >= c.opts.QueueSize {
+		switch c.opts.Overflow {
+		case OverflowDropOldest:
+			c.queue = c.queue[1:]
+		case OverflowDropNewest:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+	c.queue = append(c.queue, packed)
+	return nil
+}
+
+// Close closes the current connection and stops reconnecting.
+func (c *Client) Close() error {
+	ok := false
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		ok = true
+	})
+	if !ok {
+		return ErrClosed
+	}
+	c.cancel()
+	c.lock.Lock()
+	conn := c.conn
+	c.lock.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return nil
+}
+
+// Sets the state and calls the callback.
+func (c *Client) setState(state State, err error) {
+	c.lock.Lock()
+	c.state = state
+	if state != StateOpen {
+		c.conn = nil
+		c.flushed = false
+	}
+	c.lock.Unlock()
+	if c.opts.OnStateChange != nil {
+		c.opts.OnStateChange(state, err)
+	}
+}
+
+// Returns the delay before the attempt, growing exponentially with the number of failed attempts.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.opts.MinBackoff
+	for i := 1; i < attempt && d < c.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.opts.MaxBackoff {
+		d = c.opts.MaxBackoff
+	}
+	if c.opts.Jitter > 0 {
+		jitter := c.opts.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= time.Duration(rand.Float64() * jitter * float64(d))
+	}
+	return d
+}
+
+// Waits for the delay, returns false if the client was closed meanwhile.
+func (c *Client) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+// Connects and reconnects until the client is closed or gives up.
+func (c *Client) run(ctx context.Context) {
+	state := StateConnecting
+	attempts := 0
+	var err error
+	for {
+		c.setState(state, err)
+		conn, dialErr := c.dial(ctx)
+		if dialErr != nil {
+			attempts++
+			if c.opts.MaxAttempts > 0 && attempts >= c.opts.MaxAttempts {
+				c.setState(StateClosed, dialErr)
+				return
+			}
+			if !c.wait(c.backoff(attempts)) {
+				c.setState(StateClosed, nil)
+				return
+			}
+			err = dialErr
+			continue
+		}
+		attempts = 0
+
+		c.lock.Lock()
+		c.conn = conn
+		c.lock.Unlock()
+		c.setState(StateOpen, nil)
+		select {
+		case <-c.closed: // Closed while connecting.
+			conn.Close()
+		default:
+		}
+		if c.opts.Resubscribe != nil {
+			c.opts.Resubscribe(conn)
+		}
+		c.flush(conn)
+
+		select {
+		case <-conn.Done():
+		case <-c.closed:
+			conn.Close()
+			<-conn.Done()
+		}
+		err = conn.Err()
+		select {
+		case <-c.closed:
+			c.setState(StateClosed, nil)
+			return
+		default:
+		}
+		if c.opts.ShouldReconnect != nil && !c.opts.ShouldReconnect(err) {
+			c.setState(StateClosed, err)
+			return
+		}
+		state = StateReconnecting
+		if !c.wait(c.backoff(1)) {
+			c.setState(StateClosed, nil)
+			return
+		}
+	}
+}
+
+// Establishes a connection inheriting the handlers of the client.
+func (c *Client) dial(ctx context.Context) (*Conn, error) {
+	opts := c.opts.Options
+	opts.Protocol = c.template.protocol
+	opts.OnOpen = func(conn *Conn) {
+		conn.inherit(c.template)
+		if c.opts.OnOpen != nil {
+			c.opts.OnOpen(conn)
+		}
+	}
+	return Dial(ctx, c.url, &opts)
+}
+
+// Sends queued messages in order, afterwards Emit sends directly on the connection.
+func (c *Client) flush(conn *Conn) {
+	for {
+		c.lock.Lock()
+		if c.conn != conn {
+			c.lock.Unlock()
+			return
+		}
+		if len(c.queue) == 0 {
+			c.flushed = true
+			c.lock.Unlock()
+			return
+		}
+		packed := c.queue[0]
+		c.queue = c.queue[1:]
+		c.lock.Unlock()
+		if conn.emitPacked(packed) != nil {
+			c.lock.Lock() // Keep the message for the next connection.
+			c.queue = append([][]byte{packed}, c.queue...)
+			c.lock.Unlock()
+			return
+		}
+	}
+}
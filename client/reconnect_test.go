@@ -0,0 +1,190 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package client
+
+import (
+	"github.com/trevex/golem"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	c := &Client{opts: ReconnectOptions{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}}
+	for attempt, expected := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		if d := c.backoff(attempt + 1); d != expected {
+			t.Fatalf("expected delay %v before attempt %d, returned %v", expected, attempt+1, d)
+		}
+	}
+
+	c.opts.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := c.backoff(2); d < 100*time.Millisecond || d > 200*time.Millisecond {
+			t.Fatalf("expected delay with jitter between 100ms and 200ms, returned %v", d)
+		}
+	}
+	c.opts.Jitter = 2
+	for i := 0; i < 100; i++ {
+		if d := c.backoff(1); d < 0 || d > 100*time.Millisecond {
+			t.Fatalf("expected jitter to be capped to the delay, returned %v", d)
+		}
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	for _, test := range []struct {
+		overflow OverflowPolicy
+		err      error
+		queue    string
+	}{
+		{OverflowDropOldest, nil, "bc"},
+		{OverflowDropNewest, nil, "ab"},
+		{OverflowError, ErrQueueFull, "ab"},
+	} {
+		c := &Client{opts: ReconnectOptions{QueueSize: 2, Overflow: test.overflow}}
+		c.enqueue([]byte("a"))
+		c.enqueue([]byte("b"))
+		if err := c.enqueue([]byte("c")); err != test.err {
+			t.Fatalf("expected policy %d to return %v, returned %v", test.overflow, test.err, err)
+		}
+		queue := ""
+		for _, packed := range c.queue {
+			queue += string(packed)
+		}
+		if queue != test.queue {
+			t.Fatalf("expected policy %d to keep %q, kept %q", test.overflow, test.queue, queue)
+		}
+	}
+}
+
+// Returns a router rejecting handshakes until the returned flag is set.
+func blockingRouter() (*golem.Router, *atomic.Bool) {
+	ready := &atomic.Bool{}
+	router := echoRouter()
+	router.OnHandshake(func(w http.ResponseWriter, r *http.Request) bool {
+		return ready.Load()
+	})
+	return router, ready
+}
+
+func TestReconnectQueue(t *testing.T) {
+	router, ready := blockingRouter()
+	received := make(chan string, 4)
+	router.On("queued", func(conn *golem.Connection, data *testMessage) {
+		received <- data.Text
+	})
+	states := make(chan State, 8)
+	c := New(serveTest(t, router), &ReconnectOptions{
+		MinBackoff:    10 * time.Millisecond,
+		MaxBackoff:    10 * time.Millisecond,
+		QueueSize:     2,
+		OnStateChange: func(state State, err error) { states <- state },
+	})
+	defer c.Close()
+
+	for _, text := range []string{"a", "b", "c"} {
+		if err := c.Emit("queued", &testMessage{Text: text}); err != nil {
+			t.Fatalf("emitting while connecting failed: %v", err)
+		}
+	}
+	if state := c.State(); state != StateConnecting {
+		t.Fatalf("expected client to be connecting, is %v", state)
+	}
+	ready.Store(true)
+	for _, expected := range []string{"b", "c"} {
+		if text := receive(t, received); text != expected {
+			t.Fatalf("expected queued message %q, received %q", expected, text)
+		}
+	}
+	for receive(t, states) != StateOpen {
+	}
+	c.Emit("queued", &testMessage{Text: "d"})
+	if text := receive(t, received); text != "d" {
+		t.Fatalf("expected message %q, received %q", "d", text)
+	}
+
+	c.Close()
+	for receive(t, states) != StateClosed {
+	}
+	if err := c.Emit("queued", &testMessage{Text: "e"}); err != ErrClosed {
+		t.Fatalf("expected emitting on closed client to fail, returned %v", err)
+	}
+}
+
+func TestReconnectResubscribe(t *testing.T) {
+	router := echoRouter()
+	joined := make(chan bool, 4)
+	router.On("join", func(conn *golem.Connection) {
+		joined <- true
+	})
+	states := make(chan State, 8)
+	echoed := make(chan string, 4)
+	c := New(serveTest(t, router), &ReconnectOptions{
+		MinBackoff: 10 * time.Millisecond,
+		Resubscribe: func(conn *Conn) {
+			conn.Emit("join", nil)
+		},
+		OnStateChange: func(state State, err error) { states <- state },
+	})
+	defer c.Close()
+	c.On("echo", func(data *testMessage) {
+		echoed <- data.Text
+	})
+
+	receive(t, joined)
+	c.Emit("bye", nil)
+	receive(t, joined)
+	for _, expected := range []State{StateConnecting, StateOpen, StateReconnecting, StateOpen} {
+		if state := receive(t, states); state != expected {
+			t.Fatalf("expected state %v, changed to %v", expected, state)
+		}
+	}
+	c.Emit("echo", &testMessage{Text: "again"})
+	if text := receive(t, echoed); text != "again" {
+		t.Fatalf("expected handler to be kept across connections, received %q", text)
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	router, _ := blockingRouter()
+	errs := make(chan error, 8)
+	c := New(serveTest(t, router), &ReconnectOptions{
+		MinBackoff:  time.Millisecond,
+		MaxAttempts: 3,
+		OnStateChange: func(state State, err error) {
+			if state == StateClosed {
+				errs <- err
+			}
+		},
+	})
+	if err := receive(t, errs); err == nil {
+		t.Fatal("expected giving up to report the dial error")
+	}
+	if state := c.State(); state != StateClosed {
+		t.Fatalf("expected client to be closed, is %v", state)
+	}
+}
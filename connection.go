@@ -19,8 +19,11 @@
 package golem
 
 import (
-	"github.com/gorilla/websocket"
+	"context"
+	"go.opentelemetry.io/otel/trace"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,7 +34,7 @@ const (
 	readWait = 60 * time.Second
 	// Send pings to client with this period. Must be less than readWait.
 	pingPeriod = (readWait * 9) / 10
-	// Maximum message size allowed from client.
+	// Default maximum message size allowed from client.
 	maxMessageSize = 512
 	// Outgoing default channel size.
 	sendChannelSize = 512
@@ -39,6 +42,8 @@ const (
 
 var (
 	defaultConnectionExtension = reflect.ValueOf(nil)
+	// Last ID assigned to a connection.
+	lastConnectionID uint64
 )
 
 // SetDefaultConnectionExtension sets the initial extension used by all freshly instanced routers.
@@ -47,47 +52,107 @@ func SetDefaultConnectionExtension(constructor interface{}) {
 	defaultConnectionExtension = reflect.ValueOf(constructor)
 }
 
+// MarshalError is reported to the error callback of the router, if the protocol failed to marshal
+// or pack a message emitted to a connection. The message is dropped.
+type MarshalError struct {
+	// Event of the dropped message.
+	Event string
+	// Error returned by the protocol.
+	Err error
+}
+
+// Error describes the dropped message.
+func (e *MarshalError) Error() string {
+	return "Marshalling event " + e.Event + " failed: " + e.Err.Error()
+}
+
+// Unwrap returns the error of the protocol.
+func (e *MarshalError) Unwrap() error {
+	return e.Err
+}
+
 // Connection holds information about the underlying WebSocket-Connection,
 // the associated router and the outgoing data channel.
 type Connection struct {
-	// The websocket connection.
-	socket *websocket.Conn
+	// The underlying transport, usually a websocket connection.
+	transport Transport
 	// Associated router.
 	router *Router
 	// Buffered channel of outbound messages.
 	send chan *message
 	//
 	extension interface{}
+	// Status code and reason of the close frame written when the connection is closed.
+	closeCode   int
+	closeReason string
+	// Guards closeCode and closeReason.
+	closeLock sync.Mutex
+	// Active streams of the connection.
+	streams *streamSet
+	// Bytes of frames received for the incomplete message of a mixed mode protocol.
+	receivedBytes int
+	// Unique ID, remote address and time the connection was established.
+	id         uint64
+	remoteAddr string
+	since      time.Time
+	// Claims of the principal stored by the handshake callback, nil if none.
+	claims Claims
+	// Timer of the scheduled reauth event or close of expired claims, and its generation,
+	// which is incremented to cancel the scheduled actions. Guarded by claimsLock.
+	expiry           *time.Timer
+	expiryGeneration uint64
+	claimsLock       sync.Mutex
+	// Rate limiter of incoming messages, created with the first message.
+	limiter *rateLimiter
+	// Span context of the handshake, linked by the spans of messages.
+	handshake trace.SpanContext
+	// Context of the message currently handled, guarded by ctxLock.
+	ctx     context.Context
+	ctxLock sync.Mutex
 }
 
-// Create a new connection using the specified socket and router.
-func newConnection(s *websocket.Conn, r *Router) *Connection {
+// Create a new connection using the specified transport and router.
+func newConnection(t Transport, r *Router) *Connection {
 	return &Connection{
-		socket:    s,
+		transport: t,
 		router:    r,
 		send:      make(chan *message, sendChannelSize),
 		extension: nil,
+		streams:   newStreamSet(),
+		id:        atomic.AddUint64(&lastConnectionID, 1),
+		since:     time.Now(),
 	}
 }
 
 // Register connection and start writing and reading loops.
 func (conn *Connection) run() {
 	hub.register <- conn
-    readMode := websocket.TextMessage
-    writeMode := websocket.TextMessage
-    if conn.router.protocol.GetReadMode() != TextMode {
-        readMode = websocket.BinaryMessage
-    }
-    if conn.router.protocol.GetWriteMode() != TextMode {
-        writeMode = websocket.BinaryMessage
-    }
-    if conn.router.useHeartbeats {
-        go conn.writePumpHeartbeat(writeMode)
-        conn.readPumpHeartbeat(readMode)
-    } else {
-        go conn.writePump(writeMode)
-        conn.readPump(readMode)
-    }
+	readMode := conn.router.protocol.GetReadMode()
+	writeMode := conn.router.protocol.GetWriteMode()
+	if t, ok := conn.transport.(compressionTransport); ok && conn.router.useCompression {
+		t.SetCompressionLevel(conn.router.compressionLevel)
+	}
+	if conn.router.useHeartbeats {
+		go conn.writePumpHeartbeat(writeMode)
+		conn.readPumpHeartbeat(readMode)
+	} else {
+		go conn.writePump(writeMode)
+		conn.readPump(readMode)
+	}
+}
+
+// ID returns the unique ID of the connection.
+func (conn *Connection) ID() uint64 {
+	return conn.id
+}
+
+// Claims returns the claims of the principal stored by the handshake callback, e.g. by an
+// Authenticator, nil if the connection is not authenticated. The claims are replaced if the
+// client refreshes its token, see SetReauth.
+func (conn *Connection) Claims() Claims {
+	conn.claimsLock.Lock()
+	defer conn.claimsLock.Unlock()
+	return conn.claims
 }
 
 func (conn *Connection) extend(e interface{}) {
@@ -95,12 +160,85 @@ func (conn *Connection) extend(e interface{}) {
 }
 
 // Emit event with provided data. The data will be automatically marshalled and packed according
-// to the active protocol of the router the connection belongs to.
+// to the active protocol of the router the connection belongs to. If tracing is enabled, messages
+// emitted while a callback of the connection runs are traced as part of the handled message.
 func (conn *Connection) Emit(event string, data interface{}) {
+	if conn.router.tracer != nil {
+		conn.EmitContext(conn.Context(), event, data)
+		return
+	}
+	conn.send <- &message{
+		event: event,
+		data:  data,
+	}
+}
+
+// EmitContext emits the event like Emit, but traces the message as part of the span carried by
+// the context, e.g. to emit from goroutines started by callbacks.
+func (conn *Connection) EmitContext(ctx context.Context, event string, data interface{}) {
+	span := conn.router.traceEmit(ctx, event)
 	conn.send <- &message{
 		event: event,
 		data:  data,
 	}
+	span.End()
+}
+
+// Context returns the context of the message currently handled by a callback of the connection,
+// which carries its span if tracing is enabled. It should be passed to calls made by the callback
+// to continue the trace. Outside of callbacks the background context is returned.
+func (conn *Connection) Context() context.Context {
+	conn.ctxLock.Lock()
+	defer conn.ctxLock.Unlock()
+	if conn.ctx == nil {
+		return context.Background()
+	}
+	return conn.ctx
+}
+
+// Sets the context of the message currently handled.
+func (conn *Connection) setContext(ctx context.Context) {
+	conn.ctxLock.Lock()
+	conn.ctx = ctx
+	conn.ctxLock.Unlock()
+}
+
+// Resets the context of the handled message, unless a message handled concurrently, e.g. by
+// the callback of a stream, replaced it meanwhile.
+func (conn *Connection) resetContext(ctx context.Context) {
+	conn.ctxLock.Lock()
+	if conn.ctx == ctx {
+		conn.ctx = nil
+	}
+	conn.ctxLock.Unlock()
+}
+
+// Queue message without blocking. If the outgoing buffer is full or the
+// connection was closed meanwhile, the message is dropped and false is returned.
+func (conn *Connection) trySend(msg *message) (ok bool) {
+	defer func() {
+		if recover() != nil { // Sending on closed channel.
+			ok = false
+		}
+	}()
+	select {
+	case conn.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// Queue message, blocking while the outgoing buffer is full. Returns false instead
+// of panicking if the connection was closed.
+func (conn *Connection) queue(msg *message) (ok bool) {
+	defer func() {
+		if recover() != nil { // Sending on closed channel.
+			ok = false
+		}
+	}()
+	conn.send <- msg
+	return true
 }
 
 // Close closes and cleans up the connection.
@@ -108,10 +246,137 @@ func (conn *Connection) Close() {
 	hub.unregister <- conn
 }
 
-// Helper for writing to socket with deadline.
+// CloseWithReason closes and cleans up the connection like Close, but sends the
+// provided status code and reason to the client as part of the close frame.
+func (conn *Connection) CloseWithReason(code int, reason string) {
+	conn.closeLock.Lock()
+	if conn.closeCode == 0 {
+		conn.closeCode = code
+		conn.closeReason = reason
+	}
+	conn.closeLock.Unlock()
+	hub.unregister <- conn
+}
+
+// Writes the close frame, that should be send to the client.
+func (conn *Connection) writeClose() error {
+	conn.closeLock.Lock()
+	code, reason := conn.closeCode, conn.closeReason
+	conn.closeLock.Unlock()
+	conn.transport.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.transport.WriteClose(code, reason)
+}
+
+// Marshal and pack message using the active protocol of the router. If the protocol
+// implements ConnectionProtocol it is used instead, which might result in several frames.
+func (conn *Connection) pack(message *message) ([][]byte, error) {
+	if p, ok := conn.router.protocol.(ConnectionProtocol); ok {
+		return p.MarshalAndPackFor(conn, message.event, message.data)
+	}
+	data, err := conn.router.protocol.MarshalAndPack(message.event, message.data)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{data}, nil
+}
+
+// Forwards an incoming frame to the router, if its mode is accepted by the active protocol.
+func (conn *Connection) receive(mode int, frameMode int, data []byte) {
+	if p, ok := conn.router.protocol.(MixedModeProtocol); ok {
+		conn.router.processFrame(conn, p, frameMode, data)
+		return
+	}
+	if frameMode == mode {
+		conn.router.processMessage(conn, data)
+	}
+}
+
+// Helper for writing all frames of a message and counting it.
+func (conn *Connection) writeMessage(mode int, message *message) error {
+	conn.router.metrics.queued(len(conn.send))
+	err := conn.writeFrames(mode, message)
+	if err == nil {
+		conn.router.metrics.sent(conn.router.eventLabel(message.event))
+	}
+	return err
+}
+
+// Writes all frames of a message.
+func (conn *Connection) writeFrames(mode int, message *message) error {
+	if p, ok := conn.router.protocol.(MixedModeProtocol); ok {
+		frames, err := p.MarshalAndPackFrames(conn, message.event, message.data)
+		if err != nil {
+			conn.marshalFailed(message.event, err)
+			return nil
+		}
+		for _, frame := range frames {
+			if err := conn.writeData(message.event, frame.Mode, frame.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, ok := conn.router.protocol.(ConnectionProtocol); message.shared && !ok {
+		prepared, err := message.prepare(conn.router, mode)
+		if err != nil {
+			conn.marshalFailed(message.event, err)
+			return nil
+		}
+		t, ok := conn.transport.(preparedTransport)
+		if !ok {
+			return conn.writeData(message.event, mode, prepared.data)
+		}
+		conn.enableCompression(message.event, len(prepared.data))
+		conn.router.metrics.sentBytes(conn.router.eventLabel(message.event), len(prepared.data))
+		conn.transport.SetWriteDeadline(time.Now().Add(writeWait))
+		return t.WritePreparedMessage(prepared.msg)
+	}
+	frames, err := conn.pack(message)
+	if err != nil {
+		conn.marshalFailed(message.event, err)
+		return nil
+	}
+	for _, data := range frames {
+		if err := conn.writeData(message.event, mode, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reports a message, that is dropped because the protocol failed to pack it. Failures of the error
+// event are only passed to the error callback, so they do not cause further error events.
+func (conn *Connection) marshalFailed(event string, err error) {
+	err = &MarshalError{Event: event, Err: err}
+	if event == conn.router.errorEvent {
+		conn.router.errorFunc(conn, err)
+		return
+	}
+	conn.router.reportError(conn, err)
+}
+
+// Helper for writing data of an event, compressing it if the compression policy of the router allows it.
+func (conn *Connection) writeData(event string, mode int, payload []byte) error {
+	conn.enableCompression(event, len(payload))
+	conn.router.metrics.sentBytes(conn.router.eventLabel(event), len(payload))
+	if t, ok := conn.transport.(eventTransport); ok {
+		conn.transport.SetWriteDeadline(time.Now().Add(writeWait))
+		return t.WriteEventFrame(event, mode, payload)
+	}
+	return conn.write(mode, payload)
+}
+
+// Enables or disables compression of the next frame, if supported by the transport.
+func (conn *Connection) enableCompression(event string, size int) {
+	if t, ok := conn.transport.(compressionTransport); ok {
+		t.EnableWriteCompression(conn.router.compress(event, size))
+	}
+}
+
+// Helper for writing to the transport with deadline.
 func (conn *Connection) write(mode int, payload []byte) error {
-	conn.socket.SetWriteDeadline(time.Now().Add(writeWait))
-	return conn.socket.WriteMessage(mode, payload)
+	conn.transport.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.transport.WriteFrame(mode, payload)
 }
 
 /*
@@ -121,23 +386,20 @@ func (conn *Connection) write(mode int, payload []byte) error {
 func (conn *Connection) readPumpHeartbeat(mode int) {
 	defer func() {
 		hub.unregister <- conn
-		conn.socket.Close()
-		conn.router.closeFunc(conn)
+		conn.transport.Close()
+		conn.router.closed(conn)
 	}()
-	conn.socket.SetReadLimit(maxMessageSize)
-	conn.socket.SetReadDeadline(time.Now().Add(readWait))
-    conn.socket.SetPongHandler(func(string) error {
-        conn.socket.SetReadDeadline(time.Now().Add(readWait))
-        return nil
-    })
+	conn.transport.SetReadLimit(conn.router.maxMessageSize)
+	conn.transport.SetReadDeadline(time.Now().Add(readWait))
+	conn.transport.SetPongHandler(func() {
+		conn.transport.SetReadDeadline(time.Now().Add(readWait))
+	})
 	for {
-		mm, message, err := conn.socket.ReadMessage()
+		mm, message, err := conn.transport.ReadFrame()
 		if err != nil {
 			break
 		}
-        if mm == mode {
-            conn.router.processMessage(conn, message)
-        }
+		conn.receive(mode, mm, message)
 	}
 }
 
@@ -145,25 +407,22 @@ func (conn *Connection) writePumpHeartbeat(mode int) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
-		conn.socket.Close() // Necessary to force reading to stop
+		conn.transport.Close() // Necessary to force reading to stop
 	}()
 	for {
 		select {
 		case message, ok := <-conn.send:
 			if ok {
-				if data, err := conn.router.protocol.MarshalAndPack(message.event, message.data); err == nil {
-					if err := conn.write(mode, data); err != nil {
-						return 
-					}
-				} else {
-                    // TODO: logging
-                }
+				if err := conn.writeMessage(mode, message); err != nil {
+					return
+				}
 			} else {
-				conn.write(websocket.CloseMessage, []byte{})
+				conn.writeClose()
 				return
 			}
 		case <-ticker.C:
-			if err := conn.write(websocket.PingMessage, []byte{}); err != nil {
+			conn.transport.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.transport.WritePing(); err != nil {
 				return
 			}
 		}
@@ -177,42 +436,34 @@ func (conn *Connection) writePumpHeartbeat(mode int) {
 func (conn *Connection) readPump(mode int) {
 	defer func() {
 		hub.unregister <- conn
-		conn.socket.Close()
-		conn.router.closeFunc(conn)
+		conn.transport.Close()
+		conn.router.closed(conn)
 	}()
-	conn.socket.SetReadLimit(maxMessageSize)
+	conn.transport.SetReadLimit(conn.router.maxMessageSize)
 	for {
-		mm, message, err := conn.socket.ReadMessage()
+		mm, message, err := conn.transport.ReadFrame()
 		if err != nil {
 			break
 		}
-        if mm == mode {
-            conn.router.processMessage(conn, message)
-        }
+		conn.receive(mode, mm, message)
 	}
 }
 
 func (conn *Connection) writePump(mode int) {
 	defer func() {
-		conn.socket.Close() // Necessary to force reading to stop
+		conn.transport.Close() // Necessary to force reading to stop
 	}()
 	for {
 		select {
 		case message, ok := <-conn.send:
 			if ok {
-				if data, err := conn.router.protocol.MarshalAndPack(message.event, message.data); err == nil {
-					if err := conn.write(mode, data); err != nil {
-						return 
-					}
-				} else {
-                    // TODO: logging
-                }
+				if err := conn.writeMessage(mode, message); err != nil {
+					return
+				}
 			} else {
-				conn.write(websocket.CloseMessage, []byte{})
+				conn.writeClose()
 				return
 			}
 		}
 	}
 }
-
-
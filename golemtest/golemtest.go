@@ -0,0 +1,401 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package golemtest provides an in-memory test harness for golem routers. A fake client
+// is connected to the router in-process, without any network or WebSocket stack:
+//
+//	func TestHello(t *testing.T) {
+//		router := golem.NewRouter()
+//		router.On("hello", hello)
+//		client := golemtest.Connect(t, router)
+//		defer client.Disconnect()
+//
+//		client.Emit("hello", &Hello{From: "Test"})
+//		var answer Answer
+//		client.Expect("answer", &answer)
+//	}
+//
+// Waiting for events is bounded by a timeout, failing the test if it passes. Settle waits
+// deterministically until all messages caused by previously emitted events were received.
+package golemtest
+
+import (
+	"github.com/trevex/golem"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// Default time waited for events.
+	defaultTimeout = time.Second
+	// Event echoed by routers, once all messages received before were handled.
+	syncEvent = "$sync"
+)
+
+var (
+	// Routers, that echo sync events.
+	syncRouters     = make(map[*golem.Router]bool)
+	syncRoutersLock sync.Mutex
+)
+
+// Syncer is implemented by rooms, room managers and the hub, see Settle.
+type Syncer interface {
+	Sync()
+}
+
+// Event is an event emitted by the router to the client.
+type Event struct {
+	// Name of the event.
+	Name string
+	// Interstage data and protocol to decode it.
+	data     interface{}
+	protocol golem.Protocol
+}
+
+// Decode unmarshals the data of the event using the protocol of the router.
+func (e *Event) Decode(v interface{}) error {
+	return e.protocol.Unmarshal(e.data, v)
+}
+
+// Client is a fake client connected in-process to a router.
+type Client struct {
+	tb       testing.TB
+	protocol golem.Protocol
+	timeout  time.Duration
+	// Ends of the in-memory connection.
+	transport *golem.MemoryTransport
+	server    *golem.MemoryTransport
+	// Closed once the router is done with the connection and the close callback returned.
+	served chan struct{}
+	// Guards the fields below.
+	lock sync.Mutex
+	// Received events, that were not taken yet.
+	events []*Event
+	// Closed and replaced whenever the fields change.
+	changed chan struct{}
+	// Error reading ended with.
+	err error
+	// Last token send and echoed by sync events.
+	token  uint64
+	synced uint64
+	// Set while reading is paused, resume is closed to continue.
+	paused bool
+	resume chan struct{}
+}
+
+// Connect connects a fake client to the router using a GET request of "/".
+func Connect(tb testing.TB, router *golem.Router) *Client {
+	return ConnectRequest(tb, router, httptest.NewRequest("GET", "/", nil))
+}
+
+// ConnectRequest connects a fake client to the router, passing the request to the connection
+// callback, e.g. to provide cookies or headers. Origin and handshake checks are not applied.
+// The router is extended by a callback of the event "$sync" on first use, see Settle.
+func ConnectRequest(tb testing.TB, router *golem.Router, r *http.Request) *Client {
+	client, server := golem.NewMemoryTransportPair()
+	c := &Client{
+		tb:        tb,
+		protocol:  router.GetProtocol(),
+		timeout:   defaultTimeout,
+		transport: client,
+		server:    server,
+		served:    make(chan struct{}),
+		changed:   make(chan struct{}),
+	}
+	registerSync(router)
+	go func() {
+		defer close(c.served)
+		router.ServeTransport(server, r)
+	}()
+	go c.read()
+	return c
+}
+
+// Registers the callback echoing the token of sync events, unless the router has it already.
+// Messages are handled in order, so all messages received before were handled and their
+// replies were queued before the echo.
+func registerSync(router *golem.Router) {
+	syncRoutersLock.Lock()
+	defer syncRoutersLock.Unlock()
+	if syncRouters[router] {
+		return
+	}
+	syncRouters[router] = true
+	router.On(syncEvent, func(conn *golem.Connection, token *uint64) {
+		conn.Emit(syncEvent, *token)
+	})
+}
+
+// SetTimeout sets the time waited for events and the router, defaults to one second.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// Wakes up waiting calls, lock has to be held.
+func (c *Client) signal() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Waits until the condition holds, which is evaluated with lock held. Returns false if the timeout passed.
+func (c *Client) wait(cond func() bool) bool {
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	for {
+		c.lock.Lock()
+		if cond() {
+			c.lock.Unlock()
+			return true
+		}
+		changed := c.changed
+		c.lock.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// Reads frames into the queue of events until the connection is closed.
+func (c *Client) read() {
+	for {
+		c.lock.Lock()
+		for c.paused {
+			resume := c.resume
+			c.lock.Unlock()
+			<-resume
+			c.lock.Lock()
+		}
+		c.lock.Unlock()
+
+		mode, data, err := c.transport.ReadFrame()
+		if err != nil {
+			c.lock.Lock()
+			c.err = err
+			c.signal()
+			c.lock.Unlock()
+			return
+		}
+		if mode != c.protocol.GetWriteMode() {
+			continue
+		}
+		name, interstage, err := c.protocol.Unpack(data)
+		if err != nil {
+			continue
+		}
+		c.lock.Lock()
+		if name == syncEvent {
+			var token uint64
+			if c.protocol.Unmarshal(interstage, &token) == nil && token > c.synced {
+				c.synced = token
+			}
+		} else {
+			c.events = append(c.events, &Event{Name: name, data: interstage, protocol: c.protocol})
+		}
+		c.signal()
+		c.lock.Unlock()
+	}
+}
+
+// Packs and writes an event, returns false if the connection is closed.
+func (c *Client) write(event string, data interface{}) bool {
+	packed, err := c.protocol.MarshalAndPack(event, data)
+	if err != nil {
+		c.tb.Fatalf("golemtest: packing %q failed: %v", event, err)
+	}
+	return c.transport.WriteFrame(c.protocol.GetReadMode(), packed) == nil
+}
+
+// Emit sends the event with the data to the router, failing the test if the connection is closed.
+func (c *Client) Emit(event string, data interface{}) {
+	c.tb.Helper()
+	if !c.write(event, data) {
+		c.tb.Fatalf("golemtest: emitting %q on closed connection", event)
+	}
+}
+
+// Receive returns the next event, failing the test if none is received within the timeout.
+func (c *Client) Receive() *Event {
+	c.tb.Helper()
+	var event *Event
+	var err error
+	ok := c.wait(func() bool {
+		if len(c.events) > 0 {
+			event = c.events[0]
+			c.events = c.events[1:]
+			return true
+		}
+		err = c.err
+		return err != nil
+	})
+	if !ok {
+		c.tb.Fatalf("golemtest: no event received within %v", c.timeout)
+	} else if event == nil {
+		c.tb.Fatalf("golemtest: connection closed while waiting for event: %v", err)
+	}
+	return event
+}
+
+// Expect receives the next event, failing the test if it is not named like the event or
+// decoding into v fails. If v is nil the data is not decoded.
+func (c *Client) Expect(event string, v interface{}) {
+	c.tb.Helper()
+	received := c.Receive()
+	if received.Name != event {
+		c.tb.Fatalf("golemtest: expected event %q, received %q", event, received.Name)
+	}
+	if v != nil {
+		if err := received.Decode(v); err != nil {
+			c.tb.Fatalf("golemtest: decoding event %q failed: %v", event, err)
+		}
+	}
+}
+
+// ExpectNone settles and fails the test if any event was received, that was not taken yet.
+func (c *Client) ExpectNone(syncers ...Syncer) {
+	c.tb.Helper()
+	c.Settle(syncers...)
+	if events := c.Drain(); len(events) > 0 {
+		c.tb.Fatalf("golemtest: expected no event, received %q", events[0].Name)
+	}
+}
+
+// Drain returns and removes all received events, that were not taken yet.
+func (c *Client) Drain() []*Event {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	events := c.events
+	c.events = nil
+	return events
+}
+
+// Round trip of a sync event, afterwards all events emitted before were handled and their
+// replies were received.
+func (c *Client) roundTrip() {
+	c.tb.Helper()
+	c.lock.Lock()
+	c.token++
+	token := c.token
+	paused := c.paused
+	c.lock.Unlock()
+	if paused {
+		c.tb.Fatalf("golemtest: cannot settle while reading is paused")
+	}
+	if !c.write(syncEvent, token) {
+		c.tb.Fatalf("golemtest: settling on closed connection")
+	}
+	if !c.wait(func() bool { return c.synced >= token || c.err != nil }) {
+		c.tb.Fatalf("golemtest: router did not settle within %v", c.timeout)
+	}
+}
+
+// Settle waits deterministically until all events emitted by the client were handled and all
+// messages caused by them were received. Messages emitted to rooms or room managers are only
+// covered if they are passed, broadcasts of the hub are always covered. Handlers, that emit
+// messages from other goroutines, are not covered.
+func (c *Client) Settle(syncers ...Syncer) {
+	c.tb.Helper()
+	c.roundTrip()
+	for _, s := range syncers {
+		s.Sync()
+	}
+	golem.GetHub().Sync()
+	c.roundTrip()
+}
+
+// Pause stops reading after the current frame to simulate a slow consumer. Messages of the
+// router queue up until its buffers are full.
+func (c *Client) Pause() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.paused {
+		c.paused = true
+		c.resume = make(chan struct{})
+	}
+}
+
+// Resume continues reading after Pause.
+func (c *Client) Resume() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.paused {
+		c.paused = false
+		close(c.resume)
+	}
+}
+
+// Disconnect drops the connection without close frame, like a lost network connection, and
+// waits until the router is done with it.
+func (c *Client) Disconnect() {
+	c.tb.Helper()
+	c.transport.Close()
+	c.WaitClosed()
+}
+
+// Close closes the connection with the status code and reason and waits until the router is
+// done with it.
+func (c *Client) Close(code int, reason string) {
+	c.tb.Helper()
+	c.transport.WriteClose(code, reason)
+	c.WaitClosed()
+	c.transport.Close()
+}
+
+// PingTimeout lets the router time out reading, as if the client stopped answering pings, and
+// waits until the router is done with the connection.
+func (c *Client) PingTimeout() {
+	c.tb.Helper()
+	c.server.Timeout()
+	c.WaitClosed()
+}
+
+// WaitClosed waits until the router is done with the connection and the close callback returned.
+func (c *Client) WaitClosed() {
+	c.tb.Helper()
+	select {
+	case <-c.served:
+	case <-time.After(c.timeout):
+		c.tb.Fatalf("golemtest: connection not closed within %v", c.timeout)
+	}
+}
+
+// ExpectClosed waits until the router closed the connection, failing the test if it did not
+// within the timeout or with another status code. Events received before remain available.
+func (c *Client) ExpectClosed(code int) {
+	c.tb.Helper()
+	var err error
+	if !c.wait(func() bool { err = c.err; return err != nil }) {
+		c.tb.Fatalf("golemtest: connection not closed within %v", c.timeout)
+	}
+	ce, ok := err.(*golem.CloseError)
+	if !ok {
+		c.tb.Fatalf("golemtest: connection closed without close frame: %v", err)
+	} else if ce.Code != code {
+		c.tb.Fatalf("golemtest: connection closed with code %d (%s), expected %d", ce.Code, ce.Text, code)
+	}
+	c.WaitClosed()
+}
+
+// Closed returns a channel, that is closed once the router is done with the connection.
+func (c *Client) Closed() <-chan struct{} {
+	return c.served
+}
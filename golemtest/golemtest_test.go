@@ -0,0 +1,216 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golemtest
+
+import (
+	"fmt"
+	"github.com/trevex/golem"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type text struct {
+	Text string `json:"text"`
+}
+
+// Records failures of the harness instead of failing the test.
+type recorder struct {
+	testing.TB
+	failure string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.failure = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+// Runs f like a test and returns the failure message, empty if it did not fail.
+func (r *recorder) run(f func()) string {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	<-done
+	return r.failure
+}
+
+func echoRouter() *golem.Router {
+	router := golem.NewRouter()
+	router.On("echo", func(conn *golem.Connection, data *text) {
+		conn.Emit("echo", data)
+	})
+	return router
+}
+
+func TestEmitExpect(t *testing.T) {
+	client := Connect(t, echoRouter())
+	defer client.Disconnect()
+
+	client.Emit("echo", &text{"hello"})
+	var answer text
+	client.Expect("echo", &answer)
+	if answer.Text != "hello" {
+		t.Fatalf("expected hello, received %q", answer.Text)
+	}
+
+	client.Emit("echo", &text{"again"})
+	event := client.Receive()
+	if event.Name != "echo" {
+		t.Fatalf("expected echo, received %q", event.Name)
+	}
+	if err := event.Decode(&answer); err != nil || answer.Text != "again" {
+		t.Fatalf("decoding failed: %v %q", err, answer.Text)
+	}
+}
+
+func TestSettleCoversRooms(t *testing.T) {
+	router := golem.NewRouter()
+	rooms := golem.NewRoomManager()
+	defer rooms.Stop()
+	router.On("join", func(conn *golem.Connection, data *text) {
+		rooms.Join(data.Text, conn)
+	})
+	router.On("say", func(conn *golem.Connection, data *text) {
+		rooms.Emit("lobby", "said", data)
+	})
+	router.OnClose(func(conn *golem.Connection) {
+		rooms.LeaveAll(conn)
+	})
+	alice := Connect(t, router)
+	defer alice.Disconnect()
+	bob := Connect(t, router)
+	defer bob.Disconnect()
+
+	alice.Emit("join", &text{"lobby"})
+	bob.Emit("join", &text{"lobby"})
+	alice.Settle(rooms)
+	bob.Settle(rooms)
+	alice.Emit("say", &text{"hi"})
+	alice.Settle(rooms)
+
+	for _, client := range []*Client{alice, bob} {
+		var said text
+		client.Expect("said", &said)
+		if said.Text != "hi" {
+			t.Fatalf("expected hi, received %q", said.Text)
+		}
+		client.ExpectNone(rooms)
+	}
+}
+
+func TestDisconnectCallsOnClose(t *testing.T) {
+	router := golem.NewRouter()
+	closed := make(chan *golem.Connection, 1)
+	router.OnClose(func(conn *golem.Connection) {
+		closed <- conn
+	})
+	client := Connect(t, router)
+	client.Disconnect()
+	select {
+	case <-closed:
+	default:
+		t.Fatal("close callback did not return before Disconnect")
+	}
+}
+
+func TestExpectClosed(t *testing.T) {
+	router := golem.NewRouter()
+	router.On("kick", func(conn *golem.Connection) {
+		conn.CloseWithReason(4000, "Kicked")
+	})
+	client := Connect(t, router)
+	client.Emit("kick", nil)
+	client.ExpectClosed(4000)
+}
+
+func TestPingTimeout(t *testing.T) {
+	router := golem.NewRouter()
+	closed := make(chan bool, 1)
+	router.OnClose(func(conn *golem.Connection) {
+		closed <- true
+	})
+	client := Connect(t, router)
+	client.PingTimeout()
+	if len(closed) != 1 {
+		t.Fatal("close callback not called after ping timeout")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	router := golem.NewRouter()
+	router.On("burst", func(conn *golem.Connection) {
+		for i := 0; i < 100; i++ {
+			conn.Emit("item", &text{"x"})
+		}
+	})
+	client := Connect(t, router)
+	defer client.Disconnect()
+
+	client.Pause()
+	client.Emit("burst", nil)
+	time.Sleep(10 * time.Millisecond)
+	if events := client.Drain(); len(events) > 1 {
+		t.Fatalf("received %d events while paused", len(events))
+	}
+	client.Resume()
+	client.Settle()
+	if events := client.Drain(); len(events) < 99 {
+		t.Fatalf("expected the remaining events after resume, received %d", len(events))
+	}
+}
+
+func TestFailures(t *testing.T) {
+	router := echoRouter()
+	tests := []struct {
+		name     string
+		test     func(*Client)
+		expected string
+	}{
+		{"wrong event", func(c *Client) {
+			c.Emit("echo", &text{"x"})
+			c.Expect("other", nil)
+		}, `expected event "other", received "echo"`},
+		{"timeout", func(c *Client) {
+			c.Receive()
+		}, "no event received within"},
+		{"unexpected event", func(c *Client) {
+			c.Emit("echo", &text{"x"})
+			c.ExpectNone()
+		}, `expected no event, received "echo"`},
+		{"not closed", func(c *Client) {
+			c.ExpectClosed(1000)
+		}, "connection not closed within"},
+	}
+	for _, test := range tests {
+		r := &recorder{TB: t}
+		client := Connect(r, router)
+		client.SetTimeout(20 * time.Millisecond)
+		failure := r.run(func() { test.test(client) })
+		if !strings.Contains(failure, test.expected) {
+			t.Errorf("%s: expected failure %q, got %q", test.name, test.expected, failure)
+		}
+		client.SetTimeout(time.Second)
+		client.Disconnect()
+	}
+}
@@ -0,0 +1,452 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// GraphQLTransportWSSubprotocol is the name of the WebSocket subprotocol spoken by
+	// the graphql-ws library, which is used by Apollo and urql.
+	GraphQLTransportWSSubprotocol = "graphql-transport-ws"
+	// Message types of the graphql-transport-ws subprotocol.
+	graphQLConnectionInit = "connection_init"
+	graphQLConnectionAck  = "connection_ack"
+	graphQLPing           = "ping"
+	graphQLPong           = "pong"
+	graphQLSubscribe      = "subscribe"
+	graphQLNext           = "next"
+	graphQLError          = "error"
+	graphQLComplete       = "complete"
+	// Close codes of the graphql-transport-ws subprotocol.
+	graphQLCloseBadRequest       = 4400
+	graphQLCloseUnauthorized     = 4401
+	graphQLCloseForbidden        = 4403
+	graphQLCloseInitTimeout      = 4408
+	graphQLCloseSubscriberExists = 4409
+	graphQLCloseTooManyInit      = 4429
+	// Time allowed between establishing the connection and receiving connection_init.
+	graphQLInitWait = 3 * time.Second
+)
+
+// Message envelope of the graphql-transport-ws subprotocol.
+type graphQLMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Publication emitted to the rooms of a topic, the subscription IDs of every
+// member are resolved when it is packed for the receiving connection.
+type graphQLPublication struct {
+	topic   string
+	payload json.RawMessage
+}
+
+// GraphQLError is a single error as it is send to the client in the payload of
+// an error message or inside of a result.
+type GraphQLError struct {
+	Message string `json:"message"`
+}
+
+// GraphQLRequest holds the payload of a subscribe message.
+type GraphQLRequest struct {
+	// ID of the subscription, unique for the connection.
+	ID string `json:"-"`
+	// Name of the requested operation.
+	OperationName string `json:"operationName"`
+	// The GraphQL document.
+	Query string `json:"query"`
+	// Raw variables of the operation.
+	Variables json.RawMessage `json:"variables"`
+	// Raw extensions of the operation.
+	Extensions json.RawMessage `json:"extensions"`
+}
+
+// DecodeVariables unmarshals the variables of the request into the provided structure.
+func (req *GraphQLRequest) DecodeVariables(v interface{}) error {
+	if len(req.Variables) == 0 {
+		return nil
+	}
+	return json.Unmarshal(req.Variables, v)
+}
+
+// GraphQLResolver resolves a subscribe request to the topic the subscription should
+// receive publications of. If an error is returned, it is send to the client and
+// no subscription is created.
+type GraphQLResolver func(*Connection, *GraphQLRequest) (string, error)
+
+// State of a single connection speaking graphql-transport-ws.
+type graphQLConnection struct {
+	// Flag whether connection_init was received.
+	initialised bool
+	// Flag whether connection_ack was send.
+	acknowledged bool
+	// Map of subscription IDs to their topics.
+	subscriptions map[string]string
+	// Timer closing the connection if it is not initialised in time.
+	timer *time.Timer
+}
+
+// GraphQLTransportWS adapts a router to the graphql-transport-ws subprotocol used by
+// Apollo and urql. Subscriptions are resolved to topics by pluggable resolvers,
+// every topic is a room of the associated room manager and results are pushed
+// to the subscribers by publishing to the topic. No GraphQL engine is involved,
+// the resolvers are responsible for interpreting the requests.
+type GraphQLTransportWS struct {
+	// Router the adapter is installed on.
+	router *Router
+	// Room manager holding one room per topic.
+	rooms *RoomManager
+	// Resolvers by operation name.
+	operations map[string]GraphQLResolver
+	// Active resolver.
+	resolver GraphQLResolver
+	// Function verifying connection_init.
+	initFunc func(*Connection, json.RawMessage) bool
+	// Time allowed to initialise connections.
+	initWait time.Duration
+	// State of active connections.
+	connections map[*Connection]*graphQLConnection
+	// Guards connections.
+	lock sync.Mutex
+}
+
+// NewGraphQLTransportWS installs the graphql-transport-ws adapter on the router and returns it.
+// The protocol of the router is replaced and the message types of the subprotocol are
+// registered as events, so the router should not be used for other purposes.
+// The room manager is used to manage the subscribers of topics.
+func NewGraphQLTransportWS(router *Router, rm *RoomManager) *GraphQLTransportWS {
+	gql := &GraphQLTransportWS{
+		router:      router,
+		rooms:       rm,
+		operations:  make(map[string]GraphQLResolver),
+		initFunc:    func(*Connection, json.RawMessage) bool { return true }, // Initialisation always allowed.
+		initWait:    graphQLInitWait,
+		connections: make(map[*Connection]*graphQLConnection),
+	}
+	gql.resolver = gql.resolveOperation
+	router.SetProtocol(&graphQLProtocol{gql})
+	router.callbacks[graphQLConnectionInit] = gql.handleInit
+	router.callbacks[graphQLSubscribe] = gql.handleSubscribe
+	router.callbacks[graphQLComplete] = gql.handleComplete
+	router.callbacks[graphQLPing] = gql.handlePing
+	router.callbacks[graphQLPong] = func(*Connection, interface{}) {}
+	router.connectHooks = append(router.connectHooks, gql.connected)
+	router.closeHooks = append(router.closeHooks, gql.closed)
+	return gql
+}
+
+// Operation registers the resolver for subscriptions of the named operation.
+func (gql *GraphQLTransportWS) Operation(name string, resolver GraphQLResolver) {
+	gql.operations[name] = resolver
+}
+
+// SetResolver replaces the resolver dispatching by operation name with a custom
+// resolver handling all subscribe requests.
+func (gql *GraphQLTransportWS) SetResolver(resolver GraphQLResolver) {
+	gql.resolver = resolver
+}
+
+// OnInit sets the callback verifying the payload of connection_init. If the function
+// returns false the connection is closed as forbidden.
+func (gql *GraphQLTransportWS) OnInit(callback func(*Connection, json.RawMessage) bool) {
+	gql.initFunc = callback
+}
+
+// SetInitTimeout sets the time clients are allowed to take to send connection_init.
+func (gql *GraphQLTransportWS) SetInitTimeout(d time.Duration) {
+	gql.initWait = d
+}
+
+// Publish sends data as next result to all subscriptions of the topic.
+func (gql *GraphQLTransportWS) Publish(topic string, data interface{}) error {
+	payload, err := json.Marshal(&struct {
+		Data interface{} `json:"data"`
+	}{data})
+	if err != nil {
+		return err
+	}
+	gql.rooms.Emit(topic, graphQLNext, &graphQLPublication{topic: topic, payload: payload})
+	return nil
+}
+
+// Complete ends all subscriptions of the topic.
+func (gql *GraphQLTransportWS) Complete(topic string) {
+	gql.rooms.Emit(topic, graphQLComplete, &graphQLPublication{topic: topic})
+}
+
+// Default resolver dispatching by operation name.
+func (gql *GraphQLTransportWS) resolveOperation(conn *Connection, req *GraphQLRequest) (string, error) {
+	if resolver, ok := gql.operations[req.OperationName]; ok {
+		return resolver(conn, req)
+	}
+	return "", errors.New("Unknown operation " + req.OperationName + ".")
+}
+
+// Start initialisation timeout of freshly established connection.
+func (gql *GraphQLTransportWS) connected(conn *Connection, r *http.Request) {
+	c := &graphQLConnection{
+		subscriptions: make(map[string]string),
+	}
+	c.timer = time.AfterFunc(gql.initWait, func() {
+		gql.lock.Lock()
+		initialised := c.initialised
+		gql.lock.Unlock()
+		if !initialised {
+			conn.CloseWithReason(graphQLCloseInitTimeout, "Connection initialisation timeout")
+		}
+	})
+	gql.lock.Lock()
+	gql.connections[conn] = c
+	gql.lock.Unlock()
+}
+
+// Clean up state and leave topics of closed connection.
+func (gql *GraphQLTransportWS) closed(conn *Connection) {
+	gql.lock.Lock()
+	c, ok := gql.connections[conn]
+	delete(gql.connections, conn)
+	gql.lock.Unlock()
+	if !ok {
+		return
+	}
+	c.timer.Stop()
+	left := make(map[string]bool)
+	for _, topic := range c.subscriptions {
+		if !left[topic] {
+			left[topic] = true
+			gql.rooms.Leave(topic, conn)
+		}
+	}
+}
+
+// Returns state of connection or nil if the connection is unknown.
+func (gql *GraphQLTransportWS) connection(conn *Connection) *graphQLConnection {
+	gql.lock.Lock()
+	defer gql.lock.Unlock()
+	return gql.connections[conn]
+}
+
+func (gql *GraphQLTransportWS) handleInit(conn *Connection, data interface{}) {
+	c := gql.connection(conn)
+	if c == nil {
+		return
+	}
+	gql.lock.Lock()
+	initialised := c.initialised
+	c.initialised = true
+	gql.lock.Unlock()
+	if initialised {
+		conn.CloseWithReason(graphQLCloseTooManyInit, "Too many initialisation requests")
+		return
+	}
+	c.timer.Stop()
+	if !gql.initFunc(conn, data.(*graphQLMessage).Payload) {
+		conn.CloseWithReason(graphQLCloseForbidden, "Forbidden")
+		return
+	}
+	gql.lock.Lock()
+	c.acknowledged = true
+	gql.lock.Unlock()
+	conn.Emit(graphQLConnectionAck, &graphQLMessage{})
+}
+
+func (gql *GraphQLTransportWS) handleSubscribe(conn *Connection, data interface{}) {
+	msg := data.(*graphQLMessage)
+	c := gql.connection(conn)
+	if c == nil {
+		return
+	}
+	req := &GraphQLRequest{}
+	if msg.ID == "" || json.Unmarshal(msg.Payload, req) != nil {
+		conn.CloseWithReason(graphQLCloseBadRequest, "Invalid subscribe message")
+		return
+	}
+	req.ID = msg.ID
+
+	gql.lock.Lock()
+	acknowledged := c.acknowledged
+	_, exists := c.subscriptions[msg.ID]
+	gql.lock.Unlock()
+	if !acknowledged {
+		conn.CloseWithReason(graphQLCloseUnauthorized, "Unauthorized")
+		return
+	}
+	if exists {
+		conn.CloseWithReason(graphQLCloseSubscriberExists, "Subscriber for "+msg.ID+" already exists")
+		return
+	}
+
+	topic, err := gql.resolver(conn, req)
+	if err != nil {
+		payload, _ := json.Marshal([]GraphQLError{{Message: err.Error()}})
+		conn.Emit(graphQLError, &graphQLMessage{ID: msg.ID, Payload: payload})
+		return
+	}
+
+	gql.lock.Lock()
+	joined := false
+	for _, t := range c.subscriptions {
+		if t == topic {
+			joined = true
+			break
+		}
+	}
+	gql.lock.Unlock()
+	if !joined && !gql.rooms.TryJoin(topic, conn) {
+		payload, _ := json.Marshal([]GraphQLError{{Message: "Not authorized."}})
+		conn.Emit(graphQLError, &graphQLMessage{ID: msg.ID, Payload: payload})
+		return
+	}
+	gql.lock.Lock()
+	c.subscriptions[msg.ID] = topic
+	gql.lock.Unlock()
+}
+
+func (gql *GraphQLTransportWS) handleComplete(conn *Connection, data interface{}) {
+	msg := data.(*graphQLMessage)
+	c := gql.connection(conn)
+	if c == nil {
+		return
+	}
+	gql.lock.Lock()
+	topic, ok := c.subscriptions[msg.ID]
+	delete(c.subscriptions, msg.ID)
+	stillJoined := false
+	for _, t := range c.subscriptions {
+		if t == topic {
+			stillJoined = true
+			break
+		}
+	}
+	gql.lock.Unlock()
+	if ok && !stillJoined {
+		gql.rooms.Leave(topic, conn)
+	}
+}
+
+func (gql *GraphQLTransportWS) handlePing(conn *Connection, data interface{}) {
+	conn.Emit(graphQLPong, &graphQLMessage{Payload: data.(*graphQLMessage).Payload})
+}
+
+// Returns the subscription IDs of the connection for the topic. If remove is set, the
+// subscriptions are removed and the connection leaves the topic.
+func (gql *GraphQLTransportWS) subscribers(conn *Connection, topic string, remove bool) []string {
+	gql.lock.Lock()
+	defer gql.lock.Unlock()
+	c, ok := gql.connections[conn]
+	if !ok {
+		return nil
+	}
+	ids := make([]string, 0, 1)
+	for id, t := range c.subscriptions {
+		if t == topic {
+			ids = append(ids, id)
+			if remove {
+				delete(c.subscriptions, id)
+			}
+		}
+	}
+	if remove && len(ids) > 0 {
+		go gql.rooms.Leave(topic, conn) // Not blocking the write pump.
+	}
+	return ids
+}
+
+// graphQLProtocol implements the JSON envelope of graphql-transport-ws. Incoming
+// messages are dispatched by their type and the interstage product is the envelope.
+type graphQLProtocol struct {
+	gql *GraphQLTransportWS
+}
+
+// Unpack decodes the envelope and returns the message type as event name.
+func (_ *graphQLProtocol) Unpack(data []byte) (string, interface{}, error) {
+	msg := &graphQLMessage{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return "", nil, err
+	}
+	if msg.Type == "" {
+		return "", nil, errors.New("Unable to extract message type from data.")
+	}
+	return msg.Type, msg, nil
+}
+
+// Unmarshals the payload of the envelope into the requested structure.
+func (_ *graphQLProtocol) Unmarshal(data interface{}, typePtr interface{}) error {
+	msg := data.(*graphQLMessage)
+	if len(msg.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(msg.Payload, typePtr)
+}
+
+// Packs an envelope with the event name as message type. Data that is not an envelope
+// is marshalled as payload.
+func (_ *graphQLProtocol) MarshalAndPack(name string, data interface{}) ([]byte, error) {
+	var msg graphQLMessage
+	if m, ok := data.(*graphQLMessage); ok {
+		msg = *m
+	} else if data != nil {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		msg.Payload = payload
+	}
+	msg.Type = name
+	return json.Marshal(&msg)
+}
+
+// Packs publications once for every subscription of the receiving connection.
+func (p *graphQLProtocol) MarshalAndPackFor(conn *Connection, name string, data interface{}) ([][]byte, error) {
+	pub, ok := data.(*graphQLPublication)
+	if !ok {
+		frame, err := p.MarshalAndPack(name, data)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{frame}, nil
+	}
+	ids := p.gql.subscribers(conn, pub.topic, name == graphQLComplete)
+	frames := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		frame, err := p.MarshalAndPack(name, &graphQLMessage{ID: id, Payload: pub.payload})
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// Return TextMode because JSON is transmitted using the text mode of WebSockets.
+func (_ *graphQLProtocol) GetReadMode() int {
+	return TextMode
+}
+
+// Return TextMode because JSON is transmitted using the text mode of WebSockets.
+func (_ *graphQLProtocol) GetWriteMode() int {
+	return TextMode
+}
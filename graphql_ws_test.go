@@ -0,0 +1,92 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"github.com/gorilla/websocket"
+	"testing"
+	"time"
+)
+
+// Returns a client socket connected to the GraphQL server of the router after initialisation.
+func connectGraphQL(t *testing.T, router *Router) *websocket.Conn {
+	socket := dialTest(t, router.Handler(), "/")
+	writeTest(t, socket, `{"type":"connection_init"}`)
+	if ack := readTest(t, socket); ack != `{"type":"connection_ack"}` {
+		t.Fatalf("expected connection_ack, received %q", ack)
+	}
+	return socket
+}
+
+func TestGraphQLSubscription(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	gql := NewGraphQLTransportWS(router, rm)
+	gql.Operation("onMessage", func(conn *Connection, req *GraphQLRequest) (string, error) {
+		return "messages", nil
+	})
+	socket := connectGraphQL(t, router)
+
+	writeTest(t, socket, `{"type":"subscribe","id":"1","payload":{"operationName":"onMessage","query":"subscription"}}`)
+	writeTest(t, socket, `{"type":"subscribe","id":"2","payload":{"operationName":"unknown","query":"subscription"}}`)
+	if msg := readTest(t, socket); msg != `{"type":"error","id":"2","payload":[{"message":"Unknown operation unknown."}]}` {
+		t.Fatalf("expected error, received %q", msg)
+	}
+	gql.Publish("messages", map[string]string{"text": "hi"})
+	if msg := readTest(t, socket); msg != `{"type":"next","id":"1","payload":{"data":{"text":"hi"}}}` {
+		t.Fatalf("expected next, received %q", msg)
+	}
+	gql.Complete("messages")
+	if msg := readTest(t, socket); msg != `{"type":"complete","id":"1"}` {
+		t.Fatalf("expected complete, received %q", msg)
+	}
+}
+
+func TestGraphQLSubscriptionDenied(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	rm.SetRoomPolicy("secret", denyAll)
+	gql := NewGraphQLTransportWS(router, rm)
+	gql.Operation("onSecret", func(conn *Connection, req *GraphQLRequest) (string, error) {
+		return "secret", nil
+	})
+	socket := connectGraphQL(t, router)
+
+	writeTest(t, socket, `{"type":"subscribe","id":"1","payload":{"operationName":"onSecret","query":"subscription"}}`)
+	if msg := readTest(t, socket); msg != `{"type":"error","id":"1","payload":[{"message":"Not authorized."}]}` {
+		t.Fatalf("expected error, received %q", msg)
+	}
+}
+
+func TestGraphQLRepeatedInit(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	NewGraphQLTransportWS(router, rm)
+	socket := connectGraphQL(t, router)
+
+	writeTest(t, socket, `{"type":"connection_init"}`)
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := socket.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != 4429 {
+		t.Fatalf("expected close with code 4429, received %v", err)
+	}
+}
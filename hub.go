@@ -67,10 +67,15 @@ func (hub *Hub) run() {
 					}
 				// Broadcast
 				case message := <-hub.broadcast:
+					if message.barrier != nil {
+						close(message.barrier)
+						continue
+					}
 					for conn := range hub.connections {
 						select {
 						case conn.send <- message:
 						default:
+							conn.router.metrics.evicted()
 							hub.remove(conn)
 						}
 					}
@@ -94,10 +99,19 @@ func GetHub() *Hub {
 	return &hub
 }
 
+// Sync blocks until all messages broadcasted before were queued for the connections,
+// e.g. to wait deterministically in tests.
+func (hub *Hub) Sync() {
+	barrier := make(chan struct{})
+	hub.broadcast <- &message{barrier: barrier}
+	<-barrier
+}
+
 // Broadcast emits an event with data to ALL active connections.
 func (hub *Hub) Broadcast(event string, data interface{}) {
 	hub.broadcast <- &message{
-		event: event,
-		data:  data,
+		event:  event,
+		data:   data,
+		shared: true,
 	}
 }
@@ -0,0 +1,427 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Default time a poll waits for outgoing messages.
+	defaultPollTimeout = 25 * time.Second
+	// Default time a session is kept without any poll or post of the client.
+	defaultSessionTimeout = 30 * time.Second
+	// Maximum number of outgoing messages waiting for acknowledgement.
+	longPollingMaxPending = 1024
+	// Maximum size of posted batches.
+	longPollingMaxBody = 1 << 20
+)
+
+var (
+	errTooManyPending = errors.New("Too many messages waiting for acknowledgement.")
+)
+
+// LongPollingMessage is a message in the batches exchanged by the long-polling transport.
+type LongPollingMessage struct {
+	// Sequence number, consecutive per direction starting with 1.
+	Seq uint64 `json:"seq"`
+	// Name of the event, only set for outgoing messages.
+	Event string `json:"event,omitempty"`
+	// Frame packed by the protocol of the router, base64 encoded if Binary is set.
+	Data string `json:"data"`
+	// Marks binary frames.
+	Binary bool `json:"binary,omitempty"`
+}
+
+// LongPolling serves connections of a router using HTTP long-polling as fallback for clients
+// only capable of plain XHR. The connections behave like WebSocket connections, so handlers,
+// rooms and the hub work transparently. All requests go to the same URL:
+//
+// GET without session parameter opens a session and responds with {"session": <session ID>}.
+//
+// GET with session=<session ID>&ack=<sequence number> polls outgoing messages. Messages up to
+// the acknowledged sequence number are discarded, the remaining ones are returned as JSON array
+// of LongPollingMessage. If none are available the poll waits until messages are emitted or
+// the poll timeout passed, in which case an empty array is returned. Unacknowledged messages are
+// send again, so clients should skip sequence numbers they already handled. A new poll of the
+// same session ends the previous one. A closed connection sends a last message with the event
+// "$close" and {"code": <status code>, "reason": <reason>} as data.
+//
+// POST with session=<session ID> sends a JSON array of LongPollingMessage, with sequence numbers
+// consecutive starting with 1. Messages already handled are skipped, so batches can be posted
+// again if the response got lost, gaps are rejected with 409. The response is send once all
+// messages were handed over to the connection, which handles them in order, not after they
+// were handled.
+//
+// Sessions without polls or posts expire after the session timeout, which closes the connection.
+type LongPolling struct {
+	// Associated router.
+	router *Router
+	// Sessions by ID.
+	sessions map[string]*longPollingTransport
+	// Guards sessions.
+	lock sync.Mutex
+	// Settings of polls and sessions.
+	pollTimeout    time.Duration
+	sessionTimeout time.Duration
+}
+
+// NewLongPolling creates the long-polling fallback for the router.
+func NewLongPolling(router *Router) *LongPolling {
+	return &LongPolling{
+		router:         router,
+		sessions:       make(map[string]*longPollingTransport),
+		pollTimeout:    defaultPollTimeout,
+		sessionTimeout: defaultSessionTimeout,
+	}
+}
+
+// SetPollTimeout sets the maximum time a poll waits for outgoing messages.
+func (lp *LongPolling) SetPollTimeout(timeout time.Duration) {
+	lp.pollTimeout = timeout
+}
+
+// SetSessionTimeout sets the time after which sessions without any activity of the client expire.
+// It should be longer than the poll timeout.
+func (lp *LongPolling) SetSessionTimeout(timeout time.Duration) {
+	lp.sessionTimeout = timeout
+}
+
+// Handler creates a handler function opening sessions, serving polls and posted messages.
+func (lp *LongPolling) Handler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("session")
+		if r.Method == "GET" && id == "" {
+			lp.open(w, r)
+			return
+		}
+		if r.Method != "GET" && r.Method != "POST" {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		lp.lock.Lock()
+		t, ok := lp.sessions[id]
+		lp.lock.Unlock()
+		if !ok {
+			http.Error(w, "Unknown session", 404)
+			return
+		}
+		if r.Method == "GET" {
+			lp.poll(w, r, t)
+		} else {
+			lp.post(w, r, t)
+		}
+	}
+}
+
+// Opens a session and serves its connection in the background.
+func (lp *LongPolling) open(w http.ResponseWriter, r *http.Request) {
+	r = withHandshakeState(r)
+	ticket, ok := lp.router.accept(w, r)
+	if !ok {
+		return
+	}
+	id, err := newSessionID()
+	if err != nil {
+		ticket.release()
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	t := newLongPollingTransport()
+	t.expiry = time.AfterFunc(lp.sessionTimeout, func() { t.Close() })
+	lp.lock.Lock()
+	lp.sessions[id] = t
+	lp.lock.Unlock()
+
+	go func() {
+		defer ticket.release()
+		defer func() {
+			// Unlike handlers of the http-package, the session is served outside of the request,
+			// so a panicking callback would crash the server.
+			if err := recover(); err != nil {
+				log.Println("Panic serving long-polling session:", err)
+			}
+			t.Close()
+			// Keep the session until the client had the chance to poll the remaining messages.
+			time.AfterFunc(lp.pollTimeout, func() {
+				lp.lock.Lock()
+				delete(lp.sessions, id)
+				lp.lock.Unlock()
+			})
+		}()
+		lp.router.ServeTransport(t, r)
+	}()
+
+	writeJSONResponse(w, map[string]string{"session": id})
+}
+
+// Responds with the outgoing messages of the session.
+func (lp *LongPolling) poll(w http.ResponseWriter, r *http.Request, t *longPollingTransport) {
+	ack, _ := strconv.ParseUint(r.URL.Query().Get("ack"), 10, 64)
+	t.begin()
+	defer t.end(lp.sessionTimeout)
+	t.pong()
+	messages := t.take(ack, lp.pollTimeout, r.Context().Done())
+	if messages == nil {
+		messages = []LongPollingMessage{}
+	}
+	writeJSONResponse(w, messages)
+}
+
+// Hands the posted messages over to the connection in order.
+func (lp *LongPolling) post(w http.ResponseWriter, r *http.Request, t *longPollingTransport) {
+	t.begin()
+	defer t.end(lp.sessionTimeout)
+	body, status := readFrameBody(r, longPollingMaxBody)
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	var messages []LongPollingMessage
+	if err := json.Unmarshal(body, &messages); err != nil {
+		http.Error(w, "Invalid batch", 400)
+		return
+	}
+	t.pong()
+
+	// Posts of the same session are handled one after another to preserve the order.
+	t.postLock.Lock()
+	defer t.postLock.Unlock()
+	limit := t.limit()
+	for _, m := range messages {
+		if m.Seq < t.nextSeq {
+			continue // Already handled.
+		}
+		if m.Seq > t.nextSeq {
+			http.Error(w, "Missing message "+strconv.FormatUint(t.nextSeq, 10), 409)
+			return
+		}
+		data, mode := []byte(m.Data), TextMode
+		if m.Binary {
+			decoded, err := base64.StdEncoding.DecodeString(m.Data)
+			if err != nil {
+				http.Error(w, "Invalid message "+strconv.FormatUint(m.Seq, 10), 400)
+				return
+			}
+			data, mode = decoded, BinaryMode
+		}
+		if limit > 0 && int64(len(data)) > limit {
+			http.Error(w, http.StatusText(413), 413)
+			return
+		}
+		if !t.deliver(mode, data) {
+			http.Error(w, "Session closed", 410)
+			return
+		}
+		t.nextSeq++
+	}
+	w.WriteHeader(204)
+}
+
+// Writes the value as uncached JSON response.
+func writeJSONResponse(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Cache-Control", "no-cache")
+	w.Write(data)
+}
+
+// Transport queueing outgoing messages until they are polled and reading posted messages.
+type longPollingTransport struct {
+	httpInbound
+	// Outgoing messages waiting for acknowledgement, guarded by lock of httpInbound.
+	outgoing []LongPollingMessage
+	// Sequence number of the last outgoing message.
+	lastSeq uint64
+	// Closed and replaced whenever outgoing messages or polls change.
+	changed chan struct{}
+	// Incremented by every poll, older polls end if it changes.
+	poll uint64
+	// Set if the transport was closed.
+	closed bool
+	// Set once the close event was queued, it is the last outgoing message.
+	closeQueued bool
+	// Number of requests of the client in progress and the timer expiring the session otherwise.
+	active int
+	expiry *time.Timer
+	// Serialises posts and holds the next expected sequence number.
+	postLock sync.Mutex
+	nextSeq  uint64
+}
+
+func newLongPollingTransport() *longPollingTransport {
+	return &longPollingTransport{
+		httpInbound: newHTTPInbound(),
+		changed:     make(chan struct{}),
+		nextSeq:     1,
+	}
+}
+
+// Wakes up waiting polls, lock has to be held.
+func (t *longPollingTransport) signal() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// Marks the start of a request of the client, sessions do not expire meanwhile.
+func (t *longPollingTransport) begin() {
+	t.lock.Lock()
+	t.active++
+	t.expiry.Stop()
+	t.lock.Unlock()
+}
+
+// Marks the end of a request of the client, starting the expiry if it was the last one.
+func (t *longPollingTransport) end(timeout time.Duration) {
+	t.lock.Lock()
+	t.active--
+	if t.active == 0 && !t.closed {
+		t.expiry.Reset(timeout)
+	}
+	t.lock.Unlock()
+}
+
+// Discards acknowledged messages and waits for outgoing messages, until the timeout passed, the
+// request was canceled or a newer poll started. Returns the messages waiting for acknowledgement.
+func (t *longPollingTransport) take(ack uint64, timeout time.Duration, cancel <-chan struct{}) []LongPollingMessage {
+	t.lock.Lock()
+	i := 0
+	for i < len(t.outgoing) && t.outgoing[i].Seq <= ack {
+		i++
+	}
+	t.outgoing = t.outgoing[i:]
+	t.poll++
+	poll := t.poll
+	t.signal()
+	t.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		t.lock.Lock()
+		if t.poll != poll {
+			t.lock.Unlock()
+			return nil
+		}
+		if len(t.outgoing) > 0 || t.closed {
+			messages := append([]LongPollingMessage(nil), t.outgoing...)
+			t.lock.Unlock()
+			return messages
+		}
+		changed := t.changed
+		t.lock.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil
+		case <-cancel:
+			return nil
+		}
+	}
+}
+
+// Queues an outgoing message for the next poll.
+func (t *longPollingTransport) push(event string, mode int, data []byte) error {
+	m := LongPollingMessage{Event: event, Data: string(data)}
+	if mode == BinaryMode {
+		m.Data = base64.StdEncoding.EncodeToString(data)
+		m.Binary = true
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed || t.closeQueued {
+		return ErrTransportClosed
+	}
+	if len(t.outgoing) >= longPollingMaxPending {
+		return errTooManyPending
+	}
+	t.append(m)
+	return nil
+}
+
+// Appends an outgoing message and wakes up waiting polls, lock has to be held.
+func (t *longPollingTransport) append(m LongPollingMessage) {
+	t.lastSeq++
+	m.Seq = t.lastSeq
+	t.outgoing = append(t.outgoing, m)
+	t.signal()
+}
+
+// Queues the close event, lock has to be held. If it was queued already, e.g. without status
+// by Close, its data is replaced unless it was polled meanwhile.
+func (t *longPollingTransport) queueClose(data []byte) {
+	if !t.closeQueued {
+		t.closeQueued = true
+		t.append(LongPollingMessage{Event: httpCloseEvent, Data: string(data)})
+	} else if last := len(t.outgoing) - 1; last >= 0 && t.outgoing[last].Event == httpCloseEvent {
+		t.outgoing[last].Data = string(data)
+	}
+}
+
+func (t *longPollingTransport) WriteFrame(mode int, data []byte) error {
+	return t.push("", mode, data)
+}
+
+// WriteEventFrame queues the frame labelled with the event name.
+func (t *longPollingTransport) WriteEventFrame(event string, mode int, data []byte) error {
+	return t.push(event, mode, data)
+}
+
+// WritePing does nothing, polls and posts of the client are reported as pongs.
+func (t *longPollingTransport) WritePing() error {
+	return nil
+}
+
+// WriteClose queues the close event, which is also possible after Close as long as the close
+// event queued by Close was not polled yet.
+func (t *longPollingTransport) WriteClose(code int, reason string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.queueClose(closeEventData(code, reason))
+	return nil
+}
+
+// Close ends reading and waiting polls, the remaining messages including the close event can
+// still be polled.
+func (t *longPollingTransport) Close() error {
+	if !t.closeInbound() {
+		return nil
+	}
+	t.lock.Lock()
+	if !t.closeQueued { // Before marking closed, so the client learns about it.
+		t.queueClose(closeEventData(0, ""))
+	}
+	t.closed = true
+	t.expiry.Stop()
+	t.signal()
+	t.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,221 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Client of a long-polling session.
+type testPoller struct {
+	t       *testing.T
+	url     string
+	session string
+	ack     uint64
+}
+
+func openPoller(t *testing.T, lp *LongPolling) *testPoller {
+	server := httptest.NewServer(http.HandlerFunc(lp.Handler()))
+	t.Cleanup(server.Close)
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("opening session failed: %v", err)
+	}
+	defer res.Body.Close()
+	var opened map[string]string
+	if err := json.NewDecoder(res.Body).Decode(&opened); err != nil || opened["session"] == "" {
+		t.Fatalf("expected session, received %v %v", opened, err)
+	}
+	return &testPoller{t: t, url: server.URL + "?session=" + opened["session"]}
+}
+
+// Polls once acknowledging all messages received so far, returns the messages and status.
+func (p *testPoller) poll() ([]LongPollingMessage, int) {
+	p.t.Helper()
+	res, err := http.Get(p.url + "&ack=" + strconv.FormatUint(p.ack, 10))
+	if err != nil {
+		p.t.Fatalf("polling failed: %v", err)
+	}
+	defer res.Body.Close()
+	var messages []LongPollingMessage
+	json.NewDecoder(res.Body).Decode(&messages)
+	if len(messages) > 0 {
+		p.ack = messages[len(messages)-1].Seq
+	}
+	return messages, res.StatusCode
+}
+
+// Polls until n messages were received.
+func (p *testPoller) receive(n int) []LongPollingMessage {
+	p.t.Helper()
+	var received []LongPollingMessage
+	for deadline := time.Now().Add(time.Second); len(received) < n; {
+		if time.Now().After(deadline) {
+			p.t.Fatalf("expected %d messages, received %v", n, received)
+		}
+		messages, _ := p.poll()
+		received = append(received, messages...)
+	}
+	return received
+}
+
+func (p *testPoller) post(body string) int {
+	p.t.Helper()
+	res, err := http.Post(p.url, "application/json", strings.NewReader(body))
+	if err != nil {
+		p.t.Fatalf("posting failed: %v", err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestLongPolling(t *testing.T) {
+	router := NewRouter()
+	router.On("echo", func(conn *Connection, data *testMessage) {
+		conn.Emit("echo", data)
+	})
+	router.On("bye", func(conn *Connection) {
+		conn.CloseWithReason(4000, "Bye")
+	})
+	lp := NewLongPolling(router)
+	lp.SetPollTimeout(100 * time.Millisecond)
+	p := openPoller(t, lp)
+
+	if status := p.post(`[{"seq":1,"data":"echo {\"text\":\"a\"}"},{"seq":2,"data":"echo {\"text\":\"b\"}"}]`); status != 204 {
+		t.Fatalf("expected status 204, received %d", status)
+	}
+	// Resent messages are skipped, gaps are rejected.
+	if status := p.post(`[{"seq":2,"data":"echo {\"text\":\"b\"}"},{"seq":3,"data":"echo {\"text\":\"c\"}"}]`); status != 204 {
+		t.Fatalf("expected status 204, received %d", status)
+	}
+	if status := p.post(`[{"seq":5,"data":"echo {}"}]`); status != 409 {
+		t.Fatalf("expected status 409, received %d", status)
+	}
+	messages := p.receive(3)
+	for i, text := range []string{"a", "b", "c"} {
+		m := messages[i]
+		if m.Seq != uint64(i+1) || m.Event != "echo" || m.Data != `echo {"text":"`+text+`"}` {
+			t.Fatalf("unexpected message %+v", m)
+		}
+	}
+	// Unacknowledged messages are delivered again.
+	p.ack = 2
+	if messages, _ := p.poll(); len(messages) != 1 || messages[0].Seq != 3 {
+		t.Fatalf("expected message 3 to be delivered again, received %v", messages)
+	}
+
+	p.post(`[{"seq":4,"data":"bye null"}]`)
+	if m := p.receive(1)[0]; m.Event != "$close" || m.Data != `{"code":4000,"reason":"Bye"}` {
+		t.Fatalf("expected close event, received %+v", m)
+	}
+}
+
+func TestLongPollingExpiry(t *testing.T) {
+	router := NewRouter()
+	closed := make(chan bool, 1)
+	router.OnClose(func(conn *Connection) {
+		closed <- true
+	})
+	lp := NewLongPolling(router)
+	lp.SetPollTimeout(20 * time.Millisecond)
+	lp.SetSessionTimeout(50 * time.Millisecond)
+	p := openPoller(t, lp)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("session without polls did not expire")
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		if _, status := p.poll(); status == 404 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired session was not removed")
+		}
+	}
+}
+
+func TestLongPollingCloseEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		close    func(*longPollingTransport)
+		expected string
+	}{
+		{"close", func(t *longPollingTransport) {
+			t.Close()
+		}, `{"code":0,"reason":""}`},
+		{"close frame after close", func(t *longPollingTransport) {
+			t.Close()
+			t.WriteClose(4000, "Bye")
+		}, `{"code":4000,"reason":"Bye"}`},
+		{"close after close frame", func(t *longPollingTransport) {
+			t.WriteClose(4001, "First")
+			t.Close()
+		}, `{"code":4001,"reason":"First"}`},
+	}
+	for _, test := range tests {
+		transport := newLongPollingTransport()
+		transport.expiry = time.AfterFunc(time.Hour, func() {})
+		test.close(transport)
+		if err := transport.WriteFrame(TextMode, []byte("x")); err == nil {
+			t.Errorf("%s: expected writing after close to fail", test.name)
+		}
+		if len(transport.outgoing) != 1 || transport.outgoing[0].Event != "$close" || transport.outgoing[0].Data != test.expected {
+			t.Errorf("%s: expected single close event %s, queued %v", test.name, test.expected, transport.outgoing)
+		}
+	}
+}
+
+func TestLongPollingPanic(t *testing.T) {
+	router := NewRouter()
+	router.SetAdmissionLimits(AdmissionLimits{MaxConnections: 1})
+	router.On("panic", func(conn *Connection) {
+		panic("callback failed")
+	})
+	lp := NewLongPolling(router)
+	lp.SetPollTimeout(10 * time.Millisecond)
+	lp.SetSessionTimeout(100 * time.Millisecond)
+	p := openPoller(t, lp)
+
+	p.post(`[{"seq":1,"data":"panic null"}]`)
+	// The session is closed and its connection released, so another session is admitted.
+	for deadline := time.Now().Add(time.Second); ; {
+		server := httptest.NewServer(http.HandlerFunc(lp.Handler()))
+		res, err := http.Get(server.URL)
+		server.Close()
+		if err != nil {
+			t.Fatalf("opening session failed: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected session to be admitted after panic, received status %d", res.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -18,8 +18,52 @@
 
 package golem
 
+import (
+	"github.com/gorilla/websocket"
+	"sync"
+)
+
 // Message is container for unprepared data and therefore holds the event name and the pointer to the struct holding the data.
 type message struct {
 	event string
 	data  interface{}
+	// Set for messages delivered to several connections (rooms and broadcasts), the packed
+	// data of shared messages is reused by all connections of the same router.
+	shared bool
+	// Prepared data of shared messages by router.
+	prepared map[*Router]*preparedMessage
+	// Guards prepared.
+	lock sync.Mutex
+	// Set for barriers, which are closed by the loops of hub and rooms instead of being
+	// delivered once all messages queued before were delivered.
+	barrier chan struct{}
+}
+
+// Packed data of a shared message, that is ready to be written. The prepared message
+// compresses the data only once for all connections using the same compression level.
+type preparedMessage struct {
+	data []byte
+	msg  *websocket.PreparedMessage
+	err  error
+}
+
+// Returns the prepared data for connections of the router, packing it on first use.
+func (m *message) prepare(router *Router, mode int) (*preparedMessage, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if p, ok := m.prepared[router]; ok {
+		return p, p.err
+	}
+	p := &preparedMessage{}
+	data, err := router.protocol.MarshalAndPack(m.event, m.data)
+	if err == nil {
+		p.data = data
+		p.msg, err = websocket.NewPreparedMessage(webSocketMessageType(mode), data)
+	}
+	p.err = err
+	if m.prepared == nil {
+		m.prepared = make(map[*Router]*preparedMessage)
+	}
+	m.prepared[router] = p
+	return p, err
 }
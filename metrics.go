@@ -0,0 +1,333 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Event label of messages, that could not be unpacked or whose event has no callback, to
+	// bound the number of series clients can create, also by topics of the adapters.
+	unknownEventLabel = "(unknown)"
+	// Content type of the Prometheus text exposition format.
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// Buckets of the handler latency in seconds.
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// Buckets of the send queue depth in messages, up to the size of the send channel.
+	queueDepthBuckets = []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 512}
+)
+
+// Types of metric families.
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+// A metric family with all its series by label values.
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+// A single series of a metric family.
+type metricSeries struct {
+	values []string
+	// Value of counters and gauges.
+	value float64
+	// Bucket counts, sum and count of histograms.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Creates a metric family, buckets are only used by histograms.
+func newMetricFamily(name string, help string, kind string, buckets []float64, labels ...string) *metricFamily {
+	return &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+}
+
+// Returns the series of the label values, creating it on first use.
+func (f *metricFamily) get(values []string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{values: values}
+		if f.kind == histogramMetric {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Writes the family in the text exposition format.
+func (f *metricFamily) write(w *bufio.Writer) {
+	if len(f.series) == 0 {
+		return
+	}
+	w.WriteString("# HELP " + f.name + " " + f.help + "\n")
+	w.WriteString("# TYPE " + f.name + " " + f.kind + "\n")
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != histogramMetric {
+			w.WriteString(f.name + formatLabels(f.labels, s.values, "") + " " + formatFloat(s.value) + "\n")
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			w.WriteString(f.name + "_bucket" + formatLabels(f.labels, s.values, formatFloat(bound)) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		w.WriteString(f.name + "_bucket" + formatLabels(f.labels, s.values, "+Inf") + " " + strconv.FormatUint(s.count, 10) + "\n")
+		w.WriteString(f.name + "_sum" + formatLabels(f.labels, s.values, "") + " " + formatFloat(s.sum) + "\n")
+		w.WriteString(f.name + "_count" + formatLabels(f.labels, s.values, "") + " " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+}
+
+// Formats label names and values, adding the le label of histogram buckets if provided.
+func formatLabels(names []string, values []string, le string) string {
+	if len(names) == 0 && le == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+"=\""+labelReplacer.Replace(values[i])+"\"")
+	}
+	if le != "" {
+		pairs = append(pairs, "le=\""+le+"\"")
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Escapes label values.
+var labelReplacer = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// Formats sample values and bucket bounds.
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Metrics collects metrics of routers and room managers and exposes them in the Prometheus
+// text exposition format. Routers and room managers are added using their SetMetrics methods
+// with a name, that is used as label to distinguish them:
+//
+//	metrics := golem.NewMetrics()
+//	router.SetMetrics(metrics, "chat")
+//	http.Handle("/metrics", metrics.Handler())
+type Metrics struct {
+	// Guards all families.
+	lock sync.Mutex
+	// Families in order of exposition.
+	families []*metricFamily
+	// Families by purpose.
+	connections     *metricFamily
+	rooms           *metricFamily
+	members         *metricFamily
+	received        *metricFamily
+	receivedBytes   *metricFamily
+	sent            *metricFamily
+	sentBytes       *metricFamily
+	unmarshalErrors *metricFamily
+	evictions       *metricFamily
+	rejections      *metricFamily
+	handlerLatency  *metricFamily
+	sendQueueDepth  *metricFamily
+}
+
+// NewMetrics creates a new instance and returns the pointer to it.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		connections:     newMetricFamily("golem_connections", "Number of active connections.", gaugeMetric, nil, "router"),
+		rooms:           newMetricFamily("golem_rooms", "Number of rooms of the room manager.", gaugeMetric, nil, "manager"),
+		members:         newMetricFamily("golem_room_members", "Number of memberships in rooms of the room manager.", gaugeMetric, nil, "manager"),
+		received:        newMetricFamily("golem_messages_received_total", "Number of messages received.", counterMetric, nil, "router", "event"),
+		receivedBytes:   newMetricFamily("golem_received_bytes_total", "Number of bytes of messages received.", counterMetric, nil, "router", "event"),
+		sent:            newMetricFamily("golem_messages_sent_total", "Number of messages sent.", counterMetric, nil, "router", "event"),
+		sentBytes:       newMetricFamily("golem_sent_bytes_total", "Number of bytes of messages sent.", counterMetric, nil, "router", "event"),
+		unmarshalErrors: newMetricFamily("golem_unmarshal_failures_total", "Number of messages, that could not be unpacked or unmarshalled.", counterMetric, nil, "router", "event"),
+		evictions:       newMetricFamily("golem_slow_consumer_evictions_total", "Number of connections removed from rooms or the hub, because their send queue was full.", counterMetric, nil, "router"),
+		rejections:      newMetricFamily("golem_handshake_rejections_total", "Number of rejected connection requests.", counterMetric, nil, "router", "reason"),
+		handlerLatency:  newMetricFamily("golem_handler_duration_seconds", "Time spent in event handlers.", histogramMetric, latencyBuckets, "router", "event"),
+		sendQueueDepth:  newMetricFamily("golem_send_queue_depth", "Number of messages waiting in the send queue, when a message is written.", histogramMetric, queueDepthBuckets, "router"),
+	}
+	m.families = []*metricFamily{
+		m.connections, m.rooms, m.members,
+		m.received, m.receivedBytes, m.sent, m.sentBytes,
+		m.unmarshalErrors, m.evictions, m.rejections,
+		m.handlerLatency, m.sendQueueDepth,
+	}
+	return m
+}
+
+// Adds the delta to the series of a counter or gauge.
+func (m *Metrics) add(f *metricFamily, delta float64, values ...string) {
+	m.lock.Lock()
+	f.get(values).value += delta
+	m.lock.Unlock()
+}
+
+// Sets the value of the series of a gauge.
+func (m *Metrics) set(f *metricFamily, value float64, values ...string) {
+	m.lock.Lock()
+	f.get(values).value = value
+	m.lock.Unlock()
+}
+
+// Observes the value in the series of a histogram.
+func (m *Metrics) observe(f *metricFamily, value float64, values ...string) {
+	m.lock.Lock()
+	s := f.get(values)
+	for i, bound := range f.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+	m.lock.Unlock()
+}
+
+// Writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) writeTo(w *bufio.Writer) error {
+	m.lock.Lock()
+	for _, f := range m.families {
+		f.write(w)
+	}
+	m.lock.Unlock()
+	return w.Flush()
+}
+
+// Handler returns a http.Handler exposing the metrics in the Prometheus text exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		m.writeTo(bufio.NewWriter(w))
+	})
+}
+
+// Metrics of a router, all methods are no-ops if metrics are disabled.
+type routerMetrics struct {
+	metrics *Metrics
+	name    string
+}
+
+func (rm *routerMetrics) connected() {
+	if rm != nil {
+		rm.metrics.add(rm.metrics.connections, 1, rm.name)
+	}
+}
+
+func (rm *routerMetrics) closed() {
+	if rm != nil {
+		rm.metrics.add(rm.metrics.connections, -1, rm.name)
+	}
+}
+
+func (rm *routerMetrics) received(event string, size int) {
+	if rm != nil {
+		rm.metrics.add(rm.metrics.received, 1, rm.name, event)
+		rm.metrics.add(rm.metrics.receivedBytes, float64(size), rm.name, event)
+	}
+}
+
+func (rm *routerMetrics) sent(event string) {
+	if rm != nil {
+		rm.metrics.add(rm.metrics.sent, 1, rm.name, event)
+	}
+}
+
+func (rm *routerMetrics) sentBytes(event string, size int) {
+	if rm != nil {
+		rm.metrics.add(rm.metrics.sentBytes, float64(size), rm.name, event)
+	}
+}
+
+func (rm *routerMetrics) unmarshalFailed(event string) {
+	if rm != nil {
+		rm.metrics.add(rm.metrics.unmarshalErrors, 1, rm.name, event)
+	}
+}
+
+func (rm *routerMetrics) evicted() {
+	if rm != nil {
+		rm.metrics.add(rm.metrics.evictions, 1, rm.name)
+	}
+}
+
+func (rm *routerMetrics) rejected(reason string) {
+	if rm != nil {
+		rm.metrics.add(rm.metrics.rejections, 1, rm.name, reason)
+	}
+}
+
+func (rm *routerMetrics) handled(event string, d time.Duration) {
+	if rm != nil {
+		rm.metrics.observe(rm.metrics.handlerLatency, d.Seconds(), rm.name, event)
+	}
+}
+
+func (rm *routerMetrics) queued(depth int) {
+	if rm != nil {
+		rm.metrics.observe(rm.metrics.sendQueueDepth, float64(depth), rm.name)
+	}
+}
+
+// Metrics of a room manager, all methods are no-ops if metrics are disabled.
+type managerMetrics struct {
+	metrics *Metrics
+	name    string
+}
+
+func (mm *managerMetrics) update(rooms int, members int) {
+	if mm != nil {
+		mm.metrics.set(mm.metrics.rooms, float64(rooms), mm.name)
+		mm.metrics.set(mm.metrics.members, float64(members), mm.name)
+	}
+}
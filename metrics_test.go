@@ -0,0 +1,147 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the exposed metrics.
+func scrapeMetrics(t *testing.T, metrics *Metrics) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := w.Header().Get("Content-Type"); contentType != metricsContentType {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+	return w.Body.String()
+}
+
+// Waits until the exposed metrics contain all the lines.
+func expectMetrics(t *testing.T, metrics *Metrics, lines ...string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		exposed := scrapeMetrics(t, metrics)
+		missing := ""
+		for _, line := range lines {
+			if !strings.Contains(exposed, line+"\n") {
+				missing = line
+				break
+			}
+		}
+		if missing == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected metric %q, exposed:\n%s", missing, exposed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMetricsRouter(t *testing.T) {
+	metrics := NewMetrics()
+	router := NewRouter()
+	router.SetMetrics(metrics, "chat")
+	router.On("echo", func(conn *Connection, data *testMessage) {
+		conn.Emit("echo", data)
+	})
+	if exposed := scrapeMetrics(t, metrics); exposed != "" {
+		t.Fatalf("expected no metrics before use, exposed:\n%s", exposed)
+	}
+
+	client := connectMemory(t, router)
+	expectMetrics(t, metrics,
+		"# HELP golem_connections Number of active connections.",
+		"# TYPE golem_connections gauge",
+		`golem_connections{router="chat"} 1`,
+	)
+
+	message := `echo {"text":"hello"}`
+	client.WriteFrame(TextMode, []byte(message))
+	readMemory(t, client)
+	client.WriteFrame(TextMode, []byte(`missing {}`))
+	expectMetrics(t, metrics,
+		"# TYPE golem_messages_received_total counter",
+		`golem_messages_received_total{router="chat",event="echo"} 1`,
+		`golem_received_bytes_total{router="chat",event="echo"} 21`,
+		`golem_messages_sent_total{router="chat",event="echo"} 1`,
+		`golem_sent_bytes_total{router="chat",event="echo"} 21`,
+		`golem_messages_received_total{router="chat",event="(unknown)"} 1`,
+		"# TYPE golem_handler_duration_seconds histogram",
+		`golem_handler_duration_seconds_bucket{router="chat",event="echo",le="+Inf"} 1`,
+		`golem_handler_duration_seconds_count{router="chat",event="echo"} 1`,
+		`golem_send_queue_depth_count{router="chat"} 1`,
+	)
+
+	client.WriteFrame(TextMode, []byte(`echo {"text":`))
+	expectMetrics(t, metrics, `golem_unmarshal_failures_total{router="chat",event="echo"} 1`)
+
+	client.Close()
+	expectMetrics(t, metrics, `golem_connections{router="chat"} 0`)
+}
+
+func TestMetricsRejections(t *testing.T) {
+	metrics := NewMetrics()
+	router := NewRouter()
+	router.SetMetrics(metrics, "chat")
+	router.Handler()(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+	router.Handler()(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expectMetrics(t, metrics,
+		`golem_handshake_rejections_total{router="chat",reason="method"} 1`,
+		`golem_handshake_rejections_total{router="chat",reason="upgrade"} 1`,
+	)
+}
+
+func TestMetricsRoomManager(t *testing.T) {
+	metrics := NewMetrics()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	rm.SetMetrics(metrics, "rooms")
+	router := NewRouter()
+	connected := make(chan *Connection, 1)
+	router.OnConnect(func(conn *Connection, r *http.Request) {
+		connected <- conn
+	})
+	connectMemory(t, router)
+	conn := <-connected
+
+	rm.Join("a", conn)
+	rm.Join("b", conn)
+	expectMetrics(t, metrics,
+		`golem_rooms{manager="rooms"} 2`,
+		`golem_room_members{manager="rooms"} 2`,
+	)
+	rm.Leave("a", conn)
+	expectMetrics(t, metrics,
+		`golem_rooms{manager="rooms"} 1`,
+		`golem_room_members{manager="rooms"} 1`,
+	)
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.add(metrics.received, 1, "a\"b\\c\nd", "e")
+	expectMetrics(t, metrics, `golem_messages_received_total{router="a\"b\\c\nd",event="e"} 1`)
+}
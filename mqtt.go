@@ -0,0 +1,853 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// MQTTSubprotocol is the WebSocket subprotocol name of MQTT.
+	MQTTSubprotocol = "mqtt"
+	// Control packet types.
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttPubrel      = 6
+	mqttPubcomp     = 7
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+	// Event names of packets other than PUBLISH are prefixed with NUL, which
+	// cannot be part of a topic, to not collide with topic names.
+	mqttPacketPrefix = "\x00"
+	// Event name of malformed packets, which close the connection.
+	mqttMalformed = mqttPacketPrefix + "malformed"
+	// Return codes of CONNACK.
+	mqttAccepted              = 0
+	mqttUnacceptableProtocol  = 1
+	mqttIdentifierRejected    = 2
+	mqttNotAuthorized         = 5
+	mqttSubscriptionFailure   = 0x80
+	mqttMaxQoS                = 1
+	mqttMaxRemainingLength    = 268435455
+	mqttGeneratedClientPrefix = "golem-"
+	// Default and upper limit of unacknowledged QoS 1 messages per session.
+	mqttDefaultMaxInflight = 64
+	mqttMaxInflight        = 65535
+)
+
+// MQTTMessage is an application message published to a topic. Handlers taking
+// interface{} as data receive the message of PUBLISH packets directly.
+type MQTTMessage struct {
+	// Topic the message was published to.
+	Topic string
+	// Payload of the message.
+	Payload []byte
+	// Quality of service the message was published with.
+	QoS byte
+	// Flag whether the message should be retained.
+	Retain bool
+	// Packet identifier of QoS 1 messages.
+	packetID uint16
+}
+
+// MQTTConnectInfo holds the information of a CONNECT packet, that is necessary to
+// authenticate the client.
+type MQTTConnectInfo struct {
+	ClientID     string
+	Username     string
+	Password     []byte
+	CleanSession bool
+	KeepAlive    time.Duration
+}
+
+// Publication emitted to the room of a topic filter.
+type mqttPublication struct {
+	filter string
+	msg    *MQTTMessage
+}
+
+// Already encoded control packet.
+type mqttRaw []byte
+
+// Control packet with fixed header split from its body.
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// Encodes a control packet with fixed header.
+func encodeMQTTPacket(kind, flags byte, body []byte) []byte {
+	out := make([]byte, 0, len(body)+5)
+	out = append(out, kind<<4|flags)
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 128
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(out, body...)
+}
+
+// Parses a single control packet, the data needs to contain exactly one packet.
+func parseMQTTPacket(data []byte) (*mqttPacket, error) {
+	if len(data) < 2 {
+		return nil, errors.New("MQTT packet too short.")
+	}
+	length, multiplier, i := 0, 1, 1
+	for {
+		if i >= len(data) || i > 4 {
+			return nil, errors.New("Malformed MQTT remaining length.")
+		}
+		b := data[i]
+		length += int(b&127) * multiplier
+		multiplier *= 128
+		i++
+		if b&128 == 0 {
+			break
+		}
+	}
+	if length > mqttMaxRemainingLength || len(data)-i != length {
+		return nil, errors.New("MQTT remaining length does not match packet.")
+	}
+	return &mqttPacket{kind: data[0] >> 4, flags: data[0] & 15, body: data[i:]}, nil
+}
+
+// Reads a length prefixed string and returns it and the remaining data. Strings need to be
+// valid UTF-8 without U+0000.
+func readMQTTString(b []byte) (string, []byte, error) {
+	data, rest, err := readMQTTBytes(b)
+	if err != nil {
+		return "", nil, err
+	}
+	if !utf8.Valid(data) || strings.ContainsRune(string(data), 0) {
+		return "", nil, errors.New("Malformed MQTT string.")
+	}
+	return string(data), rest, nil
+}
+
+// Reads length prefixed binary data and returns it and the remaining data.
+func readMQTTBytes(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("Unexpected end of MQTT packet.")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, errors.New("Unexpected end of MQTT packet.")
+	}
+	return b[2 : 2+n], b[2+n:], nil
+}
+
+// Appends a length prefixed string.
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// Decodes the variable header and payload of a PUBLISH packet.
+func decodeMQTTPublish(p *mqttPacket) (*MQTTMessage, error) {
+	msg := &MQTTMessage{
+		QoS:    (p.flags >> 1) & 3,
+		Retain: p.flags&1 == 1,
+	}
+	topic, rest, err := readMQTTString(p.body)
+	if err != nil {
+		return nil, err
+	}
+	msg.Topic = topic
+	if msg.QoS > 0 {
+		if len(rest) < 2 {
+			return nil, errors.New("PUBLISH packet without packet identifier.")
+		}
+		msg.packetID = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	msg.Payload = rest
+	return msg, nil
+}
+
+// Encodes a PUBLISH packet.
+func encodeMQTTPublish(msg *MQTTMessage, qos byte, packetID uint16) []byte {
+	flags := qos << 1
+	if msg.Retain {
+		flags |= 1
+	}
+	body := appendMQTTString(make([]byte, 0, len(msg.Topic)+len(msg.Payload)+4), msg.Topic)
+	if qos > 0 {
+		body = append(body, byte(packetID>>8), byte(packetID))
+	}
+	body = append(body, msg.Payload...)
+	return encodeMQTTPacket(mqttPublish, flags, body)
+}
+
+// Returns an acknowledgement packet only consisting of the packet identifier.
+func mqttAck(kind byte, packetID uint16) mqttRaw {
+	return mqttRaw(encodeMQTTPacket(kind, 0, []byte{byte(packetID >> 8), byte(packetID)}))
+}
+
+// Verifies that the topic filter only contains valid wildcards.
+func validMQTTFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns whether the topic name matches the topic filter. Topics starting with $ are
+// not matched by filters starting with a wildcard.
+func matchMQTTTopic(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (f[0] == "#" || f[0] == "+") {
+		return false
+	}
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// State of a single connection speaking MQTT.
+type mqttSession struct {
+	// Flag whether CONNECT was accepted.
+	connected bool
+	// Flag whether the client disconnected gracefully.
+	graceful bool
+	// Client identifier.
+	clientID string
+	// Granted QoS by topic filter.
+	subscriptions map[string]byte
+	// Last will published on ungraceful disconnect.
+	will *MQTTMessage
+	// Last packet identifier used for outgoing QoS 1 messages.
+	lastPacketID uint16
+	// Unacknowledged outgoing QoS 1 messages.
+	inflight map[uint16]bool
+	// Time the last packet was received.
+	lastSeen time.Time
+	// Closed to stop keep-alive checks.
+	stop chan bool
+}
+
+// MQTT turns a router into a minimal MQTT 3.1.1 broker endpoint for clients using
+// WebSockets, e.g. mqtt.js. Every topic filter subscribed to is a room of the associated
+// room manager and publications are emitted to the rooms of all matching filters.
+// PUBLISH packets are additionally dispatched to the handlers registered with the topic
+// as event name, their payload is unmarshalled as JSON unless the handler accepts
+// *[]byte or *string. QoS 0 and 1 are supported, retained messages and last wills are
+// kept in memory and sessions are always clean. Each WebSocket message has to contain
+// exactly one control packet.
+type MQTT struct {
+	// Router the adapter is installed on.
+	router *Router
+	// Room manager holding one room per topic filter.
+	rooms *RoomManager
+	// Function verifying CONNECT packets.
+	connectFunc func(*Connection, *MQTTConnectInfo) bool
+	// State of active connections.
+	sessions map[*Connection]*mqttSession
+	// Active connection by client identifier.
+	clients map[string]*Connection
+	// Subscriber count by topic filter.
+	filters map[string]int
+	// Retained messages by topic.
+	retained map[string]*MQTTMessage
+	// Counter for generated client identifiers.
+	generatedID uint64
+	// Maximum number of unacknowledged QoS 1 messages per session.
+	maxInflight int
+	// Guards all state.
+	lock sync.Mutex
+}
+
+// NewMQTT installs the MQTT broker on the router and returns it. The protocol of the router
+// is replaced and the room manager is used to manage the subscribers of topic filters.
+func NewMQTT(router *Router, rm *RoomManager) *MQTT {
+	m := &MQTT{
+		router:      router,
+		rooms:       rm,
+		connectFunc: func(*Connection, *MQTTConnectInfo) bool { return true }, // Connect always allowed.
+		sessions:    make(map[*Connection]*mqttSession),
+		clients:     make(map[string]*Connection),
+		filters:     make(map[string]int),
+		retained:    make(map[string]*MQTTMessage),
+		maxInflight: mqttDefaultMaxInflight,
+	}
+	router.SetProtocol(&mqttProtocol{m})
+	prefix := func(kind byte) string { return mqttPacketPrefix + strconv.Itoa(int(kind)) }
+	router.callbacks[prefix(mqttConnect)] = m.handleConnect
+	router.callbacks[prefix(mqttSubscribe)] = m.handleSubscribe
+	router.callbacks[prefix(mqttUnsubscribe)] = m.handleUnsubscribe
+	router.callbacks[prefix(mqttPuback)] = m.handlePuback
+	router.callbacks[prefix(mqttPingreq)] = func(conn *Connection, data interface{}) {
+		conn.Emit(mqttPacketPrefix, mqttRaw(encodeMQTTPacket(mqttPingresp, 0, nil)))
+	}
+	router.callbacks[prefix(mqttDisconnect)] = m.handleDisconnect
+	router.callbacks[mqttMalformed] = func(conn *Connection, data interface{}) {
+		conn.Close()
+	}
+	router.connectHooks = append(router.connectHooks, m.connected)
+	router.closeHooks = append(router.closeHooks, m.closed)
+	router.middleware = append(router.middleware, m.intercept)
+	return m
+}
+
+// SetMaxInflight sets the maximum number of unacknowledged QoS 1 messages per session, the
+// receive maximum of the client, by default 64. Dropping further QoS 1 messages would break
+// their at-least-once delivery, so the connection of a session exceeding the maximum is closed
+// instead. Values above 65535 are clamped.
+func (m *MQTT) SetMaxInflight(max int) {
+	if max <= 0 {
+		max = mqttDefaultMaxInflight
+	} else if max > mqttMaxInflight {
+		max = mqttMaxInflight
+	}
+	m.lock.Lock()
+	m.maxInflight = max
+	m.lock.Unlock()
+}
+
+// OnConnect sets the callback verifying CONNECT packets, e.g. by username and password.
+// If the function returns false the connection is refused as not authorized.
+func (m *MQTT) OnConnect(callback func(*Connection, *MQTTConnectInfo) bool) {
+	m.connectFunc = callback
+}
+
+// Publish sends the payload to all subscribers of matching topic filters. Byte slices and
+// strings are used as payload directly, everything else is marshalled as JSON.
+// QoS values above 1 are downgraded to 1.
+func (m *MQTT) Publish(topic string, data interface{}, qos byte, retain bool) error {
+	payload, err := mqttPayload(data)
+	if err != nil {
+		return err
+	}
+	if qos > mqttMaxQoS {
+		qos = mqttMaxQoS
+	}
+	m.publish(&MQTTMessage{Topic: topic, Payload: payload, QoS: qos, Retain: retain})
+	return nil
+}
+
+// Forwards message to the rooms of all matching filters and updates retained messages.
+func (m *MQTT) publish(msg *MQTTMessage) {
+	m.lock.Lock()
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(m.retained, msg.Topic)
+		} else {
+			m.retained[msg.Topic] = msg
+		}
+	}
+	filters := make([]string, 0)
+	for filter := range m.filters {
+		if matchMQTTTopic(filter, msg.Topic) {
+			filters = append(filters, filter)
+		}
+	}
+	m.lock.Unlock()
+	// Retain flag is only set for messages delivered because of a new subscription.
+	forwarded := *msg
+	forwarded.Retain = false
+	for _, filter := range filters {
+		m.rooms.Emit(filter, msg.Topic, &mqttPublication{filter: filter, msg: &forwarded})
+	}
+}
+
+// Returns the session of the connection or nil if the connection is unknown.
+func (m *MQTT) session(conn *Connection) *mqttSession {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.sessions[conn]
+}
+
+func (m *MQTT) connected(conn *Connection, r *http.Request) {
+	m.lock.Lock()
+	m.sessions[conn] = &mqttSession{
+		subscriptions: make(map[string]byte),
+		inflight:      make(map[uint16]bool),
+		lastSeen:      time.Now(),
+		stop:          make(chan bool),
+	}
+	m.lock.Unlock()
+}
+
+func (m *MQTT) closed(conn *Connection) {
+	m.lock.Lock()
+	session, ok := m.sessions[conn]
+	delete(m.sessions, conn)
+	if ok && m.clients[session.clientID] == conn {
+		delete(m.clients, session.clientID)
+	}
+	if ok {
+		for filter := range session.subscriptions {
+			m.unsubscribed(filter)
+		}
+	}
+	m.lock.Unlock()
+	if !ok {
+		return
+	}
+	close(session.stop)
+	for filter := range session.subscriptions {
+		m.rooms.Leave(filter, conn)
+	}
+	if session.will != nil && !session.graceful {
+		m.publish(session.will)
+	}
+}
+
+// Decrements subscriber count of filter, needs to be called with lock held.
+func (m *MQTT) unsubscribed(filter string) {
+	m.filters[filter]--
+	if m.filters[filter] <= 0 {
+		delete(m.filters, filter)
+	}
+}
+
+// Middleware tracking activity, rejecting packets of unconnected sessions and acting
+// as broker for PUBLISH packets.
+func (m *MQTT) intercept(next dispatchFunc) dispatchFunc {
+	return func(conn *Connection, name string, data interface{}) {
+		session := m.session(conn)
+		if session == nil {
+			return
+		}
+		m.lock.Lock()
+		session.lastSeen = time.Now()
+		connected := session.connected
+		m.lock.Unlock()
+		if !connected && name != mqttPacketPrefix+strconv.Itoa(mqttConnect) {
+			conn.Close() // The first packet has to be CONNECT.
+			return
+		}
+		msg, ok := data.(*MQTTMessage)
+		if !ok {
+			next(conn, name, data)
+			return
+		}
+		if msg.QoS > mqttMaxQoS || strings.ContainsAny(msg.Topic, "+#") || msg.Topic == "" {
+			conn.Close()
+			return
+		}
+		next(conn, name, data)
+		m.publish(msg)
+		if msg.QoS == 1 {
+			conn.trySend(&message{event: mqttPacketPrefix, data: mqttAck(mqttPuback, msg.packetID)})
+		}
+	}
+}
+
+// Emits CONNACK with return code.
+func (m *MQTT) connack(conn *Connection, code byte) {
+	conn.Emit(mqttPacketPrefix, mqttRaw(encodeMQTTPacket(mqttConnack, 0, []byte{0, code})))
+}
+
+func (m *MQTT) handleConnect(conn *Connection, data interface{}) {
+	p := data.(*mqttPacket)
+	session := m.session(conn)
+	m.lock.Lock()
+	connected := session.connected
+	m.lock.Unlock()
+	if connected { // Second CONNECT is a protocol violation.
+		conn.Close()
+		return
+	}
+	name, rest, err := readMQTTString(p.body)
+	if err != nil || name != "MQTT" || len(rest) < 4 {
+		conn.Close()
+		return
+	}
+	if rest[0] != 4 { // Protocol level of 3.1.1
+		m.connack(conn, mqttUnacceptableProtocol)
+		conn.Close()
+		return
+	}
+	flags := rest[1]
+	if flags&0x01 != 0 || (flags&0x04 == 0 && flags&0x38 != 0) || (flags&0x80 == 0 && flags&0x40 != 0) {
+		conn.Close() // Reserved flag, will flags without will or password without username.
+		return
+	}
+	info := &MQTTConnectInfo{
+		CleanSession: flags&0x02 != 0,
+		KeepAlive:    time.Duration(binary.BigEndian.Uint16(rest[2:])) * time.Second,
+	}
+	rest = rest[4:]
+	if info.ClientID, rest, err = readMQTTString(rest); err != nil {
+		conn.Close()
+		return
+	}
+	var will *MQTTMessage
+	if flags&0x04 != 0 {
+		will = &MQTTMessage{QoS: (flags >> 3) & 3, Retain: flags&0x20 != 0}
+		if will.Topic, rest, err = readMQTTString(rest); err != nil {
+			conn.Close()
+			return
+		}
+		if will.Payload, rest, err = readMQTTBytes(rest); err != nil {
+			conn.Close()
+			return
+		}
+		if will.QoS > mqttMaxQoS {
+			will.QoS = mqttMaxQoS
+		}
+	}
+	if flags&0x80 != 0 {
+		if info.Username, rest, err = readMQTTString(rest); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	if flags&0x40 != 0 {
+		if info.Password, _, err = readMQTTBytes(rest); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	if info.ClientID == "" {
+		if !info.CleanSession {
+			m.connack(conn, mqttIdentifierRejected)
+			conn.Close()
+			return
+		}
+		m.lock.Lock()
+		m.generatedID++
+		info.ClientID = mqttGeneratedClientPrefix + strconv.FormatUint(m.generatedID, 10)
+		m.lock.Unlock()
+	}
+	if !m.connectFunc(conn, info) {
+		m.connack(conn, mqttNotAuthorized)
+		conn.Close()
+		return
+	}
+
+	m.lock.Lock()
+	previous, taken := m.clients[info.ClientID]
+	m.clients[info.ClientID] = conn
+	session.connected = true
+	session.clientID = info.ClientID
+	session.will = will
+	m.lock.Unlock()
+	if taken { // Only one connection per client identifier.
+		previous.Close()
+	}
+	m.connack(conn, mqttAccepted)
+	if info.KeepAlive > 0 {
+		go m.keepAlive(conn, session, info.KeepAlive)
+	}
+}
+
+// Closes the connection if no packet was received for one and a half keep-alive periods.
+func (m *MQTT) keepAlive(conn *Connection, session *mqttSession, period time.Duration) {
+	ticker := time.NewTicker(period / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.lock.Lock()
+			idle := time.Since(session.lastSeen)
+			m.lock.Unlock()
+			if idle > period*3/2 {
+				conn.Close()
+				return
+			}
+		case <-session.stop:
+			return
+		}
+	}
+}
+
+func (m *MQTT) handleSubscribe(conn *Connection, data interface{}) {
+	p := data.(*mqttPacket)
+	if p.flags != 2 || len(p.body) < 2 {
+		conn.Close()
+		return
+	}
+	session := m.session(conn)
+	packetID := binary.BigEndian.Uint16(p.body)
+	rest := p.body[2:]
+	codes := make([]byte, 0, 1)
+	joined := make([]string, 0, 1)
+	for len(rest) > 0 {
+		filter, r, err := readMQTTString(rest)
+		if err != nil || len(r) < 1 {
+			conn.Close()
+			return
+		}
+		qos := r[0]
+		rest = r[1:]
+		if !validMQTTFilter(filter) || qos > 2 {
+			codes = append(codes, mqttSubscriptionFailure)
+			continue
+		}
+		if qos > mqttMaxQoS {
+			qos = mqttMaxQoS
+		}
+		m.lock.Lock()
+		_, subscribed := session.subscriptions[filter]
+		m.lock.Unlock()
+		if !subscribed && !m.rooms.TryJoin(filter, conn) { // Denied by the policies of the room.
+			codes = append(codes, mqttSubscriptionFailure)
+			continue
+		}
+		m.lock.Lock()
+		if !subscribed {
+			m.filters[filter]++
+			joined = append(joined, filter)
+		}
+		session.subscriptions[filter] = qos
+		m.lock.Unlock()
+		codes = append(codes, qos)
+	}
+	if len(codes) == 0 {
+		conn.Close()
+		return
+	}
+	conn.Emit(mqttPacketPrefix, mqttRaw(encodeMQTTPacket(mqttSuback, 0, append([]byte{byte(packetID >> 8), byte(packetID)}, codes...))))
+
+	// Deliver retained messages of new subscriptions.
+	m.lock.Lock()
+	retained := make([]*mqttPublication, 0)
+	for _, filter := range joined {
+		for topic, msg := range m.retained {
+			if matchMQTTTopic(filter, topic) {
+				retained = append(retained, &mqttPublication{filter: filter, msg: msg})
+			}
+		}
+	}
+	m.lock.Unlock()
+	for _, pub := range retained {
+		conn.Emit(pub.msg.Topic, pub)
+	}
+}
+
+func (m *MQTT) handleUnsubscribe(conn *Connection, data interface{}) {
+	p := data.(*mqttPacket)
+	if p.flags != 2 || len(p.body) < 2 {
+		conn.Close()
+		return
+	}
+	session := m.session(conn)
+	packetID := binary.BigEndian.Uint16(p.body)
+	rest := p.body[2:]
+	for len(rest) > 0 {
+		filter, r, err := readMQTTString(rest)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		rest = r
+		m.lock.Lock()
+		_, ok := session.subscriptions[filter]
+		if ok {
+			delete(session.subscriptions, filter)
+			m.unsubscribed(filter)
+		}
+		m.lock.Unlock()
+		if ok {
+			m.rooms.Leave(filter, conn)
+		}
+	}
+	conn.Emit(mqttPacketPrefix, mqttAck(mqttUnsuback, packetID))
+}
+
+func (m *MQTT) handlePuback(conn *Connection, data interface{}) {
+	p := data.(*mqttPacket)
+	if len(p.body) != 2 {
+		conn.Close()
+		return
+	}
+	session := m.session(conn)
+	m.lock.Lock()
+	delete(session.inflight, binary.BigEndian.Uint16(p.body))
+	m.lock.Unlock()
+}
+
+func (m *MQTT) handleDisconnect(conn *Connection, data interface{}) {
+	session := m.session(conn)
+	m.lock.Lock()
+	session.graceful = true
+	m.lock.Unlock()
+	conn.Close()
+}
+
+// Returns the QoS granted to the connection for the filter and the packet identifier to
+// use. The third return value is false, if the connection is not subscribed or the maximum
+// of messages in flight is exceeded, so the message is dropped. In the latter case the
+// connection is closed.
+func (m *MQTT) delivery(conn *Connection, filter string, qos byte) (byte, uint16, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	session, ok := m.sessions[conn]
+	if !ok {
+		return 0, 0, false
+	}
+	granted, ok := session.subscriptions[filter]
+	if !ok {
+		return 0, 0, false
+	}
+	if granted < qos {
+		qos = granted
+	}
+	if qos == 0 {
+		return 0, 0, true
+	}
+	if len(session.inflight) >= m.maxInflight {
+		go conn.Close() // Not holding the lock of the broker.
+		return 0, 0, false
+	}
+	for { // Terminates, because fewer than 65535 identifiers are in flight.
+		session.lastPacketID++
+		if session.lastPacketID != 0 && !session.inflight[session.lastPacketID] {
+			break
+		}
+	}
+	session.inflight[session.lastPacketID] = true
+	return qos, session.lastPacketID, true
+}
+
+// Returns the payload for data, byte slices and strings are used directly.
+func mqttPayload(data interface{}) ([]byte, error) {
+	switch d := data.(type) {
+	case []byte:
+		return d, nil
+	case string:
+		return []byte(d), nil
+	}
+	return json.Marshal(data)
+}
+
+// mqttProtocol implements the binary packet codec of MQTT. PUBLISH packets are unpacked
+// using their topic as event name, all other packets are handled by the broker.
+type mqttProtocol struct {
+	mqtt *MQTT
+}
+
+// Unpack parses the control packet and returns the event name and interstage product,
+// which is *MQTTMessage for PUBLISH packets. Malformed packets are unpacked as event closing
+// the connection.
+func (_ *mqttProtocol) Unpack(data []byte) (string, interface{}, error) {
+	p, err := parseMQTTPacket(data)
+	if err != nil {
+		return mqttMalformed, nil, nil
+	}
+	if p.kind == mqttPublish {
+		msg, err := decodeMQTTPublish(p)
+		if err != nil {
+			return mqttMalformed, nil, nil
+		}
+		return msg.Topic, msg, nil
+	}
+	return mqttPacketPrefix + strconv.Itoa(int(p.kind)), p, nil
+}
+
+// Unmarshals the payload of the message into the requested structure. Pointers to byte
+// slices and strings receive the raw payload, everything else is unmarshalled as JSON.
+func (_ *mqttProtocol) Unmarshal(data interface{}, typePtr interface{}) error {
+	msg, ok := data.(*MQTTMessage)
+	if !ok {
+		return errors.New("Only PUBLISH packets can be unmarshalled.")
+	}
+	switch ptr := typePtr.(type) {
+	case *[]byte:
+		*ptr = msg.Payload
+		return nil
+	case *string:
+		*ptr = string(msg.Payload)
+		return nil
+	}
+	return json.Unmarshal(msg.Payload, typePtr)
+}
+
+// Packs encoded control packets as they are and any other data as QoS 0 PUBLISH
+// packet using the event name as topic.
+func (_ *mqttProtocol) MarshalAndPack(name string, data interface{}) ([]byte, error) {
+	switch d := data.(type) {
+	case mqttRaw:
+		return d, nil
+	case *mqttPublication:
+		return encodeMQTTPublish(d.msg, 0, 0), nil
+	}
+	payload, err := mqttPayload(data)
+	if err != nil {
+		return nil, err
+	}
+	return encodeMQTTPublish(&MQTTMessage{Topic: name, Payload: payload}, 0, 0), nil
+}
+
+// Packs publications with the QoS granted to the subscription of the receiving connection.
+func (p *mqttProtocol) MarshalAndPackFor(conn *Connection, name string, data interface{}) ([][]byte, error) {
+	pub, ok := data.(*mqttPublication)
+	if !ok {
+		frame, err := p.MarshalAndPack(name, data)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{frame}, nil
+	}
+	qos, packetID, ok := p.mqtt.delivery(conn, pub.filter, pub.msg.QoS)
+	if !ok { // Unsubscribed meanwhile or too many messages in flight.
+		return nil, nil
+	}
+	return [][]byte{encodeMQTTPublish(pub.msg, qos, packetID)}, nil
+}
+
+// Return BinaryMode because MQTT packets are transmitted using the binary mode of WebSockets.
+func (_ *mqttProtocol) GetReadMode() int {
+	return BinaryMode
+}
+
+// Return BinaryMode because MQTT packets are transmitted using the binary mode of WebSockets.
+func (_ *mqttProtocol) GetWriteMode() int {
+	return BinaryMode
+}
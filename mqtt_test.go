@@ -0,0 +1,222 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"github.com/gorilla/websocket"
+	"testing"
+	"time"
+)
+
+func denyAll(*Connection) bool { return false }
+
+// Starts an MQTT broker and returns a connected client socket.
+func connectMQTT(t *testing.T, router *Router, rm *RoomManager) (*MQTT, *websocket.Conn) {
+	m := NewMQTT(router, rm)
+	socket := dialTest(t, router.Handler(), "/")
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, 0x02, 0, 60)
+	body = appendMQTTString(body, "test")
+	writeMQTT(t, socket, encodeMQTTPacket(mqttConnect, 0, body))
+	if connack := readTest(t, socket); connack != "\x20\x02\x00\x00" {
+		t.Fatalf("expected CONNACK, received %x", connack)
+	}
+	return m, socket
+}
+
+func writeMQTT(t *testing.T, socket *websocket.Conn, packet []byte) {
+	t.Helper()
+	if err := socket.WriteMessage(websocket.BinaryMessage, packet); err != nil {
+		t.Fatalf("writing failed: %v", err)
+	}
+}
+
+func subscribeMQTT(id byte, filters ...string) []byte {
+	body := []byte{0, id}
+	for _, filter := range filters {
+		body = append(appendMQTTString(body, filter), 1)
+	}
+	return encodeMQTTPacket(mqttSubscribe, 2, body)
+}
+
+// Reads a PUBLISH packet and returns the message.
+func readMQTTPublish(t *testing.T, socket *websocket.Conn) *MQTTMessage {
+	t.Helper()
+	p, err := parseMQTTPacket([]byte(readTest(t, socket)))
+	if err != nil || p.kind != mqttPublish {
+		t.Fatalf("expected PUBLISH, received %v %v", p, err)
+	}
+	msg, err := decodeMQTTPublish(p)
+	if err != nil {
+		t.Fatalf("decoding PUBLISH failed: %v", err)
+	}
+	return msg
+}
+
+func TestMQTTPublishSubscribe(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	received := make(chan string, 1)
+	router.On("a/b", func(conn *Connection, data *string) {
+		received <- *data
+	})
+	m, socket := connectMQTT(t, router, rm)
+
+	writeMQTT(t, socket, subscribeMQTT(7, "a/+"))
+	if suback := readTest(t, socket); suback != "\x90\x03\x00\x07\x01" {
+		t.Fatalf("expected SUBACK, received %x", suback)
+	}
+	m.Publish("a/b", "hello", 1, false)
+	if msg := readMQTTPublish(t, socket); msg.Topic != "a/b" || string(msg.Payload) != "hello" || msg.QoS != 1 {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	writeMQTT(t, socket, encodeMQTTPublish(&MQTTMessage{Topic: "a/b", Payload: []byte("hi")}, 0, 0))
+	select {
+	case data := <-received:
+		if data != "hi" {
+			t.Fatalf("expected hi, received %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback of topic not called")
+	}
+	if msg := readMQTTPublish(t, socket); msg.Topic != "a/b" || string(msg.Payload) != "hi" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	writeMQTT(t, socket, encodeMQTTPacket(mqttPingreq, 0, nil))
+	if pingresp := readTest(t, socket); pingresp != "\xd0\x00" {
+		t.Fatalf("expected PINGRESP, received %x", pingresp)
+	}
+}
+
+func TestMQTTRetained(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	m, socket := connectMQTT(t, router, rm)
+
+	m.Publish("status", "up", 0, true)
+	writeMQTT(t, socket, subscribeMQTT(1, "status"))
+	if suback := readTest(t, socket); suback != "\x90\x03\x00\x01\x01" {
+		t.Fatalf("expected SUBACK, received %x", suback)
+	}
+	if msg := readMQTTPublish(t, socket); !msg.Retain || string(msg.Payload) != "up" {
+		t.Fatalf("expected retained message, received %+v", msg)
+	}
+}
+
+func TestMQTTSubscriptionDenied(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	rm.SetRoomPolicy("secret", denyAll)
+	m, socket := connectMQTT(t, router, rm)
+
+	writeMQTT(t, socket, subscribeMQTT(3, "secret", "public"))
+	if suback := readTest(t, socket); suback != "\x90\x04\x00\x03\x80\x01" {
+		t.Fatalf("expected SUBACK with failure, received %x", suback)
+	}
+	m.Publish("secret", "x", 0, false)
+	m.Publish("public", "y", 0, false)
+	if msg := readMQTTPublish(t, socket); msg.Topic != "public" {
+		t.Fatalf("received message of denied subscription %+v", msg)
+	}
+}
+
+func TestMQTTRequiresConnect(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	NewMQTT(router, rm)
+	socket := dialTest(t, router.Handler(), "/")
+	writeMQTT(t, socket, encodeMQTTPacket(mqttPingreq, 0, nil))
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := socket.ReadMessage(); err == nil {
+		t.Fatal("expected connection to be closed")
+	}
+}
+
+// Fails the test unless the connection is closed.
+func expectMQTTClosed(t *testing.T, socket *websocket.Conn) {
+	t.Helper()
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, _, err := socket.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+			t.Fatal("expected connection to be closed")
+		}
+		return
+	}
+}
+
+func TestMQTTRejectsMalformedTopics(t *testing.T) {
+	for _, topic := range []string{"\x00" + "8", "a/\xff"} {
+		router := NewRouter()
+		rm := NewRoomManager()
+		_, socket := connectMQTT(t, router, rm)
+		writeMQTT(t, socket, encodeMQTTPublish(&MQTTMessage{Topic: topic}, 0, 0))
+		expectMQTTClosed(t, socket)
+		rm.Stop()
+	}
+}
+
+func TestMQTTConnectFlags(t *testing.T) {
+	for _, flags := range []byte{0x03, 0x42, 0x12, 0x22} { // Reserved, password without username, will QoS and retain without will.
+		router := NewRouter()
+		rm := NewRoomManager()
+		NewMQTT(router, rm)
+		socket := dialTest(t, router.Handler(), "/")
+		body := appendMQTTString(nil, "MQTT")
+		body = append(body, 4, flags, 0, 60)
+		body = appendMQTTString(body, "test")
+		writeMQTT(t, socket, encodeMQTTPacket(mqttConnect, 0, body))
+		expectMQTTClosed(t, socket)
+		rm.Stop()
+	}
+}
+
+func TestMQTTInflightLimit(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	m, socket := connectMQTT(t, router, rm)
+	m.SetMaxInflight(1)
+
+	writeMQTT(t, socket, subscribeMQTT(1, "a"))
+	readTest(t, socket)
+	m.Publish("a", "1", 1, false)
+	first := readMQTTPublish(t, socket)
+	writeMQTT(t, socket, encodeMQTTPacket(mqttPuback, 0, []byte{0, 1}))
+	// Packets are handled in order, so the response implies the acknowledgement was processed.
+	writeMQTT(t, socket, encodeMQTTPacket(mqttPingreq, 0, nil))
+	readTest(t, socket)
+	m.Publish("a", "2", 1, false)
+	second := readMQTTPublish(t, socket)
+	if string(first.Payload) != "1" || string(second.Payload) != "2" {
+		t.Fatalf("expected messages 1 and 2, received %q and %q", first.Payload, second.Payload)
+	}
+	// Without acknowledgement of the second message the limit is exceeded.
+	m.Publish("a", "3", 1, false)
+	expectMQTTClosed(t, socket)
+}
@@ -0,0 +1,238 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Frame types of stream connections, matching the opcodes of WebSockets.
+	netTextFrame   = 1
+	netBinaryFrame = 2
+	netCloseFrame  = 8
+	netPingFrame   = 9
+	netPongFrame   = 10
+	// Size of the frame header, type followed by the length of the payload.
+	netHeaderSize = 5
+	// Maximum delay between retries after temporary accept errors.
+	maxAcceptDelay = time.Second
+	// Status code of close frames of connections rejected by the admission limits (try again later).
+	netRejectedCode = 1013
+)
+
+var (
+	errUnknownFrameType = errors.New("Unknown frame type.")
+	// Errors of accepting connections, after which accepting is retried, e.g. because the
+	// file descriptors are exhausted until other connections are closed.
+	temporaryAcceptErrors = []error{syscall.ECONNABORTED, syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM}
+)
+
+// Transport framing messages on stream connections like TCP or Unix-domain sockets.
+type netTransport struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// Serialises writes of the writing connection and pongs send while reading.
+	writeLock sync.Mutex
+	// Only used by the reader.
+	readLimit   int64
+	pongHandler func()
+}
+
+// NewNetTransport frames messages on a stream connection, e.g. TCP or Unix-domain sockets,
+// as described for Serve. It can be used by clients connecting to a router using Serve.
+func NewNetTransport(conn net.Conn) Transport {
+	return &netTransport{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Serve accepts stream connections, e.g. TCP or Unix-domain sockets, of the listener and serves
+// them like WebSocket connections, so they share handlers, rooms and the hub with all other
+// connections. Serve blocks until accepting fails permanently, e.g. because the listener was
+// closed, and returns the error. The connection callback receives a synthetic GET request with the
+// remote address. The admission limits apply, connections exceeding them are closed with status
+// 1013 (try again later), but origin and handshake checks are not applied. A panicking callback
+// closes its connection instead of crashing the server.
+//
+// Every frame starts with a header of one byte type and the length of the payload as 32 bit
+// unsigned integer in big-endian byte order, followed by the payload. The types are the opcodes
+// of WebSockets: 1 text, 2 binary, 8 close, 9 ping and 10 pong. Messages are packed by the
+// protocol of the router and send as text or binary frames according to its modes. The payload
+// of close frames is the status code as 16 bit big-endian integer followed by the reason and
+// pings have to be answered with pongs.
+func (router *Router) Serve(l net.Listener) error {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if temporaryAcceptError(err) {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		r := &http.Request{
+			Method:     "GET",
+			URL:        &url.URL{Scheme: l.Addr().Network(), Host: l.Addr().String()},
+			Host:       l.Addr().String(),
+			Header:     make(http.Header),
+			RemoteAddr: conn.RemoteAddr().String(),
+		}
+		t := NewNetTransport(conn)
+		ticket, ok := router.admitTransport(t, r)
+		if !ok {
+			continue
+		}
+		go func() {
+			defer ticket.release()
+			defer func() {
+				if err := recover(); err != nil {
+					log.Println("Panic serving "+r.RemoteAddr+":", err)
+					t.Close()
+				}
+			}()
+			router.ServeTransport(t, r)
+		}()
+	}
+}
+
+// Returns whether accepting should be retried after the error.
+func temporaryAcceptError(err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	for _, temporary := range temporaryAcceptErrors {
+		if errors.Is(err, temporary) {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes a frame with header.
+func (t *netTransport) writeFrame(frameType byte, payload []byte) error {
+	buf := make([]byte, netHeaderSize+len(payload))
+	buf[0] = frameType
+	binary.BigEndian.PutUint32(buf[1:netHeaderSize], uint32(len(payload)))
+	copy(buf[netHeaderSize:], payload)
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	_, err := t.conn.Write(buf)
+	return err
+}
+
+// ReadFrame returns the next text or binary frame, answering pings and reporting pongs meanwhile.
+func (t *netTransport) ReadFrame() (int, []byte, error) {
+	var header [netHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(t.reader, header[:]); err != nil {
+			return 0, nil, err
+		}
+		length := binary.BigEndian.Uint32(header[1:])
+		if t.readLimit > 0 && int64(length) > t.readLimit {
+			return 0, nil, ErrReadLimit
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(t.reader, payload); err != nil {
+			return 0, nil, err
+		}
+		switch header[0] {
+		case netTextFrame:
+			return TextMode, payload, nil
+		case netBinaryFrame:
+			return BinaryMode, payload, nil
+		case netPingFrame:
+			if err := t.writeFrame(netPongFrame, payload); err != nil {
+				return 0, nil, err
+			}
+		case netPongFrame:
+			if t.pongHandler != nil {
+				t.pongHandler()
+			}
+		case netCloseFrame:
+			ce := &CloseError{}
+			if len(payload) >= 2 {
+				ce.Code = int(binary.BigEndian.Uint16(payload))
+				ce.Text = string(payload[2:])
+			}
+			return 0, nil, ce
+		default:
+			return 0, nil, errUnknownFrameType
+		}
+	}
+}
+
+func (t *netTransport) WriteFrame(mode int, data []byte) error {
+	if mode == BinaryMode {
+		return t.writeFrame(netBinaryFrame, data)
+	}
+	return t.writeFrame(netTextFrame, data)
+}
+
+func (t *netTransport) WritePing() error {
+	return t.writeFrame(netPingFrame, nil)
+}
+
+func (t *netTransport) WriteClose(code int, reason string) error {
+	if code == 0 {
+		return t.writeFrame(netCloseFrame, nil)
+	}
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	return t.writeFrame(netCloseFrame, payload)
+}
+
+func (t *netTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *netTransport) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *netTransport) SetWriteDeadline(deadline time.Time) error {
+	return t.conn.SetWriteDeadline(deadline)
+}
+
+func (t *netTransport) SetReadLimit(limit int64) {
+	t.readLimit = limit
+}
+
+func (t *netTransport) SetPongHandler(h func()) {
+	t.pongHandler = h
+}
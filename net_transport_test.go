@@ -0,0 +1,178 @@
+/*
+Copyright 2013 Niklas Voss
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package golem
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Serves the router on a local TCP listener, which is closed after the test.
+func serveTest(t *testing.T, router *Router) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- router.Serve(l)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		if err := <-served; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("expected Serve to return after the listener was closed, returned %v", err)
+		}
+	})
+	return l
+}
+
+// Dials the listener and returns the transport of the client.
+func dialNet(t *testing.T, l net.Listener) Transport {
+	t.Helper()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewNetTransport(conn)
+}
+
+// Reads the next frame of the transport, failing the test if none arrives within a second.
+func readNet(t *testing.T, client Transport) (int, string) {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	mode, data, err := client.ReadFrame()
+	if err != nil {
+		t.Fatalf("reading failed: %v", err)
+	}
+	return mode, string(data)
+}
+
+func TestServe(t *testing.T) {
+	router := NewRouter()
+	router.On("echo", func(conn *Connection, data *testMessage) {
+		conn.Emit("echo", data)
+	})
+	router.On("bye", func(conn *Connection) {
+		conn.CloseWithReason(4000, "Bye")
+	})
+	client := dialNet(t, serveTest(t, router))
+
+	pong := make(chan bool, 1)
+	client.SetPongHandler(func() { pong <- true })
+	if err := client.WritePing(); err != nil {
+		t.Fatalf("writing ping failed: %v", err)
+	}
+	client.WriteFrame(TextMode, []byte(`echo {"text":"hello"}`))
+	if mode, answer := readNet(t, client); mode != TextMode || answer != `echo {"text":"hello"}` {
+		t.Fatalf("unexpected answer %d %q", mode, answer)
+	}
+	select {
+	case <-pong:
+	default:
+		t.Fatal("expected ping to be answered before the answer")
+	}
+	client.WriteFrame(TextMode, []byte(`bye null`))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := client.ReadFrame()
+	if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != 4000 || closeErr.Text != "Bye" {
+		t.Fatalf("expected close with code 4000, received %v", err)
+	}
+}
+
+func TestServeAdmission(t *testing.T) {
+	router := NewRouter()
+	router.SetAdmissionLimits(AdmissionLimits{MaxConnections: 1})
+	router.On("echo", func(conn *Connection, data *testMessage) {
+		conn.Emit("echo", data)
+	})
+	router.On("panic", func(conn *Connection) {
+		panic("callback failed")
+	})
+	l := serveTest(t, router)
+	first := dialNet(t, l)
+	first.WriteFrame(TextMode, []byte(`echo {"text":"first"}`))
+	readNet(t, first)
+
+	second := dialNet(t, l)
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := second.ReadFrame()
+	if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != netRejectedCode {
+		t.Fatalf("expected connection exceeding the limit to be closed with code 1013, received %v", err)
+	}
+
+	// A panicking callback closes its connection and releases it.
+	first.WriteFrame(TextMode, []byte(`panic null`))
+	first.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := first.ReadFrame(); err == nil {
+		t.Fatal("expected connection to be closed after panic")
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		third := dialNet(t, l)
+		third.WriteFrame(TextMode, []byte(`echo {"text":"third"}`))
+		third.SetReadDeadline(time.Now().Add(time.Second))
+		if _, data, err := third.ReadFrame(); err == nil {
+			if string(data) != `echo {"text":"third"}` {
+				t.Fatalf("unexpected answer %q", data)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected connection to be admitted after panic")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNetTransportFrames(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	server, client := NewNetTransport(a), NewNetTransport(b)
+	server.SetReadLimit(4)
+
+	// Writes block on pipes until the frame is read.
+	go func() {
+		client.WriteFrame(BinaryMode, []byte{1, 2})
+		client.WriteClose(1000, "ok")
+	}()
+	if mode, data, err := server.ReadFrame(); err != nil || mode != BinaryMode || string(data) != "\x01\x02" {
+		t.Fatalf("unexpected frame %d %v %v", mode, data, err)
+	}
+	_, _, err := server.ReadFrame()
+	if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != 1000 || closeErr.Text != "ok" {
+		t.Fatalf("expected close frame, received %v", err)
+	}
+
+	for _, frame := range [][]byte{
+		{3, 0, 0, 0, 0},      // Unknown type.
+		{1, 0, 0, 0, 5, 'a'}, // Exceeding the read limit.
+		{1, 0, 0, 0, 2, 'a'}, // Truncated payload.
+	} {
+		a, b := net.Pipe()
+		server := NewNetTransport(a)
+		server.SetReadLimit(4)
+		go func(frame []byte) {
+			b.Write(frame)
+			b.Close()
+		}(frame)
+		if _, _, err := server.ReadFrame(); err == nil {
+			t.Fatalf("expected error reading frame %v", frame)
+		}
+		a.Close()
+	}
+}
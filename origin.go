@@ -0,0 +1,148 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Returns the default port of the scheme, empty if unknown.
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "http", "ws":
+		return "80"
+	case "https", "wss":
+		return "443"
+	}
+	return ""
+}
+
+// Origin of a request split into its parts, the port is the default port of the scheme if
+// not specified.
+type origin struct {
+	scheme string
+	host   string
+	port   string
+}
+
+// Parses the value of an Origin header. Returns false if it is malformed.
+func parseOrigin(value string) (origin, bool) {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return origin{}, false
+	}
+	o := origin{
+		scheme: strings.ToLower(u.Scheme),
+		host:   strings.ToLower(u.Hostname()),
+		port:   u.Port(),
+	}
+	if o.port == "" {
+		o.port = defaultPort(o.scheme)
+	}
+	return o, true
+}
+
+// Returns the origin the request was sent to, according to its Host header and whether it was
+// received using TLS. Returns false if the host is malformed.
+func requestOrigin(r *http.Request) (origin, bool) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return parseOrigin(scheme + "://" + r.Host)
+}
+
+// Returns whether the origin matches the pattern. Patterns consist of an optional scheme, the
+// host, which may start with "*." to match all subdomains, and an optional port, which may be
+// "*" to match all ports. Without scheme any scheme matches, without port only the default
+// port of the scheme matches. The pattern "*" matches all origins.
+func (o origin) matches(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	pattern = strings.ToLower(pattern)
+	scheme := ""
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		scheme, pattern = pattern[:i], pattern[i+3:]
+		if scheme != o.scheme {
+			return false
+		}
+	}
+	host, port := pattern, ""
+	if h, p, err := net.SplitHostPort(pattern); err == nil {
+		host, port = h, p
+	}
+	switch port {
+	case "*":
+	case "":
+		if o.port != defaultPort(o.scheme) {
+			return false
+		}
+	default:
+		if port != o.port {
+			return false
+		}
+	}
+	if strings.HasPrefix(host, "*.") {
+		return strings.HasSuffix(o.host, host[1:])
+	}
+	return host == o.host
+}
+
+// SetCheckOrigin sets the function deciding whether the origin of a request is allowed, which
+// overrides the Origins of the router.
+func (router *Router) SetCheckOrigin(callback func(*http.Request) bool) {
+	router.checkOriginFunc = callback
+}
+
+// Checks the origin of the request. If the origin is not allowed, the reason is returned.
+func (router *Router) checkOrigin(r *http.Request) (string, bool) {
+	if router.checkOriginFunc != nil {
+		if !router.checkOriginFunc(r) {
+			return "rejected by CheckOrigin", false
+		}
+		return "", true
+	}
+	value := r.Header.Get("Origin")
+	if value == "" {
+		if len(router.Origins) > 0 {
+			return "missing Origin header", false
+		}
+		return "", true // Not a browser, so same-origin does not apply.
+	}
+	o, ok := parseOrigin(value)
+	if !ok {
+		return "malformed Origin header", false
+	}
+	if len(router.Origins) == 0 {
+		if same, ok := requestOrigin(r); !ok || o != same {
+			return "not the same origin as host " + r.Host, false
+		}
+		return "", true
+	}
+	for _, pattern := range router.Origins {
+		if o.matches(pattern) {
+			return "", true
+		}
+	}
+	return "not an allowed origin", false
+}
@@ -0,0 +1,115 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"crypto/tls"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSameOrigin(t *testing.T) {
+	router := NewRouter()
+	tests := []struct {
+		host, origin string
+		tls          bool
+		allowed      bool
+	}{
+		{"example.com", "", false, true},
+		{"example.com", "http://example.com", false, true},
+		{"example.com", "https://example.com", false, false},
+		{"example.com", "https://example.com", true, true},
+		{"example.com", "http://example.com", true, false},
+		{"example.com:8080", "http://example.com:8080", false, true},
+		{"example.com:80", "http://example.com", false, true},
+		{"example.com", "http://evil.com", false, false},
+		{"example.com", "nonsense", false, false},
+		{"[::1]", "http://[::1]", false, true},
+		{"[::1]:8080", "http://[::1]:8080", false, true},
+		{"[::1]:8080", "http://[::1]:8081", false, false},
+		{"EXAMPLE.com", "http://example.COM", false, true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = test.host
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		} else {
+			r.TLS = nil
+		}
+		if reason, allowed := router.checkOrigin(r); allowed != test.allowed {
+			t.Errorf("origin %s of host %s (TLS %v): expected allowed %v, received %v %q", test.origin, test.host, test.tls, test.allowed, allowed, reason)
+		}
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	router := NewRouter()
+	tests := []struct {
+		origins []string
+		origin  string
+		allowed bool
+	}{
+		{[]string{"https://*.example.com"}, "https://a.b.example.com", true},
+		{[]string{"https://*.example.com"}, "https://example.com", false},
+		{[]string{"https://*.example.com"}, "http://a.example.com", false},
+		{[]string{"https://example.com"}, "https://example.com:443", true},
+		{[]string{"https://example.com"}, "https://EXAMPLE.com:8443", false},
+		{[]string{"example.com:8443"}, "https://example.com:8443", true},
+		{[]string{"http://localhost:*"}, "http://localhost:3000", true},
+		{[]string{"example.com"}, "http://example.com", true},
+		{[]string{"example.com"}, "", false},
+		{[]string{"*"}, "http://x.y", true},
+	}
+	for _, test := range tests {
+		router.Origins = test.origins
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if reason, allowed := router.checkOrigin(r); allowed != test.allowed {
+			t.Errorf("origin %q with %v: expected allowed %v, received %v %q", test.origin, test.origins, test.allowed, allowed, reason)
+		}
+	}
+}
+
+func TestOriginRejectsHandshake(t *testing.T) {
+	router := NewRouter()
+	router.SetCheckOrigin(func(r *http.Request) bool {
+		return r.Header.Get("Origin") == "https://trusted.com"
+	})
+	server := httptest.NewServer(http.HandlerFunc(router.Handler()))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	socket, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://trusted.com"}})
+	if err != nil {
+		t.Fatalf("dialing from trusted origin failed: %v", err)
+	}
+	socket.Close()
+	if _, res, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.com"}}); err == nil || res.StatusCode != 403 {
+		t.Fatalf("expected origin to be rejected with status 403, received %v", err)
+	}
+}
@@ -64,6 +64,61 @@ type Protocol interface {
 	GetWriteMode() int
 }
 
+// ConnectionProtocol can optionally be implemented by protocols, that need to know the receiving
+// connection to pack outgoing data, e.g. to correlate messages with state kept per connection.
+// If the active protocol implements it, MarshalAndPackFor is used instead of MarshalAndPack.
+// Returning no frames drops the message, returning several frames writes each of them.
+type ConnectionProtocol interface {
+	Protocol
+	// Marshal and pack data for the specified connection into a list of frames.
+	// Takes connection, event name and type pointer as parameters.
+	MarshalAndPackFor(*Connection, string, interface{}) ([][]byte, error)
+}
+
+// Frame is a single WebSocket message together with its mode (TextMode or BinaryMode).
+type Frame struct {
+	Mode int
+	Data []byte
+}
+
+// MixedModeProtocol can optionally be implemented by protocols, that transmit text and binary
+// frames over the same connection or need several frames to complete a message. If the active
+// protocol implements it, frames of both modes are passed to UnpackFrame instead of Unpack and
+// MarshalAndPackFrames is used instead of MarshalAndPack.
+type MixedModeProtocol interface {
+	Protocol
+	// Unpacks a frame of the specified connection and mode. Returns the event name and interstage
+	// data like Unpack, the boolean return value is false if more frames are necessary to complete
+	// the message.
+	UnpackFrame(*Connection, int, []byte) (string, interface{}, bool, error)
+	// Marshal and pack data for the specified connection into a list of frames.
+	// Takes connection, event name and type pointer as parameters.
+	MarshalAndPackFrames(*Connection, string, interface{}) ([]Frame, error)
+}
+
+// StreamProtocol can optionally be implemented by protocols, that transmit chunks of streams
+// natively instead of marshalling them like other data, e.g. as raw binary payload. If the active
+// protocol implements it, outgoing chunks are packed and incoming chunks are unpacked using it.
+type StreamProtocol interface {
+	Protocol
+	// Returns the data emitted for a chunk of the stream with the specified ID.
+	PackChunk(uint64, []byte) interface{}
+	// Extracts stream ID and chunk from the interstage product of a chunk. The boolean return
+	// value is false if the data is no native chunk and should be unmarshalled instead.
+	UnpackChunk(interface{}) (uint64, []byte, bool)
+}
+
+// TraceProtocol can optionally be implemented by protocols, whose messages carry a W3C trace
+// context in their envelope. If the active protocol implements it, the envelope is removed from
+// incoming messages and, if tracing is enabled, their spans continue the trace context.
+type TraceProtocol interface {
+	Protocol
+	// Unwraps an incoming message. Takes event name and interstage product as parameters and
+	// returns them without the envelope together with the W3C traceparent, which is empty if
+	// the message carries none.
+	UnpackTrace(string, interface{}) (string, interface{}, string)
+}
+
 // SetDefaultProtocol sets the protocol that should be used by newly created routers. Therefore every router
 // created after changing the default protocol will use the new protocol by default.
 func SetDefaultProtocol(protocol Protocol) {
@@ -89,6 +144,28 @@ func (_ *DefaultJSONProtocol) Unmarshal(data interface{}, typePtr interface{}) e
 	return json.Unmarshal(data.([]byte), typePtr)
 }
 
+// Envelope of messages of the DefaultJSONProtocol carrying a trace context.
+type traceEnvelope struct {
+	TraceParent string          `json:"traceparent"`
+	Event       string          `json:"event"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// UnpackTrace unwraps messages of the "$trace" event, which carry the event name, the data and
+// the traceparent, e.g.:
+//
+//	$trace {"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "event": "chat", "data": {...}}
+func (_ *DefaultJSONProtocol) UnpackTrace(name string, data interface{}) (string, interface{}, string) {
+	if name != traceEvent {
+		return name, data, ""
+	}
+	var envelope traceEnvelope
+	if json.Unmarshal(data.([]byte), &envelope) != nil || envelope.Event == "" {
+		return name, data, ""
+	}
+	return envelope.Event, []byte(envelope.Data), envelope.TraceParent
+}
+
 // Marshals structure into JSON and packs event name in as well. If not successful second return value is an error.
 func (_ *DefaultJSONProtocol) MarshalAndPack(name string, structPtr interface{}) ([]byte, error) {
 	if data, err := json.Marshal(structPtr); err == nil {
@@ -0,0 +1,204 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+const (
+	// Event emitted to clients exceeding a limit with policy RateLimitWarn.
+	throttleEvent = "$throttle"
+	// Reason of the close frame of connections exceeding a limit with policy RateLimitClose.
+	rateLimitCloseReason = "Rate limit exceeded"
+	// Longest delay of a message with policy RateLimitDelay, reading including the handling of
+	// pongs stops meanwhile, so longer delays would risk the read deadline.
+	maxRateLimitDelay = time.Second
+)
+
+// RatePolicy decides what happens to messages exceeding a rate limit.
+type RatePolicy int
+
+const (
+	// RateLimitDrop discards the message.
+	RateLimitDrop RatePolicy = iota
+	// RateLimitDelay stops reading from the connection until the message is allowed. Pongs are
+	// not handled meanwhile either, so messages, that would be delayed longer than a second, are
+	// discarded instead.
+	RateLimitDelay
+	// RateLimitWarn discards the message and emits the event "$throttle" to the client, with
+	// the event name and the milliseconds until the next message is allowed as data:
+	//     {"event": "chat", "retryAfter": 250}
+	// The warning is only emitted once until a message is allowed again.
+	RateLimitWarn
+	// RateLimitClose closes the connection with status code 1008 (policy violation).
+	RateLimitClose
+)
+
+// RateLimit is a token bucket limit of incoming messages. The zero value disables the limit.
+type RateLimit struct {
+	// Messages per second allowed on average.
+	Rate float64
+	// Messages allowed in a burst, at least one.
+	Burst int
+	// Policy applied to messages exceeding the limit.
+	Policy RatePolicy
+}
+
+// RateLimits are the limits of incoming messages of a connection.
+type RateLimits struct {
+	// Limit of all messages of the connection.
+	Global RateLimit
+	// Limits of messages by event name, applied in addition to the global limit.
+	Events map[string]RateLimit
+}
+
+// Data of the throttle warning event.
+type throttleWarning struct {
+	Event      string `json:"event"`
+	RetryAfter int64  `json:"retryAfter"`
+}
+
+// Token bucket of a limit.
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+	// Set once a warning was emitted, until a message is allowed again.
+	warned bool
+}
+
+// Creates a full bucket, returns nil if the limit is disabled.
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: time.Now()}
+}
+
+// Refills the bucket and returns the time until a token is available.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if max := float64(b.limit.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// Rate limiter of a connection, only used by its reading routine.
+type rateLimiter struct {
+	global *tokenBucket
+	events map[string]*tokenBucket
+}
+
+// Creates the rate limiter of the connection from the limits.
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	l := &rateLimiter{
+		global: newTokenBucket(limits.Global),
+		events: make(map[string]*tokenBucket, len(limits.Events)),
+	}
+	for event, limit := range limits.Events {
+		if b := newTokenBucket(limit); b != nil {
+			l.events[event] = b
+		}
+	}
+	return l
+}
+
+// SetRateLimits sets the limits of incoming messages of each connection. By default
+// messages are not limited. Limits apply to all messages including golem's internal
+// events, e.g. data of streams.
+func (router *Router) SetRateLimits(limits RateLimits) {
+	router.rateLimits = limits
+	router.useRateLimits = true
+}
+
+// SetRateLimitFunc sets the function returning the limits of incoming messages of a connection,
+// which overrides the limits set using SetRateLimits, e.g. to vary limits by authenticated user.
+// It is called once before the first message of the connection is handled, therefore after the
+// connection callback.
+func (router *Router) SetRateLimitFunc(callback func(*Connection) RateLimits) {
+	router.rateLimitFunc = callback
+	router.useRateLimits = true
+}
+
+// Applies the rate limits of the connection to a message of the event. Returns false if the
+// message should be discarded, messages with policy RateLimitDelay are delayed instead unless
+// the delay exceeds maxRateLimitDelay.
+func (router *Router) allow(conn *Connection, event string) bool {
+	if !router.useRateLimits {
+		return true
+	}
+	if conn.limiter == nil {
+		limits := router.rateLimits
+		if router.rateLimitFunc != nil {
+			limits = router.rateLimitFunc(conn)
+		}
+		conn.limiter = newRateLimiter(limits)
+	}
+	buckets := [2]*tokenBucket{conn.limiter.events[event], conn.limiter.global}
+	for {
+		now := time.Now()
+		var exceeded *tokenBucket
+		var wait time.Duration
+		for _, b := range buckets {
+			if b == nil {
+				continue
+			}
+			if d := b.wait(now); d > wait {
+				exceeded, wait = b, d
+			}
+		}
+		if exceeded == nil { // Allowed by all limits, so take the tokens.
+			for _, b := range buckets {
+				if b != nil {
+					b.tokens--
+					b.warned = false
+				}
+			}
+			return true
+		}
+		switch exceeded.limit.Policy {
+		case RateLimitDelay:
+			if wait <= maxRateLimitDelay {
+				time.Sleep(wait)
+				continue
+			}
+		case RateLimitWarn:
+			if !exceeded.warned {
+				exceeded.warned = true
+				conn.trySend(&message{
+					event: throttleEvent,
+					data:  &throttleWarning{Event: event, RetryAfter: int64((wait + time.Millisecond - 1) / time.Millisecond)},
+				})
+			}
+		case RateLimitClose:
+			conn.CloseWithReason(websocket.ClosePolicyViolation, rateLimitCloseReason)
+		}
+		return false
+	}
+}
@@ -0,0 +1,159 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if b := newTokenBucket(RateLimit{}); b != nil {
+		t.Fatal("expected zero limit to be disabled")
+	}
+	if b := newTokenBucket(RateLimit{Rate: 1}); b.limit.Burst != 1 || b.tokens != 1 {
+		t.Fatalf("expected burst of at least one, bucket %+v", b)
+	}
+
+	b := newTokenBucket(RateLimit{Rate: 10, Burst: 2})
+	now := b.last
+	for i := 0; i < 2; i++ {
+		if d := b.wait(now); d != 0 {
+			t.Fatalf("expected burst to be allowed, waiting %v", d)
+		}
+		b.tokens--
+	}
+	if d := b.wait(now); d != 100*time.Millisecond {
+		t.Fatalf("expected to wait for a token for 100ms, waiting %v", d)
+	}
+	if d := b.wait(now.Add(50 * time.Millisecond)); d != 50*time.Millisecond {
+		t.Fatalf("expected half a token to be refilled after 50ms, waiting %v", d)
+	}
+	if d := b.wait(now.Add(time.Minute)); d != 0 || b.tokens != 2 {
+		t.Fatalf("expected refill to be capped at the burst, waiting %v with %v tokens", d, b.tokens)
+	}
+}
+
+// Returns a router echoing "echo" and answering "ping" with "pong" using the limits.
+func limitedRouter(limits RateLimits) *Router {
+	router := NewRouter()
+	router.On("echo", func(conn *Connection, data *testMessage) {
+		conn.Emit("echo", data)
+	})
+	router.On("ping", func(conn *Connection) {
+		conn.Emit("pong", nil)
+	})
+	router.SetRateLimits(limits)
+	return router
+}
+
+// Writes the messages to the client.
+func writeMemory(client *MemoryTransport, messages ...string) {
+	for _, message := range messages {
+		client.WriteFrame(TextMode, []byte(message))
+	}
+}
+
+func TestRateLimitEvent(t *testing.T) {
+	client := connectMemory(t, limitedRouter(RateLimits{
+		Events: map[string]RateLimit{"echo": {Rate: 0.001, Burst: 1}},
+	}))
+	writeMemory(client, `echo {"text":"a"}`, `echo {"text":"b"}`, `ping null`)
+	if data := readMemory(t, client); data != `echo {"text":"a"}` {
+		t.Fatalf("expected message within the limit, read %q", data)
+	}
+	if data := readMemory(t, client); data != `pong null` {
+		t.Fatalf("expected message exceeding the limit to be dropped and other events to be allowed, read %q", data)
+	}
+}
+
+func TestRateLimitGlobal(t *testing.T) {
+	client := connectMemory(t, limitedRouter(RateLimits{
+		Global: RateLimit{Rate: 0.001, Burst: 2, Policy: RateLimitWarn},
+	}))
+	writeMemory(client, `echo {"text":"a"}`, `ping null`, `echo {"text":"b"}`, `ping null`, `echo {"text":"c"}`)
+	for _, expected := range []string{`echo {"text":"a"}`, `pong null`} {
+		if data := readMemory(t, client); data != expected {
+			t.Fatalf("expected %q within the limit, read %q", expected, data)
+		}
+	}
+	data := readMemory(t, client)
+	if !strings.HasPrefix(data, `$throttle {"event":"echo","retryAfter":`) {
+		t.Fatalf("expected warning once the limit of all events is exceeded, read %q", data)
+	}
+}
+
+func TestRateLimitClose(t *testing.T) {
+	client := connectMemory(t, limitedRouter(RateLimits{
+		Events: map[string]RateLimit{"echo": {Rate: 0.001, Burst: 1, Policy: RateLimitClose}},
+	}))
+	writeMemory(client, `echo {"text":"a"}`, `echo {"text":"b"}`)
+	readMemory(t, client)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := client.ReadFrame()
+	if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != 1008 || closeErr.Text != rateLimitCloseReason {
+		t.Fatalf("expected close frame once the limit is exceeded, read %v", err)
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	client := connectMemory(t, limitedRouter(RateLimits{
+		Events: map[string]RateLimit{
+			"echo": {Rate: 20, Burst: 1, Policy: RateLimitDelay},
+			"ping": {Rate: 0.001, Burst: 1, Policy: RateLimitDelay},
+		},
+	}))
+	start := time.Now()
+	writeMemory(client, `echo {"text":"a"}`, `echo {"text":"b"}`)
+	readMemory(t, client)
+	if data := readMemory(t, client); data != `echo {"text":"b"}` {
+		t.Fatalf("expected message to be delayed, read %q", data)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("expected message to be delayed for about 50ms, delayed %v", d)
+	}
+
+	writeMemory(client, `ping null`, `ping null`, `echo {"text":"c"}`)
+	for _, expected := range []string{`pong null`, `echo {"text":"c"}`} {
+		if data := readMemory(t, client); data != expected {
+			t.Fatalf("expected delays longer than a second to be dropped, read %q instead of %q", data, expected)
+		}
+	}
+}
+
+func TestRateLimitFunc(t *testing.T) {
+	router := limitedRouter(RateLimits{Events: map[string]RateLimit{"ping": {Rate: 0.001, Burst: 1}}})
+	called := make(chan *Connection, 2)
+	router.SetRateLimitFunc(func(conn *Connection) RateLimits {
+		called <- conn
+		return RateLimits{Events: map[string]RateLimit{"echo": {Rate: 0.001, Burst: 1}}}
+	})
+	client := connectMemory(t, router)
+	writeMemory(client, `echo {"text":"a"}`, `echo {"text":"b"}`, `ping null`, `ping null`)
+	readMemory(t, client)
+	for i := 0; i < 2; i++ {
+		if data := readMemory(t, client); data != `pong null` {
+			t.Fatalf("expected limits of the function to override the limits of the router, read %q", data)
+		}
+	}
+	if len(called) != 1 {
+		t.Fatalf("expected function to be called once per connection, called %d times", len(called))
+	}
+}
@@ -0,0 +1,206 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"time"
+)
+
+const (
+	// Default events requiring and carrying a new token.
+	defaultReauthEvent  = "$reauth"
+	defaultRefreshEvent = "$refresh"
+	// Default time before expiry the reauth event is emitted.
+	defaultReauthAhead = time.Minute
+	// Reason of the close frame of connections, whose token expired.
+	reauthCloseReason = "Token expired"
+)
+
+var (
+	// ErrRefreshDisabled is reported if a token is refreshed without an Authenticator of Reauth.
+	ErrRefreshDisabled = errors.New("Tokens can not be refreshed.")
+	// ErrNoExpiry is reported if a refreshed token has no "exp" claim.
+	ErrNoExpiry = errors.New("Token without expiry.")
+	// ErrSubjectMismatch is reported if a refreshed token has another subject than the current one.
+	ErrSubjectMismatch = errors.New("Token of another subject.")
+)
+
+// RefreshError is reported to the error callback if the client emitted a token, that could not
+// replace the current one of the connection.
+type RefreshError struct {
+	// Refresh event emitted by the client.
+	Event string
+	// Reason of the failure, e.g. ErrTokenExpired or ErrSubjectMismatch.
+	Err error
+}
+
+// Error describes the reason of the failure.
+func (e *RefreshError) Error() string {
+	return "Token refresh failed: " + e.Err.Error()
+}
+
+// Unwrap returns the reason of the failure.
+func (e *RefreshError) Unwrap() error {
+	return e.Err
+}
+
+// Reauth configures the enforcement of the "exp" claim of connections. Ahead of expiry the
+// client is asked to emit a new token, otherwise the connection is closed with status code
+// 1008 (policy violation) once the token expired.
+type Reauth struct {
+	// Authenticator verifying new tokens. If nil, tokens can not be refreshed.
+	Authenticator *Authenticator
+	// Time before expiry the reauth event is emitted, by default one minute.
+	Ahead time.Duration
+	// Event emitted to the client ahead of expiry, by default "$reauth", with the milliseconds
+	// until the token expires as data:
+	//     {"expiresIn": 60000}
+	RequiredEvent string
+	// Event the client emits with a new token, by default "$refresh":
+	//     {"token": "..."}
+	// The token needs to be valid, expire and have the same subject as the current one,
+	// otherwise it is rejected and a RefreshError is reported to the error callback.
+	RefreshEvent string
+}
+
+// Data of the reauth event.
+type reauthRequired struct {
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+// Data of the refresh event.
+type reauthRefresh struct {
+	Token string `json:"token"`
+}
+
+// SetReauth enables the enforcement of token expiry on connections with claims containing
+// "exp", e.g. set by the Handshake method of an Authenticator. It should be called before
+// connections are established.
+func (router *Router) SetReauth(reauth Reauth) {
+	if reauth.Ahead <= 0 {
+		reauth.Ahead = defaultReauthAhead
+	}
+	if reauth.RequiredEvent == "" {
+		reauth.RequiredEvent = defaultReauthEvent
+	}
+	if reauth.RefreshEvent == "" {
+		reauth.RefreshEvent = defaultRefreshEvent
+	}
+	if router.reauth == nil {
+		router.connectHooks = append(router.connectHooks, func(conn *Connection, r *http.Request) {
+			router.watchExpiry(conn)
+		})
+		router.closeHooks = append(router.closeHooks, router.stopExpiry)
+	} else {
+		delete(router.callbacks, router.reauth.RefreshEvent)
+	}
+	router.reauth = &reauth
+	router.callbacks[reauth.RefreshEvent] = router.handleRefresh
+}
+
+// Schedules the reauth event and the close of the connection according to its claims,
+// replacing previously scheduled ones.
+func (router *Router) watchExpiry(conn *Connection) {
+	reauth := router.reauth
+	conn.claimsLock.Lock()
+	defer conn.claimsLock.Unlock()
+	if conn.expiry != nil {
+		conn.expiry.Stop()
+		conn.expiry = nil
+	}
+	exp := conn.claims.ExpiresAt()
+	if exp.IsZero() {
+		return
+	}
+	conn.expiryGeneration++
+	generation := conn.expiryGeneration
+	conn.expiry = time.AfterFunc(time.Until(exp.Add(-reauth.Ahead)), func() {
+		conn.claimsLock.Lock()
+		current := conn.expiryGeneration == generation // Otherwise refreshed meanwhile.
+		if current {
+			conn.expiry = time.AfterFunc(time.Until(exp), func() {
+				conn.claimsLock.Lock()
+				expired := conn.expiryGeneration == generation
+				conn.claimsLock.Unlock()
+				if expired {
+					conn.CloseWithReason(websocket.ClosePolicyViolation, reauthCloseReason)
+				}
+			})
+		}
+		conn.claimsLock.Unlock()
+		if current {
+			// Blocks while the outgoing buffer is full, so the event is not dropped.
+			conn.queue(&message{
+				event: reauth.RequiredEvent,
+				data:  &reauthRequired{ExpiresIn: int64(time.Until(exp) / time.Millisecond)},
+			})
+		}
+	})
+}
+
+// Stops the scheduled reauth event and close of the connection.
+func (router *Router) stopExpiry(conn *Connection) {
+	conn.claimsLock.Lock()
+	if conn.expiry != nil {
+		conn.expiry.Stop()
+		conn.expiry = nil
+	}
+	conn.expiryGeneration++
+	conn.claimsLock.Unlock()
+}
+
+// Verifies the token of the refresh event and replaces the claims of the connection. Reports
+// a RefreshError if the token was rejected.
+func (router *Router) handleRefresh(conn *Connection, data interface{}) {
+	reauth := router.reauth
+	claims, err := router.refreshedClaims(conn, data)
+	if err != nil {
+		router.reportError(conn, &RefreshError{Event: reauth.RefreshEvent, Err: err})
+		return
+	}
+	conn.claimsLock.Lock()
+	conn.claims = claims
+	conn.claimsLock.Unlock()
+	router.watchExpiry(conn)
+}
+
+// Returns the verified claims of the token of the refresh event.
+func (router *Router) refreshedClaims(conn *Connection, data interface{}) (Claims, error) {
+	if router.reauth.Authenticator == nil {
+		return nil, ErrRefreshDisabled
+	}
+	var refresh reauthRefresh
+	if router.protocol.Unmarshal(data, &refresh) != nil || refresh.Token == "" {
+		return nil, ErrNoToken
+	}
+	claims, err := router.reauth.Authenticator.Verify(refresh.Token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ExpiresAt().IsZero() { // Would never expire otherwise.
+		return nil, ErrNoExpiry
+	}
+	if claims.Subject() != conn.Claims().Subject() {
+		return nil, ErrSubjectMismatch
+	}
+	return claims, nil
+}
@@ -0,0 +1,91 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReauth(t *testing.T) {
+	a := NewJWTAuthenticator(JWTKeys{HMAC: testSecret})
+	router := NewRouter()
+	router.OnHandshake(a.Handshake)
+	router.SetReauth(Reauth{Authenticator: a, Ahead: 1900 * time.Millisecond})
+	errs := make(chan error, 4)
+	router.OnError(func(conn *Connection, err error) {
+		errs <- err
+	})
+	server := httptest.NewServer(http.HandlerFunc(router.Handler()))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?access_token="
+	token := testJWT("HS256", map[string]interface{}{"sub": "alice", "exp": time.Now().Unix() + 2}, signHS256)
+	refreshed, _, err := websocket.DefaultDialer.Dial(url+token, nil)
+	if err != nil {
+		t.Fatalf("dialing failed: %v", err)
+	}
+	defer refreshed.Close()
+	expired, _, err := websocket.DefaultDialer.Dial(url+token, nil)
+	if err != nil {
+		t.Fatalf("dialing failed: %v", err)
+	}
+	defer expired.Close()
+
+	refreshed.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, msg, err := refreshed.ReadMessage(); err != nil || !strings.HasPrefix(string(msg), "$reauth ") {
+		t.Fatalf("expected reauth event, received %q %v", msg, err)
+	}
+	refresh := func(socket *websocket.Conn, claims map[string]interface{}) {
+		socket.WriteMessage(websocket.TextMessage, []byte(`$refresh {"token":"`+testJWT("HS256", claims, signHS256)+`"}`))
+	}
+	for _, rejected := range []struct {
+		claims   map[string]interface{}
+		expected error
+	}{
+		{map[string]interface{}{"sub": "mallory", "exp": time.Now().Unix() + 3600}, ErrSubjectMismatch},
+		{map[string]interface{}{"sub": "alice"}, ErrNoExpiry},
+	} {
+		refresh(expired, rejected.claims)
+		err := <-errs
+		if refreshErr, ok := err.(*RefreshError); !ok || !errors.Is(err, rejected.expected) || refreshErr.Event != "$refresh" {
+			t.Fatalf("expected refresh error %v, received %v", rejected.expected, err)
+		}
+	}
+	refresh(refreshed, map[string]interface{}{"sub": "alice", "exp": time.Now().Unix() + 3600})
+
+	expired.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := expired.ReadMessage(); err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != websocket.ClosePolicyViolation {
+				t.Fatalf("expected close with policy violation, received %v", err)
+			}
+			break
+		}
+	}
+	// The refreshed connection outlives the expiry of its first token.
+	refreshed.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, msg, err := refreshed.ReadMessage(); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected refreshed connection to stay open, received %q %v", msg, err)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+const (
+	// Events of streaming responses. Next, done and error are send to the client,
+	// cancel is send by the client. All carry the ID of the request.
+	replyNextEvent   = "$reply:next"
+	replyDoneEvent   = "$reply:done"
+	replyErrorEvent  = "$reply:error"
+	replyCancelEvent = "$reply:cancel"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	senderType  = reflect.TypeOf(Sender[interface{}](nil))
+	uint64Type  = reflect.TypeOf(uint64(0))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Sender sends the results of type T of a streaming response, see Router.OnStream. It is a
+// function, so senders of any result type can be created for callbacks, which use its Send method.
+type Sender[T any] func(data interface{}) error
+
+// Send emits data as next result of the request. It blocks while the outgoing buffer
+// of the connection is full and fails once the request was canceled.
+func (s Sender[T]) Send(data T) error {
+	return s(data)
+}
+
+// Returns true if the type is an instance of Sender.
+func isSenderType(t reflect.Type) bool {
+	return t.Kind() == reflect.Func && t.PkgPath() == senderType.PkgPath() &&
+		strings.HasPrefix(t.Name(), "Sender[") && senderType.ConvertibleTo(t)
+}
+
+// Request of a streaming response, only the ID is unmarshalled into it. The data is
+// unmarshalled together with the ID into a structure with the type of the handler.
+type replyRequest struct {
+	ID uint64 `json:"id"`
+}
+
+// Result or terminal message of a streaming response.
+type replyMessage struct {
+	ID    uint64      `json:"id"`
+	Data  interface{} `json:"data,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// Sender of a single request.
+type replySender struct {
+	conn *Connection
+	id   uint64
+	ctx  context.Context
+}
+
+// Send emits the data as next result unless the request was canceled.
+func (s *replySender) Send(data interface{}) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	if !s.conn.queue(&message{event: replyNextEvent, data: &replyMessage{ID: s.id, Data: data}}) {
+		return ErrStreamCanceled
+	}
+	return nil
+}
+
+// OnStream adds a handler with results of type R to the router like Router.OnStream, but the
+// type of the callback is checked at compile time.
+func OnStream[T, R any](router *Router, name string, callback func(context.Context, *Connection, *T, Sender[R]) error, policies ...Policy) error {
+	return router.OnStream(name, callback, policies...)
+}
+
+// OnStream adds a handler responding with a stream of results instead of a single reply.
+// For request type T and result type R the callback would be of type:
+//
+//	func (context.Context, *golem.Connection, *T, golem.Sender[R]) error
+//
+// For example:
+//
+//	router.OnStream("search", func(ctx context.Context, conn *golem.Connection, q *Query, out golem.Sender[Result]) error {
+//		return out.Send(Result{})
+//	})
+//
+// If a connection extension is registered, the extended type can be used instead of *Connection.
+// The request is unmarshalled using the protocol of the router and its data validated, see Validator.
+// Invalid requests are answered with "$reply:error".
+// The client emits the event with the data {"id": <request ID>, "data": <T>}. Each call of Send
+// emits a "$reply:next" event with the request ID and the result as data, after the handler returned
+// "$reply:done" or "$reply:error" is emitted. The client can cancel the request by emitting "$reply:cancel"
+// with the request ID, which cancels the context, as does closing the connection. The context carries
+// the span of the request if tracing is enabled, see Connection.Context. The handler runs in its own
+// goroutine. Optional policies authorize connections to emit the event as for On.
+func (router *Router) OnStream(name string, callback interface{}, policies ...Policy) error {
+	callbackValue := reflect.ValueOf(callback)
+	callbackType := callbackValue.Type()
+	if callbackType.Kind() != reflect.Func || callbackType.NumIn() != 4 || callbackType.NumOut() != 1 ||
+		callbackType.In(0) != contextType || callbackType.In(2).Kind() != reflect.Ptr ||
+		!isSenderType(callbackType.In(3)) || callbackType.Out(0) != errorType {
+		return errors.New("OnStream cannot accept a callback of the type " + callbackType.String() + ".")
+	}
+	useExtension := false
+	if callbackType.In(1) != reflect.TypeOf((*Connection)(nil)) {
+		if !router.connExtensionConstructor.IsValid() || callbackType.In(1) != router.connExtensionConstructor.Type().Out(0) {
+			return errors.New("OnStream cannot accept a callback of the type " + callbackType.String() + ".")
+		}
+		useExtension = true
+	}
+	router.setPolicies(name, policies)
+	callbackDataElem := callbackType.In(2).Elem()
+	if callbackDataElem.Kind() == reflect.Struct {
+		validationOf(callbackDataElem) // Panics early if struct tags are malformed.
+	}
+	// Request with the data typed as taken by the callback, unmarshalled using the protocol.
+	requestType := reflect.StructOf([]reflect.StructField{
+		{Name: "ID", Type: uint64Type, Tag: `json:"id"`},
+		{Name: "Data", Type: callbackType.In(2), Tag: `json:"data"`},
+	})
+
+	router.callbacks[name] = func(conn *Connection, data interface{}) {
+		req := &replyRequest{}
+		if err := router.protocol.Unmarshal(data, req); err != nil {
+			return // TODO: Proper debug output!
+		}
+		typed := reflect.New(requestType)
+		if err := router.protocol.Unmarshal(data, typed.Interface()); err != nil {
+			conn.trySend(&message{event: replyErrorEvent, data: &replyMessage{ID: req.ID, Error: err.Error()}})
+			return
+		}
+		result := typed.Elem().Field(1)
+		if result.IsNil() { // Request without data.
+			result = reflect.New(callbackDataElem)
+		}
+		if !router.validate(conn, name, result) {
+			conn.trySend(&message{event: replyErrorEvent, data: &replyMessage{ID: req.ID, Error: "Invalid data."}})
+			return
+		}
+
+		// Canceled by the client, after the handler returned or once the connection is closed.
+		ctx, cancel := context.WithCancel(conn.Context())
+		conn.streams.lock.Lock()
+		_, exists := conn.streams.replies[req.ID]
+		if !exists {
+			conn.streams.replies[req.ID] = cancel
+		}
+		conn.streams.lock.Unlock()
+		if exists {
+			cancel()
+			conn.trySend(&message{event: replyErrorEvent, data: &replyMessage{ID: req.ID, Error: "Request ID already in use."}})
+			return
+		}
+
+		go func() {
+			defer cancel()
+			first := reflect.ValueOf(conn)
+			if useExtension {
+				first = reflect.ValueOf(conn.extension)
+			}
+			sender := &replySender{conn: conn, id: req.ID, ctx: ctx}
+			out := callbackValue.Call([]reflect.Value{reflect.ValueOf(ctx), first, result,
+				reflect.ValueOf(sender.Send).Convert(callbackType.In(3))})
+
+			conn.streams.lock.Lock()
+			_, active := conn.streams.replies[req.ID]
+			delete(conn.streams.replies, req.ID)
+			conn.streams.lock.Unlock()
+			if !active || ctx.Err() != nil { // Canceled by client or closed connection.
+				return
+			}
+			if err, _ := out[0].Interface().(error); err != nil {
+				conn.queue(&message{event: replyErrorEvent, data: &replyMessage{ID: req.ID, Error: err.Error()}})
+			} else {
+				conn.queue(&message{event: replyDoneEvent, data: &replyMessage{ID: req.ID}})
+			}
+		}()
+	}
+	return nil
+}
+
+// Cancels the context of a streaming response on request of the client.
+func (router *Router) handleReplyCancel(conn *Connection, data interface{}) {
+	end := &streamEnd{}
+	if router.protocol.Unmarshal(data, end) != nil {
+		return
+	}
+	conn.streams.lock.Lock()
+	cancel, ok := conn.streams.replies[end.ID]
+	delete(conn.streams.replies, end.ID)
+	conn.streams.lock.Unlock()
+	if ok {
+		cancel()
+	}
+}
@@ -0,0 +1,217 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testQuery struct {
+	Query string `json:"query" validate:"max=5"`
+}
+
+type testResult struct {
+	N int `json:"n"`
+}
+
+func TestOnStreamReplies(t *testing.T) {
+	router := NewRouter()
+	err := OnStream(router, "count", func(ctx context.Context, conn *Connection, q *testQuery, out Sender[testResult]) error {
+		if q.Query == "fail" {
+			return errors.New("Failed.")
+		}
+		for i := 0; i < 3; i++ {
+			if err := out.Send(testResult{i}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("registering stream failed: %v", err)
+	}
+	socket := dialTest(t, router.Handler(), "/")
+
+	writeTest(t, socket, `count {"id":1,"data":{"query":"abc"}}`)
+	for _, expected := range []string{
+		`$reply:next {"id":1,"data":{"n":0}}`,
+		`$reply:next {"id":1,"data":{"n":1}}`,
+		`$reply:next {"id":1,"data":{"n":2}}`,
+		`$reply:done {"id":1}`,
+	} {
+		if msg := readTest(t, socket); msg != expected {
+			t.Fatalf("expected %q, received %q", expected, msg)
+		}
+	}
+	writeTest(t, socket, `count {"id":2,"data":{"query":"fail"}}`)
+	if msg := readTest(t, socket); msg != `$reply:error {"id":2,"error":"Failed."}` {
+		t.Fatalf("expected error, received %q", msg)
+	}
+}
+
+func TestOnStreamInvalidRequests(t *testing.T) {
+	router := NewRouter()
+	OnStream(router, "count", func(ctx context.Context, conn *Connection, q *testQuery, out Sender[testResult]) error {
+		<-ctx.Done()
+		return nil
+	})
+	socket := dialTest(t, router.Handler(), "/")
+
+	writeTest(t, socket, `count {"id":1,"data":{"query":5}}`)
+	if msg := readTest(t, socket); !strings.HasPrefix(msg, `$reply:error {"id":1,"error":`) {
+		t.Fatalf("expected decoding error, received %q", msg)
+	}
+	writeTest(t, socket, `count {"id":2,"data":{"query":"toolong"}}`)
+	if msg := readTest(t, socket); msg != `$reply:error {"id":2,"error":"Invalid data."}` {
+		t.Fatalf("expected validation error, received %q", msg)
+	}
+	writeTest(t, socket, `count {"id":3,"data":{"query":"a"}}`)
+	writeTest(t, socket, `count {"id":3,"data":{"query":"b"}}`)
+	if msg := readTest(t, socket); msg != `$reply:error {"id":3,"error":"Request ID already in use."}` {
+		t.Fatalf("expected error of duplicate ID, received %q", msg)
+	}
+}
+
+func TestOnStreamCancel(t *testing.T) {
+	router := NewRouter()
+	started := make(chan bool, 1)
+	canceled := make(chan error, 1)
+	OnStream(router, "watch", func(ctx context.Context, conn *Connection, q *testQuery, out Sender[testResult]) error {
+		started <- true
+		<-ctx.Done()
+		canceled <- out.Send(testResult{})
+		return nil
+	})
+	socket := dialTest(t, router.Handler(), "/")
+
+	writeTest(t, socket, `watch {"id":1}`)
+	<-started
+	writeTest(t, socket, `$reply:cancel {"id":1}`)
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Fatalf("expected Send to fail after cancel, received %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("context not canceled")
+	}
+	socket.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, msg, err := socket.ReadMessage(); err == nil {
+		t.Fatalf("expected no reply after cancel, received %q", msg)
+	}
+}
+
+func TestOnStreamPolicies(t *testing.T) {
+	router := NewRouter()
+	errs := make(chan error, 1)
+	router.OnError(func(conn *Connection, err error) {
+		errs <- err
+	})
+	OnStream(router, "secret", func(ctx context.Context, conn *Connection, q *testQuery, out Sender[testResult]) error {
+		return nil
+	}, denyAll)
+	socket := dialTest(t, router.Handler(), "/")
+
+	writeTest(t, socket, `secret {"id":1}`)
+	select {
+	case err := <-errs:
+		if authErr, ok := err.(*AuthorizationError); !ok || authErr.Event != "secret" {
+			t.Fatalf("expected authorization error, received %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("denied request not reported")
+	}
+}
+
+func TestOnStreamRejectsCallback(t *testing.T) {
+	router := NewRouter()
+	for _, callback := range []interface{}{
+		func() {},
+		func(ctx context.Context, conn *Connection, q testQuery, out Sender[interface{}]) error { return nil },
+		func(ctx context.Context, conn *Connection, q *testQuery, out chan interface{}) error { return nil },
+	} {
+		if err := router.OnStream("invalid", callback); err == nil {
+			t.Fatalf("expected callback of type %T to be rejected", callback)
+		}
+	}
+}
+
+func TestRouterOnStreamTyped(t *testing.T) {
+	router := NewRouter()
+	err := router.OnStream("count", func(ctx context.Context, conn *Connection, q *testQuery, out Sender[testResult]) error {
+		return out.Send(testResult{7})
+	})
+	if err != nil {
+		t.Fatalf("registering stream failed: %v", err)
+	}
+	socket := dialTest(t, router.Handler(), "/")
+
+	writeTest(t, socket, `count {"id":1}`)
+	if msg := readTest(t, socket); msg != `$reply:next {"id":1,"data":{"n":7}}` {
+		t.Fatalf("unexpected result %q", msg)
+	}
+	if msg := readTest(t, socket); msg != `$reply:done {"id":1}` {
+		t.Fatalf("expected done, received %q", msg)
+	}
+}
+
+func TestOnStreamConnectionClosed(t *testing.T) {
+	router := NewRouter()
+	started := make(chan bool, 1)
+	canceled := make(chan bool, 1)
+	OnStream(router, "watch", func(ctx context.Context, conn *Connection, q *testQuery, out Sender[testResult]) error {
+		started <- true
+		<-ctx.Done()
+		canceled <- true
+		return nil
+	})
+	socket := dialTest(t, router.Handler(), "/")
+
+	writeTest(t, socket, `watch {"id":1}`)
+	<-started
+	socket.Close()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("context not canceled after the connection was closed")
+	}
+}
+
+func TestOnStreamTrace(t *testing.T) {
+	router, exporter := tracedRouter()
+	spans := make(chan trace.SpanContext, 1)
+	OnStream(router, "watch", func(ctx context.Context, conn *Connection, q *testQuery, out Sender[testResult]) error {
+		spans <- trace.SpanContextFromContext(ctx)
+		<-ctx.Done()
+		return nil
+	})
+	client := connectMemory(t, router)
+
+	client.WriteFrame(TextMode, []byte(`$trace {"traceparent":"`+testTraceParent+`","event":"watch","data":{"id":1}}`))
+	span := <-spans
+	recorded := waitSpans(t, exporter, 1)
+	if span.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || span.SpanID() != recorded[0].SpanContext.SpanID() {
+		t.Fatalf("expected context to carry the span of the request, received %v", span)
+	}
+}
@@ -66,10 +66,15 @@ func (r *Room) run() {
 			}
 		// Send
 		case message := <-r.send:
+			if message.barrier != nil {
+				close(message.barrier)
+				continue
+			}
 			for conn := range r.members { // For every connection try to send
 				select {
 				case conn.send <- message:
 				default: // If sending failed, delete member
+					conn.router.metrics.evicted()
 					delete(r.members, conn)
 				}
 			}
@@ -95,10 +100,19 @@ func (r *Room) Leave(conn *Connection) {
 	r.leave <- conn
 }
 
+// Sync blocks until all messages emitted before were queued for the members of the room,
+// e.g. to wait deterministically in tests.
+func (r *Room) Sync() {
+	barrier := make(chan struct{})
+	r.send <- &message{barrier: barrier}
+	<-barrier
+}
+
 // Emits message event to all members of the room.
 func (r *Room) Emit(event string, data interface{}) {
 	r.send <- &message{
-		event: event,
-		data:  data,
+		event:  event,
+		data:   data,
+		shared: true,
 	}
 }
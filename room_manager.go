@@ -18,6 +18,10 @@
 
 package golem
 
+import (
+	"sync"
+)
+
 const (
 	roomManagerCreateEvent        = "create"
 	roomManagerRemoveEvent        = "remove"
@@ -40,6 +44,14 @@ type roomMsg struct {
 	msg *message
 }
 
+// Snapshot of the rooms of a manager and the rooms joined by each connection.
+type roomManagerSnapshot struct {
+	// Member count of rooms by name.
+	rooms map[string]uint
+	// Names of the joined rooms by connection.
+	members map[*Connection][]string
+}
+
 // Wrapper for normal lobbies to add a member counter.
 type managedRoom struct {
 	// Reference to room.
@@ -89,11 +101,19 @@ type RoomManager struct {
 	options chan *connectionInfoReq
 	// Channel of messages associated with this room manager
 	send chan *roomMsg
+	// Channel of snapshot requests
+	snapshot chan chan *roomManagerSnapshot
 	// Stop signal channel
 	stop chan bool
 	// Room creation and removal callbacks
 	callbackRoomCreation func(string)
 	callbackRoomRemoval  func(string)
+	// Policies of rooms by name or prefix pattern, guarded by policyLock.
+	policies   map[string][]Policy
+	policyLock sync.RWMutex
+	// Total member count of all rooms and metrics reporting it, nil if disabled.
+	memberCount int
+	metrics     *managerMetrics
 }
 
 // NewRoomManager initialises a new instance and returns the a pointer to it.
@@ -108,6 +128,8 @@ func NewRoomManager() *RoomManager {
 		destroy:              make(chan string),
 		options:              make(chan *connectionInfoReq),
 		send:                 make(chan *roomMsg, roomSendChannelSize),
+		snapshot:             make(chan chan *roomManagerSnapshot),
+		policies:             make(map[string][]Policy),
 		stop:                 make(chan bool),
 		callbackRoomCreation: func(string) {},
 		callbackRoomRemoval:  func(string) {},
@@ -126,6 +148,7 @@ func (rm *RoomManager) leaveRoomByName(name string, conn *Connection) {
 			if _, ok := c.rooms[name]; ok { // Continue if connection actually joined specified room.
 				m.room.leave <- conn
 				m.count--
+				rm.memberCount--
 				delete(c.rooms, name)
 				if len(c.rooms) == 0 && (c.options&CloseConnectionOnLastRoomLeft) == CloseConnectionOnLastRoomLeft {
 					delete(rm.members, conn)
@@ -160,15 +183,18 @@ func (rm *RoomManager) run() {
 				m.count++
 			}
 			m.room.join <- req.conn
+			rm.memberCount++
 			c, ok := rm.members[req.conn]
 			if !ok { // If room association map for connection does not exist, create it!
 				c = newConnectionInfo()
 				rm.members[req.conn] = c
 			}
 			c.rooms[req.name] = true // Flag this room on members room map.
+			rm.metrics.update(len(rm.rooms), rm.memberCount)
 		// Leave
 		case req := <-rm.leave:
 			rm.leaveRoomByName(req.name, req.conn)
+			rm.metrics.update(len(rm.rooms), rm.memberCount)
 		// Leave all
 		case conn := <-rm.leaveAll:
 			if c, ok := rm.members[conn]; ok {
@@ -177,14 +203,17 @@ func (rm *RoomManager) run() {
 				}
 				delete(rm.members, conn) // Remove map of joined lobbies
 			}
+			rm.metrics.update(len(rm.rooms), rm.memberCount)
 		case name := <-rm.destroy:
-			if m, ok := rm.rooms[name]; ok {
+			if _, ok := rm.rooms[name]; ok {
 				// This should result inthe room being stopped/destroyed when the last
-				// connection is dropped
-				for conn := range m.room.members {
+				// connection is dropped. The members are taken from the manager,
+				// because the members of the room are owned by its loop.
+				for conn := range rm.members {
 					rm.leaveRoomByName(name, conn)
 				}
 			}
+			rm.metrics.update(len(rm.rooms), rm.memberCount)
 		case req := <-rm.options:
 			c, ok := rm.members[req.conn]
 			if !ok { // If room association map for connection does not exist, create it!
@@ -196,8 +225,30 @@ func (rm *RoomManager) run() {
 			} else {
 				c.options = req.options | c.options
 			}
+		// Snapshot
+		case reply := <-rm.snapshot:
+			snapshot := &roomManagerSnapshot{
+				rooms:   make(map[string]uint, len(rm.rooms)),
+				members: make(map[*Connection][]string, len(rm.members)),
+			}
+			for name, m := range rm.rooms {
+				snapshot.rooms[name] = m.count
+			}
+			for conn, c := range rm.members {
+				for name := range c.rooms {
+					snapshot.members[conn] = append(snapshot.members[conn], name)
+				}
+			}
+			reply <- snapshot
 		// Send
 		case rMsg := <-rm.send:
+			if rMsg.msg.barrier != nil { // Sync all rooms before releasing the barrier.
+				for _, m := range rm.rooms {
+					m.room.Sync()
+				}
+				close(rMsg.msg.barrier)
+				continue
+			}
 			if m, ok := rm.rooms[rMsg.to]; ok { // If room exists, get it and send data to it.
 				m.room.send <- rMsg.msg
 			}
@@ -207,6 +258,7 @@ func (rm *RoomManager) run() {
 				m.room.Stop()
 				delete(rm.rooms, k)
 			}
+			rm.metrics.update(0, 0)
 			return
 		}
 	}
@@ -220,12 +272,23 @@ func (rm *RoomManager) SetConnectionOptions(conn *Connection, options uint32, ov
 	}
 }
 
-// Join adds the connection to the specified room.
+// Join adds the connection to the specified room, if it satisfies the policies of the room
+// set using SetRoomPolicy. Denied attempts are reported to the error callback of the router.
 func (rm *RoomManager) Join(name string, conn *Connection) {
+	rm.TryJoin(name, conn)
+}
+
+// TryJoin adds the connection to the specified room like Join, but returns false if the
+// connection was denied to join by the policies of the room.
+func (rm *RoomManager) TryJoin(name string, conn *Connection) bool {
+	if !rm.authorize(name, conn) {
+		return false
+	}
 	rm.join <- &roomReq{
 		name: name,
 		conn: conn,
 	}
+	return true
 }
 
 // Leave removes the connection from the specified room.
@@ -249,12 +312,34 @@ func (rm *RoomManager) Emit(to string, event string, data interface{}) {
 	rm.send <- &roomMsg{
 		to: to,
 		msg: &message{
-			event: event,
-			data:  data,
+			event:  event,
+			data:   data,
+			shared: true,
 		},
 	}
 }
 
+// Sync blocks until all requests and messages send to the manager before were processed and
+// the messages were queued for the members of the rooms, e.g. to wait deterministically in tests.
+func (rm *RoomManager) Sync() {
+	barrier := make(chan struct{})
+	rm.send <- &roomMsg{msg: &message{barrier: barrier}}
+	<-barrier
+}
+
+// Returns a snapshot of the rooms and their members.
+func (rm *RoomManager) takeSnapshot() *roomManagerSnapshot {
+	reply := make(chan *roomManagerSnapshot, 1)
+	rm.snapshot <- reply
+	return <-reply
+}
+
+// SetMetrics enables reporting the number of rooms and members of the manager to the metrics,
+// labelled with the provided name. It should be called before the manager is used.
+func (rm *RoomManager) SetMetrics(metrics *Metrics, name string) {
+	rm.metrics = &managerMetrics{metrics: metrics, name: name}
+}
+
 // Stop the message loop and shutsdown the manager. It is safe to delete the instance afterwards.
 func (rm *RoomManager) Stop() {
 	rm.stop <- true
@@ -19,13 +19,29 @@
 package golem
 
 import (
+	"compress/flate"
 	"errors"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+	"io"
 	"log"
 	"net/http"
 	"reflect"
+	"strconv"
+	"sync"
+	"time"
 )
 
+var (
+	// Type of callback data receiving raw bytes.
+	rawType = reflect.TypeOf([]byte(nil))
+	// Type of callback data receiving streams.
+	readerType = reflect.TypeOf((*io.Reader)(nil)).Elem()
+)
+
+// Signature of functions dispatching unpacked messages by event name.
+type dispatchFunc func(*Connection, string, interface{})
+
 // Router handles multiplexing of incoming messenges by typenames/events.
 // Initially a router uses heartbeats and the default protocol.
 type Router struct {
@@ -44,11 +60,62 @@ type Router struct {
 	protocol Protocol
 	// Flag to enable or disable heartbeats
 	useHeartbeats bool
+	// Maximum size of incoming messages.
+	maxMessageSize int64
+	// Flow control window of incoming streams.
+	streamWindow int64
+	// Flag to enable negotiation of permessage-deflate.
+	useCompression bool
+	// Compression level and minimum size of compressed messages.
+	compressionLevel   int
+	compressionMinSize int
+	// Events, whose data is never compressed.
+	uncompressedEvents map[string]bool
 	//
 	connExtensionConstructor reflect.Value
-	// If set, the values the Origin header will be checked against and access is only allowed
-	// on a match; otherwise no Origin checking is performed. *This overrides the
-	// Access-Control-Allow-Origin header!*
+	// Internal hooks of golem's adapters, called before the user provided
+	// connection and close functions.
+	connectHooks []func(*Connection, *http.Request)
+	closeHooks   []func(*Connection)
+	// Internal middleware wrapping the dispatch of unpacked messages, the
+	// first middleware is the outermost.
+	middleware []func(dispatchFunc) dispatchFunc
+	// Metrics of the router, nil if disabled.
+	metrics *routerMetrics
+	// Tracer of the router, nil if disabled.
+	tracer trace.Tracer
+	// Authorization policies of events, the error callback and event reporting denied
+	// attempts and other errors of connections.
+	policies   map[string][]Policy
+	errorFunc  func(*Connection, error)
+	errorEvent string
+	// Payload types of callbacks by event name.
+	payloadTypes map[string]string
+	// Events, whose callbacks take io.Reader and handle streams opened by clients.
+	streamEvents map[string]bool
+	// Active connections by ID, room managers and authorization of the admin handler.
+	connections  map[uint64]*Connection
+	roomManagers map[string]*RoomManager
+	adminFunc    func(http.ResponseWriter, *http.Request) bool
+	// Guards connections and roomManagers.
+	adminLock sync.Mutex
+	// Limits of incoming messages, only applied if useRateLimits is set.
+	rateLimits    RateLimits
+	rateLimitFunc func(*Connection) RateLimits
+	useRateLimits bool
+	// Enforcement of token expiry of connections, nil if disabled.
+	reauth *Reauth
+	// Admission limits of connections, nil if disabled.
+	admission *admission
+	// Function deciding whether the origin of a request is allowed, overriding Origins.
+	checkOriginFunc func(*http.Request) bool
+	// If set, the patterns the Origin header will be checked against and access is only allowed
+	// on a match, e.g. "https://example.com", "https://*.example.com" or "http://localhost:*".
+	// Without scheme any scheme matches, without port only the default port of the scheme.
+	// Otherwise only same-origin requests and requests without Origin header are allowed. Their
+	// scheme, host and port need to match the request, which is https if it was received using
+	// TLS, so routers behind proxies terminating TLS need to set Origins.
+	// Rejected origins are logged with the reason.
 	Origins []string
 }
 
@@ -56,8 +123,7 @@ type Router struct {
 func NewRouter() *Router {
 	// Tries to run hub, if already running nothing will happen.
 	hub.run()
-	// Returns pointer to instance.
-	return &Router{
+	router := &Router{
 		callbacks:                make(map[string]func(*Connection, interface{})),
 		extensions:               make(map[reflect.Type]reflect.Value),
 		closeFunc:                func(*Connection) {}, // Empty placeholder close function.
@@ -65,81 +131,152 @@ func NewRouter() *Router {
 		handshakeFunc:            func(http.ResponseWriter, *http.Request) bool { return true }, // Handshake always allowed.
 		protocol:                 initialProtocol,
 		useHeartbeats:            true,
+		maxMessageSize:           maxMessageSize,
+		streamWindow:             streamWindowSize,
+		uncompressedEvents:       make(map[string]bool),
+		payloadTypes:             make(map[string]string),
+		streamEvents:             make(map[string]bool),
+		policies:                 make(map[string][]Policy),
+		errorFunc:                func(*Connection, error) {},
+		connections:              make(map[uint64]*Connection),
+		roomManagers:             make(map[string]*RoomManager),
+		adminFunc:                func(http.ResponseWriter, *http.Request) bool { return false }, // Admin access denied.
 		connExtensionConstructor: defaultConnectionExtension,
 		Origins:                  make([]string, 0),
 	}
+	// Register internal events of streams and streaming responses.
+	router.callbacks[streamOpenEvent] = router.handleStreamOpen
+	router.callbacks[streamDataEvent] = router.handleStreamData
+	router.callbacks[streamAckEvent] = router.handleStreamAck
+	router.callbacks[streamCloseEvent] = router.handleStreamClose
+	router.callbacks[streamCancelEvent] = router.handleStreamCancel
+	router.callbacks[replyCancelEvent] = router.handleReplyCancel
+	// Returns pointer to instance.
+	return router
+}
+
+// Data of the error event.
+type errorData struct {
+	Error string `json:"error"`
+	Event string `json:"event,omitempty"`
+	Room  string `json:"room,omitempty"`
+	// Fields, that failed validation.
+	Fields []FieldError `json:"fields,omitempty"`
 }
 
 // Handler creates a handler function for this router, that can be used with the
 // http-package to handle WebSocket-Connections.
 func (router *Router) Handler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Check if method used was GET.
-		if r.Method != "GET" {
-			http.Error(w, "Method not allowed", 405)
-			return
+		r, span := router.traceHandshake(withHandshakeState(r))
+		socket, ticket := router.upgrade(w, r)
+		span.End()
+		if socket != nil {
+			defer ticket.release()
+			router.ServeTransport(NewWebSocketTransport(socket), r)
 		}
+	}
+}
 
-		// Disallow cross-origin connections.
-		if len(router.Origins) > 0 {
-			originFound := false
-			for _, origin := range router.Origins {
-				if r.Header.Get("Origin") == origin {
-					originFound = true
-					break
-				}
-			}
-			if !originFound {
-				http.Error(w, "Origin not allowed", 403)
-				return
-			}
-		} else {
-			if len(r.Header.Get("Access-Control-Allow-Origin")) > 0 {
-				allowedOrigin := r.Header.Get("Access-Control-Allow-Origin")
-				if allowedOrigin != "*" {
-					if r.URL.Scheme+"://"+r.Host != allowedOrigin {
-						http.Error(w, "Origin not allwed", 403)
-						return
-					}
-				}
-			}
-		}
+// Checks the request and upgrades the websocket connection. Returns nil if the connection
+// was not accepted, the response was already written in that case. Otherwise the admission
+// ticket needs to be released once the connection is closed.
+func (router *Router) upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, *admissionTicket) {
+	// Check if method used was GET.
+	if r.Method != "GET" {
+		router.rejected(r, "method")
+		http.Error(w, "Method not allowed", 405)
+		return nil, nil
+	}
 
-		// Check if handshake callback verifies upgrade.
-		if !router.handshakeFunc(w, r) {
-			http.Error(w, "Authorization failed", 403)
-			return
-		}
+	// Check admission limits, origin and handshake callback.
+	ticket, ok := router.accept(w, r)
+	if !ok {
+		return nil, nil
+	}
 
-		// Upgrade websocket connection.
-		protocols := websocket.Subprotocols(r)
-		var responseHeader http.Header = nil
-		if len(protocols) > 0 {
-			responseHeader = http.Header{"Sec-Websocket-Protocol": {protocols[0]}}
+	// Upgrade websocket connection.
+	// Select the first subprotocol, that does not carry the token, see TokenFromProtocol.
+	var responseHeader http.Header = nil
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol != handshakeTokenProtocol(r) {
+			responseHeader = http.Header{"Sec-Websocket-Protocol": {protocol}}
+			break
 		}
-		socket, err := websocket.Upgrade(w, r, responseHeader, 1024, 1024)
-		// Check if handshake was successful
-		if _, ok := err.(websocket.HandshakeError); ok {
-			http.Error(w, "Not a websocket handshake", 400)
-			return
-		} else if err != nil {
+	}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: router.useCompression,
+		// Origin was already checked.
+		CheckOrigin: func(*http.Request) bool { return true },
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			http.Error(w, "Not a websocket handshake", status)
+		},
+	}
+	socket, err := upgrader.Upgrade(w, r, responseHeader)
+	// Check if handshake was successful, the upgrader already responded otherwise.
+	if err != nil {
+		ticket.reject()
+		router.rejected(r, "upgrade")
+		if _, ok := err.(websocket.HandshakeError); !ok {
 			log.Println(err)
-			return
 		}
+		return nil, nil
+	}
+	return socket, ticket
+}
 
-		// Create the connection.
-		conn := newConnection(socket, router)
-		//
-		if router.connExtensionConstructor.IsValid() {
-			conn.extend(router.connExtensionConstructor.Call([]reflect.Value{reflect.ValueOf(conn)})[0].Interface())
-		}
+// Checks the admission limits and the origin of the request and calls the handshake callback.
+// Responds with an error and returns false if the connection is not accepted. Otherwise the
+// admission ticket needs to be released once the connection is closed.
+func (router *Router) accept(w http.ResponseWriter, r *http.Request) (*admissionTicket, bool) {
+	ticket, ok := router.admit(w, r)
+	if !ok {
+		return nil, false
+	}
 
-		// Connection established with possible extension, so callback
-		router.connectionFunc(conn, r)
+	// Disallow connections of origins not allowed.
+	if reason, ok := router.checkOrigin(r); !ok {
+		log.Println("Origin " + strconv.Quote(r.Header.Get("Origin")) + " rejected: " + reason + ".")
+		router.rejected(r, "origin")
+		http.Error(w, "Origin not allowed", 403)
+		ticket.reject()
+		return nil, false
+	}
 
-		// And start reading and writing routines.
-		conn.run()
+	// Check if handshake callback verifies upgrade.
+	if !router.handshakeFunc(w, r) {
+		router.rejected(r, "handshake")
+		http.Error(w, "Authorization failed", 403)
+		ticket.reject()
+		return nil, false
 	}
+	return ticket, true
+}
+
+// ServeTransport serves a connection using the provided transport instead of a websocket
+// connection upgraded by the Handler, e.g. alternative WebSocket implementations, fallbacks
+// or in-memory transports in tests. The request is passed to the connection callback and may
+// be a synthetic one. ServeTransport blocks until the connection is closed.
+func (router *Router) ServeTransport(t Transport, r *http.Request) {
+	// Create the connection.
+	conn := newConnection(t, router)
+	if r != nil {
+		conn.remoteAddr = r.RemoteAddr
+		conn.handshake = trace.SpanContextFromContext(r.Context())
+		conn.claims = handshakeClaims(r)
+	}
+	//
+	if router.connExtensionConstructor.IsValid() {
+		conn.extend(router.connExtensionConstructor.Call([]reflect.Value{reflect.ValueOf(conn)})[0].Interface())
+	}
+
+	// Connection established with possible extension, so callback
+	router.connected(conn, r)
+
+	// And start reading and writing routines.
+	conn.run()
 }
 
 // The On-function adds callbacks by name of the event, that should be handled.
@@ -149,11 +286,23 @@ func (router *Router) Handler() func(http.ResponseWriter, *http.Request) {
 // specified type. If a custom protocol is used, it will be used instead to process the data.
 // If type T is registered to use a protocol extension, it will be used instead.
 // If type T is interface{} the interstage data of the active protocol will be directly forwarded!
+// Callbacks taking []byte instead of *T receive the raw interstage bytes, e.g. the JSON data
+// of the default protocol or the payload of the binary frame protocol.
+// Callbacks taking io.Reader instead of *T handle streams opened by the client with the name
+// of the event, see OpenStream. They run in their own goroutine. The maximum message size needs
+// to be raised for streams, see SetStreamWindow.
+// The data of callbacks taking *T is validated according to the struct tags of T and its
+// Validate method, invalid data is reported to the error callback and discarded, see Validator.
+// Optional policies authorize connections to emit the event, e.g. RequireRoles("moderator"),
+// messages of unauthorized connections are reported to the error callback and discarded.
 // (Note: the golem wiki has a whole page about this function)
-func (router *Router) On(name string, callback interface{}) {
+func (router *Router) On(name string, callback interface{}, policies ...Policy) {
+	router.setPolicies(name, policies)
+	delete(router.streamEvents, name)
 
 	callbackValue := reflect.ValueOf(callback)
 	callbackType := reflect.TypeOf(callback)
+	router.payloadTypes[name] = payloadType(callbackType)
 	if router.connExtensionConstructor.IsValid() {
 		extType := router.connExtensionConstructor.Type().Out(0)
 		if callbackType.In(0) == extType {
@@ -188,17 +337,45 @@ func (router *Router) On(name string, callback interface{}) {
 				return
 			}
 
+			// STREAM
+			if callbackType.In(1) == readerType {
+				router.streamEvents[name] = true
+				router.callbacks[name] = func(conn *Connection, data interface{}) {
+					if r, ok := data.(*streamReader); ok {
+						args := []reflect.Value{reflect.ValueOf(conn.extension), reflect.ValueOf(r)}
+						callbackValue.Call(args)
+					}
+				}
+				return
+			}
+
+			// RAW
+			if callbackType.In(1) == rawType {
+				router.callbacks[name] = func(conn *Connection, data interface{}) {
+					if raw, ok := router.raw(data); ok {
+						args := []reflect.Value{reflect.ValueOf(conn.extension), reflect.ValueOf(raw)}
+						callbackValue.Call(args)
+					}
+				}
+				return
+			}
+
 			// PROTOCOL
 			callbackDataElem := callbackType.In(1).Elem()
+			if callbackDataElem.Kind() == reflect.Struct {
+				validationOf(callbackDataElem) // Panics early if struct tags are malformed.
+			}
 			router.callbacks[name] = func(conn *Connection, data interface{}) {
 				result := reflect.New(callbackDataElem)
 
 				err := router.protocol.Unmarshal(data, result.Interface())
 				if err == nil {
-					args := []reflect.Value{reflect.ValueOf(conn.extension), result}
-					callbackValue.Call(args)
+					if router.validate(conn, name, result) {
+						args := []reflect.Value{reflect.ValueOf(conn.extension), result}
+						callbackValue.Call(args)
+					}
 				} else {
-					// TODO: Proper debug output!
+					router.metrics.unmarshalFailed(name)
 				}
 			}
 			return
@@ -231,32 +408,159 @@ func (router *Router) On(name string, callback interface{}) {
 			return
 		}
 
+		// STREAM
+		if cb, ok := callback.(func(*Connection, io.Reader)); ok {
+			router.streamEvents[name] = true
+			router.callbacks[name] = func(conn *Connection, data interface{}) {
+				if r, ok := data.(*streamReader); ok {
+					cb(conn, r)
+				}
+			}
+			return
+		}
+
+		// RAW
+		if cb, ok := callback.(func(*Connection, []byte)); ok {
+			router.callbacks[name] = func(conn *Connection, data interface{}) {
+				if raw, ok := router.raw(data); ok {
+					cb(conn, raw)
+				}
+			}
+			return
+		}
+
 		// PROTOCOL
 		callbackDataElem := callbackType.In(1).Elem()
+		if callbackDataElem.Kind() == reflect.Struct {
+			validationOf(callbackDataElem) // Panics early if struct tags are malformed.
+		}
 		router.callbacks[name] = func(conn *Connection, data interface{}) {
 			result := reflect.New(callbackDataElem)
 
 			err := router.protocol.Unmarshal(data, result.Interface())
 			if err == nil {
-				args := []reflect.Value{reflect.ValueOf(conn), result}
-				callbackValue.Call(args)
+				if router.validate(conn, name, result) {
+					args := []reflect.Value{reflect.ValueOf(conn), result}
+					callbackValue.Call(args)
+				}
 			} else {
-				// TODO: Proper debug output!
+				router.metrics.unmarshalFailed(name)
 			}
 		}
 		return
 	}
 }
 
+// Returns the raw bytes of interstage data for callbacks taking []byte. Interstage data,
+// that is a byte slice, is forwarded directly, otherwise the protocol is used to unmarshal
+// into a byte slice.
+func (router *Router) raw(data interface{}) ([]byte, bool) {
+	if raw, ok := data.([]byte); ok {
+		return raw, true
+	}
+	var raw []byte
+	if err := router.protocol.Unmarshal(data, &raw); err != nil {
+		return nil, false
+	}
+	return raw, true
+}
+
 // Unpacks incoming data and forwards it to callback.
 func (router *Router) processMessage(conn *Connection, in []byte) {
 	if name, data, err := router.protocol.Unpack(in); err == nil {
-		if callback, ok := router.callbacks[name]; ok {
+		router.receive(conn, name, len(in), data)
+	} else {
+		router.metrics.unmarshalFailed(unknownEventLabel)
+	}
+
+	defer recover()
+}
+
+// Unpacks incoming frame using a mixed mode protocol and forwards it to callback,
+// as soon as the protocol completed a message.
+func (router *Router) processFrame(conn *Connection, p MixedModeProtocol, mode int, in []byte) {
+	conn.receivedBytes += len(in)
+	if name, data, ok, err := p.UnpackFrame(conn, mode, in); err == nil && ok {
+		size := conn.receivedBytes
+		conn.receivedBytes = 0
+		router.receive(conn, name, size, data)
+	} else if err != nil {
+		router.metrics.unmarshalFailed(unknownEventLabel)
+		conn.receivedBytes = 0
+	}
+}
+
+// Removes the envelope of an unpacked message of the specified size, see TraceProtocol, and
+// dispatches it unless it exceeds the rate limits.
+func (router *Router) receive(conn *Connection, name string, size int, data interface{}) {
+	traceParent := ""
+	if p, ok := router.protocol.(TraceProtocol); ok {
+		name, data, traceParent = p.UnpackTrace(name, data)
+	}
+	router.metrics.received(router.eventLabel(name), size)
+	if !router.allow(conn, name) {
+		return
+	}
+	router.traceHandle(conn, name, traceParent, size, data)
+}
+
+// Returns the event label of metrics and spans, events without callback share one label. It is
+// used for sent messages as well, because the adapters emit events named by client topics.
+func (router *Router) eventLabel(name string) string {
+	if _, ok := router.callbacks[name]; ok {
+		return name
+	}
+	return unknownEventLabel
+}
+
+// Passes unpacked data through the middleware and dispatches it.
+func (router *Router) handle(conn *Connection, name string, data interface{}) {
+	dispatch := router.dispatch
+	for i := len(router.middleware) - 1; i >= 0; i-- {
+		dispatch = router.middleware[i](dispatch)
+	}
+	dispatch(conn, name, data)
+}
+
+// Forwards unpacked data to the callback of the event.
+func (router *Router) dispatch(conn *Connection, name string, data interface{}) {
+	if callback, ok := router.callbacks[name]; ok {
+		if !router.authorize(conn, name) {
+			return
+		}
+		if router.metrics == nil {
 			callback(conn, data)
+			return
 		}
-	} // TODO: else error logging?
+		start := time.Now()
+		callback(conn, data)
+		router.metrics.handled(name, time.Since(start))
+	}
+}
 
-	defer recover()
+// Calls the internal connect hooks and the connection function.
+func (router *Router) connected(conn *Connection, r *http.Request) {
+	router.metrics.connected()
+	router.adminLock.Lock()
+	router.connections[conn.id] = conn
+	router.adminLock.Unlock()
+	for _, hook := range router.connectHooks {
+		hook(conn, r)
+	}
+	router.connectionFunc(conn, r)
+}
+
+// Cancels streams, calls the internal close hooks and the close function.
+func (router *Router) closed(conn *Connection) {
+	conn.streams.cancelAll()
+	for _, hook := range router.closeHooks {
+		hook(conn)
+	}
+	router.closeFunc(conn)
+	router.adminLock.Lock()
+	delete(router.connections, conn.id)
+	router.adminLock.Unlock()
+	router.metrics.closed()
 }
 
 // OnClose sets the callback, that is called when the connection is closed.
@@ -312,10 +616,49 @@ func (router *Router) OnConnect(callback interface{}) error { //func(*Connection
 // OnHandshake sets the callback for handshake verfication.
 // If the handshake function returns false the request will not be upgraded.
 // The http.Request object will be passed into OnConnect as well.
+// Claims stored using SetHandshakeClaims, e.g. by the Handshake method of an Authenticator,
+// are available using Claims of the connection.
 func (router *Router) OnHandshake(callback func(http.ResponseWriter, *http.Request) bool) {
 	router.handshakeFunc = callback
 }
 
+// OnError sets the callback, that is called with errors caused by messages of connections,
+// e.g. an *AuthorizationError if a connection was denied to emit an event or to join a room,
+// a *ValidationError if the data of an event is invalid, a *RefreshError if a token was rejected
+// or a *MarshalError if a message emitted to the connection could not be packed. The latter is
+// reported by the goroutine writing to the connection.
+func (router *Router) OnError(callback func(*Connection, error)) {
+	router.errorFunc = callback
+}
+
+// SetErrorEvent sets the event emitted to connections, whose messages caused an error, with
+// the error message and its context as data:
+//     {"error": "Not authorized to emit event kick.", "event": "kick"}
+// By default no event is emitted.
+func (router *Router) SetErrorEvent(name string) {
+	router.errorEvent = name
+}
+
+// Calls the error callback and emits the error event if enabled.
+func (router *Router) reportError(conn *Connection, err error) {
+	router.errorFunc(conn, err)
+	if router.errorEvent == "" {
+		return
+	}
+	data := &errorData{Error: err.Error()}
+	switch e := err.(type) {
+	case *AuthorizationError:
+		data.Event, data.Room = e.Event, e.Room
+	case *ValidationError:
+		data.Event, data.Fields = e.Event, e.Fields
+	case *RefreshError:
+		data.Event = e.Event
+	case *MarshalError:
+		data.Event = e.Event
+	}
+	conn.trySend(&message{event: router.errorEvent, data: data})
+}
+
 // The AddProtocolExtension-function allows adding of custom parsers for custom types. For any Type T
 // the parser function would look like this:
 //      func (interface{}) (T, bool)
@@ -359,6 +702,17 @@ func (router *Router) SetConnectionExtension(constructor interface{}) {
 	router.connExtensionConstructor = reflect.ValueOf(constructor)
 }
 
+// GetProtocol returns the protocol the router is using.
+func (router *Router) GetProtocol() Protocol {
+	return router.protocol
+}
+
+// SetMetrics enables collection of metrics of the router, which are labelled with the
+// provided name. It should be called before the router serves connections.
+func (router *Router) SetMetrics(metrics *Metrics, name string) {
+	router.metrics = &routerMetrics{metrics: metrics, name: name}
+}
+
 // SetProtocol sets the protocol of the router to the supplied implementation of the Protocol interface.
 func (router *Router) SetProtocol(protocol Protocol) {
 	router.protocol = protocol
@@ -366,6 +720,56 @@ func (router *Router) SetProtocol(protocol Protocol) {
 
 //
 
+// SetMaxMessageSize sets the maximum size of messages read from clients, connections sending
+// larger messages are closed. By default the limit is 512 bytes.
+func (router *Router) SetMaxMessageSize(size int64) {
+	router.maxMessageSize = size
+}
+
+// SetStreamWindow sets the flow control window of incoming streams, which is the amount of bytes
+// a client may send before the handler has read them. Clients need to use the same window.
+// Each chunk of a stream is a single message, so the maximum message size (see SetMaxMessageSize)
+// needs to exceed the encoded chunks clients send, e.g. chunks of 16 KiB, the chunk size used by
+// the server, need a limit of about 22 KiB if base64 encoded by the JSON protocol. The default
+// limit of 512 bytes is too small for streams.
+func (router *Router) SetStreamWindow(size int64) {
+	router.streamWindow = size
+}
+
+// EnableCompression enables negotiation of permessage-deflate with the provided compression
+// level (see compress/flate). Messages smaller than minSize bytes are send uncompressed, because
+// compressing them is not worth the effort. Messages emitted to rooms or broadcasted are compressed
+// only once for all connections. By default compression is disabled.
+func (router *Router) EnableCompression(level int, minSize int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return errors.New("Invalid compression level " + strconv.Itoa(level) + ".")
+	}
+	router.useCompression = true
+	router.compressionLevel = level
+	router.compressionMinSize = minSize
+	return nil
+}
+
+// DisableCompression disables negotiation of permessage-deflate for new connections.
+func (router *Router) DisableCompression() {
+	router.useCompression = false
+}
+
+// SetEventCompression sets whether data of the event may be compressed, e.g. to opt out
+// for events carrying data, that is already compressed. By default all events may be compressed.
+func (router *Router) SetEventCompression(event string, flag bool) {
+	if flag {
+		delete(router.uncompressedEvents, event)
+	} else {
+		router.uncompressedEvents[event] = true
+	}
+}
+
+// Returns whether data of the event with the specified size should be compressed.
+func (router *Router) compress(event string, size int) bool {
+	return router.useCompression && size >= router.compressionMinSize && !router.uncompressedEvents[event]
+}
+
 // SetHeartbeat activates or deactivates the heartbeat depending on the flag parameter. By default heartbeats are activated.
 func (router *Router) SetHeartbeat(flag bool) {
 	router.useHeartbeats = flag
@@ -0,0 +1,261 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"compress/flate"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testMessage struct {
+	Text string `json:"text"`
+}
+
+// Starts a server for the handler and returns a dialed WebSocket connection to path.
+func dialTest(t *testing.T, handler func(http.ResponseWriter, *http.Request), path string) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(server.Close)
+	socket, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, nil)
+	if err != nil {
+		t.Fatalf("dialing failed: %v", err)
+	}
+	t.Cleanup(func() { socket.Close() })
+	return socket
+}
+
+// Writes a text message or fails the test.
+func writeTest(t *testing.T, socket *websocket.Conn, data string) {
+	t.Helper()
+	if err := socket.WriteMessage(websocket.TextMessage, []byte(data)); err != nil {
+		t.Fatalf("writing failed: %v", err)
+	}
+}
+
+// Reads the next message, failing the test if none arrives within a second.
+func readTest(t *testing.T, socket *websocket.Conn) string {
+	t.Helper()
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := socket.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading failed: %v", err)
+	}
+	return string(data)
+}
+
+func TestRouterEcho(t *testing.T) {
+	router := NewRouter()
+	router.On("echo", func(conn *Connection, data *testMessage) {
+		conn.Emit("echo", data)
+	})
+	socket := dialTest(t, router.Handler(), "/")
+	writeTest(t, socket, `echo {"text":"hello"}`)
+	if answer := readTest(t, socket); answer != `echo {"text":"hello"}` {
+		t.Fatalf("unexpected answer %q", answer)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	router := NewRouter()
+	router.SetAdmissionLimits(AdmissionLimits{MaxConnections: 1})
+	router.On("panic", func(conn *Connection) {
+		panic("callback failed")
+	})
+	server := httptest.NewServer(http.HandlerFunc(router.Handler()))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	socket, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dialing failed: %v", err)
+	}
+	defer socket.Close()
+
+	writeTest(t, socket, `panic null`)
+	// The panic is recovered by the server and the connection released, so another is admitted.
+	for deadline := time.Now().Add(time.Second); ; {
+		socket, res, err := websocket.DefaultDialer.Dial(url, nil)
+		if err == nil {
+			socket.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected connection to be admitted after panic, received %v %v", res, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Memory transport recording whether compression was enabled for each written frame. Prepared
+// messages are written as frames with the data "prepared".
+type recordingTransport struct {
+	*MemoryTransport
+	enabled    bool
+	compressed chan bool
+}
+
+func (t *recordingTransport) EnableWriteCompression(enable bool) {
+	t.enabled = enable
+}
+
+func (t *recordingTransport) SetCompressionLevel(level int) error {
+	return nil
+}
+
+func (t *recordingTransport) WriteFrame(mode int, data []byte) error {
+	t.compressed <- t.enabled
+	return t.MemoryTransport.WriteFrame(mode, data)
+}
+
+func (t *recordingTransport) WritePreparedMessage(msg *websocket.PreparedMessage) error {
+	t.compressed <- t.enabled
+	return t.MemoryTransport.WriteFrame(TextMode, []byte("prepared"))
+}
+
+// Serves a compression recording transport and returns the end of the client, the connection
+// and the transport.
+func connectCompression(t *testing.T, router *Router) (*MemoryTransport, *Connection, *recordingTransport) {
+	connected := make(chan *Connection, 1)
+	router.OnConnect(func(conn *Connection, r *http.Request) {
+		connected <- conn
+	})
+	client, server := NewMemoryTransportPair()
+	transport := &recordingTransport{MemoryTransport: server, compressed: make(chan bool, 16)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeTransport(transport, httptest.NewRequest("GET", "/", nil))
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client, <-connected, transport
+}
+
+// Reads the next frame and returns its data and whether it was compressed.
+func readCompression(t *testing.T, client *MemoryTransport, transport *recordingTransport) (string, bool) {
+	t.Helper()
+	data := readMemory(t, client)
+	return data, <-transport.compressed
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	router := NewRouter()
+	if err := router.EnableCompression(flate.BestSpeed, 32); err != nil {
+		t.Fatalf("enabling compression failed: %v", err)
+	}
+	router.SetEventCompression("zip", false)
+	client, conn, transport := connectCompression(t, router)
+
+	long := strings.Repeat("a", 32)
+	for _, c := range []struct {
+		event    string
+		text     string
+		expected bool
+	}{
+		{"echo", "short", false},
+		{"echo", long, true},
+		{"zip", long, false},
+	} {
+		conn.Emit(c.event, &testMessage{Text: c.text})
+		if data, compressed := readCompression(t, client, transport); compressed != c.expected {
+			t.Fatalf("expected compression of %q to be %v", data, c.expected)
+		}
+	}
+}
+
+func TestCompressionShared(t *testing.T) {
+	router := NewRouter()
+	router.EnableCompression(flate.BestSpeed, 32)
+	router.SetEventCompression("zip", false)
+	client, conn, transport := connectCompression(t, router)
+	room := NewRoom()
+	defer room.Stop()
+	room.Join(conn)
+
+	long := strings.Repeat("a", 32)
+	for _, c := range []struct {
+		event    string
+		text     string
+		expected bool
+	}{
+		{"echo", "short", false},
+		{"echo", long, true},
+		{"zip", long, false},
+	} {
+		room.Emit(c.event, &testMessage{Text: c.text})
+		if data, compressed := readCompression(t, client, transport); data != "prepared" || compressed != c.expected {
+			t.Fatalf("expected prepared message of %q with compression %v, received %q", c.event, c.expected, data)
+		}
+	}
+}
+
+func TestCompressionDisabled(t *testing.T) {
+	router := NewRouter()
+	if err := router.EnableCompression(flate.BestCompression+1, 0); err == nil {
+		t.Fatal("expected invalid compression level to be rejected")
+	}
+	router.EnableCompression(flate.BestSpeed, 0)
+	router.DisableCompression()
+	client, conn, transport := connectCompression(t, router)
+
+	conn.Emit("echo", &testMessage{Text: strings.Repeat("a", 1024)})
+	if data, compressed := readCompression(t, client, transport); compressed {
+		t.Fatalf("expected %q to be uncompressed", data)
+	}
+}
+
+func TestMarshalError(t *testing.T) {
+	router := NewRouter()
+	router.SetErrorEvent("error")
+	errs := make(chan error, 1)
+	router.OnError(func(conn *Connection, err error) {
+		errs <- err
+	})
+	router.On("bad", func(conn *Connection) {
+		conn.Emit("bad", make(chan int))
+	})
+	router.On("echo", func(conn *Connection, data *testMessage) {
+		conn.Emit("echo", data)
+	})
+	socket := dialTest(t, router.Handler(), "/")
+
+	writeTest(t, socket, `bad null`)
+	select {
+	case err := <-errs:
+		if marshalErr, ok := err.(*MarshalError); !ok || marshalErr.Event != "bad" {
+			t.Fatalf("expected marshal error, received %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dropped message not reported")
+	}
+	if answer := readTest(t, socket); !strings.HasPrefix(answer, `error {"error":"Marshalling event bad failed: `) ||
+		!strings.HasSuffix(answer, `","event":"bad"}`) {
+		t.Fatalf("expected error event, received %q", answer)
+	}
+	writeTest(t, socket, `echo {"text":"hi"}`)
+	if answer := readTest(t, socket); answer != `echo {"text":"hi"}` {
+		t.Fatalf("unexpected answer %q", answer)
+	}
+}
@@ -0,0 +1,791 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Engine.IO packet types.
+	engineIOOpen    = '0'
+	engineIOClose   = '1'
+	engineIOPing    = '2'
+	engineIOPong    = '3'
+	engineIOMessage = '4'
+	engineIONoop    = '6'
+	// Socket.IO packet types.
+	socketIOConnect      = 0
+	socketIODisconnect   = 1
+	socketIOEvent        = 2
+	socketIOAck          = 3
+	socketIOConnectError = 4
+	socketIOBinaryEvent  = 5
+	socketIOBinaryAck    = 6
+	// Names of internal events are prefixed with NUL, the same separator is used
+	// between namespace and name of events outside of the default namespace.
+	socketIOSeparator  = "\x00"
+	socketIOPingEvent  = socketIOSeparator + "ping"
+	socketIOPongEvent  = socketIOSeparator + "pong"
+	socketIOCloseEvent = socketIOSeparator + "close"
+	socketIONoopEvent  = socketIOSeparator + "noop"
+	socketIOConnEvent  = socketIOSeparator + "connect"
+	socketIODiscEvent  = socketIOSeparator + "disconnect"
+	socketIOAckEvent   = socketIOSeparator + "ack"
+	// Default namespace.
+	socketIODefaultNamespace = "/"
+	// Default Engine.IO options.
+	socketIOPingInterval = 25 * time.Second
+	socketIOPingTimeout  = 20 * time.Second
+	// Maximum number of binary attachments of a single packet.
+	socketIOMaxAttachments = 64
+)
+
+// SocketIOArgs can be emitted to send several arguments with one event. Arguments of
+// type []byte are send as binary attachments.
+type SocketIOArgs []interface{}
+
+// SocketIOEvent is an event received from a Socket.IO client. Handlers taking interface{}
+// as data receive the event directly, all other handlers get the first argument unmarshalled.
+// Binary attachments are available as raw data and are also substituted by base64 strings
+// in the arguments, so []byte fields are unmarshalled as expected.
+type SocketIOEvent struct {
+	// Namespace the event was emitted in.
+	Namespace string
+	// Name of the event.
+	Name string
+	// Raw arguments.
+	Args []json.RawMessage
+	// Binary attachments in order of their placeholders.
+	Attachments [][]byte
+	// Packet id if the client requested an acknowledgement, otherwise -1.
+	id int64
+	// Flag whether the event was acknowledged.
+	acked bool
+	// Connection the event was received from.
+	conn *Connection
+}
+
+// Ack acknowledges the event with the provided arguments. Only the first call is
+// send to the client and events without requested acknowledgement are ignored.
+// If the client requested an acknowledgement and the handler does not call Ack, the
+// event is acknowledged without arguments after the handler returned.
+func (ev *SocketIOEvent) Ack(args ...interface{}) {
+	if ev.id < 0 || ev.acked || ev.conn == nil {
+		return
+	}
+	ev.acked = true
+	ev.conn.trySend(&message{
+		event: socketIOAckEvent,
+		data:  &socketIOOutgoing{kind: socketIOAck, namespace: ev.Namespace, id: ev.id, args: args},
+	})
+}
+
+// Outgoing Socket.IO packet.
+type socketIOOutgoing struct {
+	kind      int
+	namespace string
+	id        int64
+	args      []interface{}
+	// Callback for acknowledgement of emitted events.
+	ack func([]json.RawMessage)
+}
+
+// Already encoded Engine.IO text packet.
+type socketIORaw string
+
+// State of a single connection speaking Socket.IO.
+type socketIOSession struct {
+	// Engine.IO session ID.
+	sid string
+	// Connected namespaces.
+	namespaces map[string]bool
+	// Event waiting for binary attachments.
+	pending *SocketIOEvent
+	// Kind of the pending packet.
+	pendingKind int
+	// Number of attachments the pending packet waits for.
+	pendingCount int
+	// Callbacks for acknowledgements of emitted events by packet ID.
+	acks map[int64]func([]json.RawMessage)
+	// Last packet ID used for emitted events.
+	lastID int64
+	// Time the last pong was received.
+	lastPong time.Time
+	// Closed to stop pinging.
+	stop chan bool
+}
+
+// SocketIONamespace is a namespace of Socket.IO. Events of the default namespace are
+// routed by their plain name, events of other namespaces have to be registered and
+// emitted using the methods of the namespace.
+type SocketIONamespace struct {
+	// Name of the namespace.
+	name string
+	// Router of the adapter.
+	router *Router
+	// Function verifying CONNECT packets.
+	connectFunc func(*Connection, json.RawMessage) bool
+}
+
+// On adds the handler of the event in the namespace, see the On-function of Router.
+func (nsp *SocketIONamespace) On(event string, callback interface{}) {
+	nsp.router.On(nsp.Event(event), callback)
+}
+
+// OnConnect sets the callback verifying the auth payload of clients connecting to the namespace.
+// If the function returns false a connect error is send to the client.
+func (nsp *SocketIONamespace) OnConnect(callback func(*Connection, json.RawMessage) bool) {
+	nsp.connectFunc = callback
+}
+
+// Event returns the name of the event inside of this namespace as it is used by the router.
+// It can be used to emit events of the namespace to rooms.
+func (nsp *SocketIONamespace) Event(event string) string {
+	if nsp.name == socketIODefaultNamespace {
+		return event
+	}
+	return nsp.name + socketIOSeparator + event
+}
+
+// Emit emits the event in the namespace to the connection. Use SocketIOArgs to send
+// several arguments.
+func (nsp *SocketIONamespace) Emit(conn *Connection, event string, data interface{}) {
+	conn.Emit(nsp.Event(event), data)
+}
+
+// EmitWithAck emits the event in the namespace to the connection and requests an
+// acknowledgement, the callback receives the raw arguments of the acknowledgement.
+func (nsp *SocketIONamespace) EmitWithAck(conn *Connection, event string, data interface{}, callback func([]json.RawMessage)) {
+	conn.Emit(nsp.Event(event), &socketIOOutgoing{
+		kind:      socketIOEvent,
+		namespace: nsp.name,
+		args:      append([]interface{}{event}, socketIOArguments(data)...),
+		ack:       callback,
+	})
+}
+
+// SocketIO adapts a router to Socket.IO v5 over Engine.IO v4 using the websocket transport.
+// Events are routed to the handlers of the router and emits are delivered as events,
+// so rooms and the hub work as usual. Polling is not supported, clients need to be
+// configured to only use the websocket transport.
+type SocketIO struct {
+	// Router the adapter is installed on.
+	router *Router
+	// Registered namespaces by name.
+	namespaces map[string]*SocketIONamespace
+	// Engine.IO options.
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+	// State of active connections.
+	sessions map[*Connection]*socketIOSession
+	// Guards sessions.
+	lock sync.Mutex
+}
+
+// NewSocketIO installs the Socket.IO adapter on the router and returns it. The protocol of
+// the router is replaced, the handler of the adapter should be used instead of the handler
+// of the router to verify the Engine.IO handshake. The maximum message size of the router is
+// advertised to clients as maxPayload and is not changed, clients assume 1000000 bytes by default
+// and SetMaxMessageSize of the router needs to be used to accept packets of that size.
+func NewSocketIO(router *Router) *SocketIO {
+	sio := &SocketIO{
+		router:       router,
+		namespaces:   make(map[string]*SocketIONamespace),
+		pingInterval: socketIOPingInterval,
+		pingTimeout:  socketIOPingTimeout,
+		sessions:     make(map[*Connection]*socketIOSession),
+	}
+	sio.Of(socketIODefaultNamespace)
+	router.SetProtocol(&socketIOProtocol{sio})
+	router.callbacks[socketIOPingEvent] = func(conn *Connection, data interface{}) {
+		if payload, ok := data.(string); ok {
+			conn.Emit(socketIOPongEvent, socketIORaw(string(engineIOPong)+payload))
+		}
+	}
+	router.callbacks[socketIOPongEvent] = sio.handlePong
+	router.callbacks[socketIOCloseEvent] = func(conn *Connection, data interface{}) { conn.Close() }
+	router.callbacks[socketIONoopEvent] = func(*Connection, interface{}) {}
+	router.callbacks[socketIOConnEvent] = sio.handleConnect
+	router.callbacks[socketIODiscEvent] = sio.handleDisconnect
+	router.callbacks[socketIOAckEvent] = sio.handleAck
+	router.connectHooks = append(router.connectHooks, sio.connected)
+	router.closeHooks = append(router.closeHooks, sio.closed)
+	router.middleware = append(router.middleware, sio.intercept)
+	return sio
+}
+
+// Handler creates a handler function verifying the Engine.IO handshake
+// (/socket.io/?EIO=4&transport=websocket) before the router upgrades the connection.
+func (sio *SocketIO) Handler() func(http.ResponseWriter, *http.Request) {
+	handler := sio.router.Handler()
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("EIO") != "4" {
+			http.Error(w, `{"code":5,"message":"Unsupported protocol version"}`, 400)
+			return
+		}
+		if query.Get("transport") != "websocket" {
+			http.Error(w, `{"code":0,"message":"Transport unknown"}`, 400)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// SetPing sets interval and timeout of Engine.IO heartbeats.
+func (sio *SocketIO) SetPing(interval, timeout time.Duration) {
+	sio.pingInterval = interval
+	sio.pingTimeout = timeout
+}
+
+// Of returns the namespace of the specified name and creates it if necessary. Clients
+// can only connect to namespaces that were created.
+func (sio *SocketIO) Of(name string) *SocketIONamespace {
+	if nsp, ok := sio.namespaces[name]; ok {
+		return nsp
+	}
+	nsp := &SocketIONamespace{
+		name:        name,
+		router:      sio.router,
+		connectFunc: func(*Connection, json.RawMessage) bool { return true }, // Connect always allowed.
+	}
+	sio.namespaces[name] = nsp
+	return nsp
+}
+
+// Returns the session of the connection or nil if the connection is unknown.
+func (sio *SocketIO) session(conn *Connection) *socketIOSession {
+	sio.lock.Lock()
+	defer sio.lock.Unlock()
+	return sio.sessions[conn]
+}
+
+// Send Engine.IO open packet and start heartbeats.
+func (sio *SocketIO) connected(conn *Connection, r *http.Request) {
+	session := &socketIOSession{
+		sid:        newSocketIOID(),
+		namespaces: make(map[string]bool),
+		acks:       make(map[int64]func([]json.RawMessage)),
+		lastPong:   time.Now(),
+		stop:       make(chan bool),
+	}
+	sio.lock.Lock()
+	sio.sessions[conn] = session
+	sio.lock.Unlock()
+	open, _ := json.Marshal(&struct {
+		Sid          string   `json:"sid"`
+		Upgrades     []string `json:"upgrades"`
+		PingInterval int64    `json:"pingInterval"`
+		PingTimeout  int64    `json:"pingTimeout"`
+		MaxPayload   int64    `json:"maxPayload"`
+	}{session.sid, []string{}, int64(sio.pingInterval / time.Millisecond), int64(sio.pingTimeout / time.Millisecond), sio.router.maxMessageSize})
+	conn.Emit(socketIOConnEvent, socketIORaw(string(engineIOOpen)+string(open)))
+	go sio.ping(conn, session)
+}
+
+func (sio *SocketIO) closed(conn *Connection) {
+	sio.lock.Lock()
+	session, ok := sio.sessions[conn]
+	delete(sio.sessions, conn)
+	sio.lock.Unlock()
+	if ok {
+		close(session.stop)
+	}
+}
+
+// Sends pings and closes the connection if the client does not answer in time.
+func (sio *SocketIO) ping(conn *Connection, session *socketIOSession) {
+	ticker := time.NewTicker(sio.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sio.lock.Lock()
+			idle := time.Since(session.lastPong)
+			sio.lock.Unlock()
+			if idle > sio.pingInterval+sio.pingTimeout {
+				conn.Close()
+				return
+			}
+			conn.trySend(&message{event: socketIOPingEvent, data: socketIORaw(string(engineIOPing))})
+		case <-session.stop:
+			return
+		}
+	}
+}
+
+// Middleware dropping events of unconnected namespaces and acknowledging events.
+func (sio *SocketIO) intercept(next dispatchFunc) dispatchFunc {
+	return func(conn *Connection, name string, data interface{}) {
+		ev, ok := data.(*SocketIOEvent)
+		if !ok || ev.Name == "" {
+			next(conn, name, data)
+			return
+		}
+		session := sio.session(conn)
+		if session == nil {
+			return
+		}
+		sio.lock.Lock()
+		connected := session.namespaces[ev.Namespace]
+		sio.lock.Unlock()
+		if !connected {
+			return
+		}
+		ev.conn = conn
+		next(conn, name, data)
+		ev.Ack()
+	}
+}
+
+func (sio *SocketIO) handlePong(conn *Connection, data interface{}) {
+	if session := sio.session(conn); session != nil {
+		sio.lock.Lock()
+		session.lastPong = time.Now()
+		sio.lock.Unlock()
+	}
+}
+
+func (sio *SocketIO) handleConnect(conn *Connection, data interface{}) {
+	ev, ok := data.(*SocketIOEvent)
+	session := sio.session(conn)
+	if !ok || session == nil {
+		return
+	}
+	nsp, ok := sio.namespaces[ev.Namespace]
+	var auth json.RawMessage
+	if len(ev.Args) > 0 {
+		auth = ev.Args[0]
+	}
+	if !ok {
+		sio.connectError(conn, ev.Namespace, "Invalid namespace")
+		return
+	}
+	if !nsp.connectFunc(conn, auth) {
+		sio.connectError(conn, ev.Namespace, "Not authorized")
+		return
+	}
+	sio.lock.Lock()
+	session.namespaces[ev.Namespace] = true
+	sio.lock.Unlock()
+	reply, _ := json.Marshal(&struct {
+		Sid string `json:"sid"`
+	}{newSocketIOID()})
+	conn.Emit(socketIOConnEvent, socketIORaw(string(engineIOMessage)+strconv.Itoa(socketIOConnect)+socketIONamespacePrefix(ev.Namespace)+string(reply)))
+}
+
+// Sends a connect error for the namespace.
+func (sio *SocketIO) connectError(conn *Connection, namespace string, msg string) {
+	reply, _ := json.Marshal(&struct {
+		Message string `json:"message"`
+	}{msg})
+	conn.Emit(socketIOConnEvent, socketIORaw(string(engineIOMessage)+strconv.Itoa(socketIOConnectError)+socketIONamespacePrefix(namespace)+string(reply)))
+}
+
+func (sio *SocketIO) handleDisconnect(conn *Connection, data interface{}) {
+	ev, ok := data.(*SocketIOEvent)
+	if !ok {
+		return
+	}
+	if session := sio.session(conn); session != nil {
+		sio.lock.Lock()
+		delete(session.namespaces, ev.Namespace)
+		sio.lock.Unlock()
+	}
+}
+
+// Disconnect disconnects the connection from the namespace, the underlying
+// connection stays open.
+func (sio *SocketIO) Disconnect(conn *Connection, namespace string) {
+	if session := sio.session(conn); session != nil {
+		sio.lock.Lock()
+		delete(session.namespaces, namespace)
+		sio.lock.Unlock()
+		conn.Emit(socketIODiscEvent, socketIORaw(string(engineIOMessage)+strconv.Itoa(socketIODisconnect)+socketIONamespacePrefix(namespace)))
+	}
+}
+
+func (sio *SocketIO) handleAck(conn *Connection, data interface{}) {
+	ev, ok := data.(*SocketIOEvent)
+	session := sio.session(conn)
+	if !ok || session == nil {
+		return
+	}
+	sio.lock.Lock()
+	callback, ok := session.acks[ev.id]
+	delete(session.acks, ev.id)
+	sio.lock.Unlock()
+	if ok {
+		callback(ev.Args)
+	}
+}
+
+// Registers ack callback and returns the packet ID to use.
+func (sio *SocketIO) registerAck(conn *Connection, callback func([]json.RawMessage)) int64 {
+	sio.lock.Lock()
+	defer sio.lock.Unlock()
+	session, ok := sio.sessions[conn]
+	if !ok {
+		return -1
+	}
+	session.lastID++
+	session.acks[session.lastID] = callback
+	return session.lastID
+}
+
+// Returns a random identifier for sessions and sockets.
+func newSocketIOID() string {
+	b := make([]byte, 15)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Returns the namespace prefix of packets, which is empty for the default namespace.
+func socketIONamespacePrefix(namespace string) string {
+	if namespace == socketIODefaultNamespace {
+		return ""
+	}
+	return namespace + ","
+}
+
+// Splits an event name of the router into namespace and event.
+func splitSocketIOEvent(name string) (string, string) {
+	if i := strings.Index(name, socketIOSeparator); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return socketIODefaultNamespace, name
+}
+
+// Returns the arguments of emitted data.
+func socketIOArguments(data interface{}) []interface{} {
+	if args, ok := data.(SocketIOArgs); ok {
+		return args
+	}
+	return []interface{}{data}
+}
+
+// Encodes a Socket.IO packet into an Engine.IO message and binary attachments.
+func encodeSocketIOPacket(p *socketIOOutgoing) ([]Frame, error) {
+	attachments := make([]Frame, 0)
+	args := make([]interface{}, len(p.args))
+	for i, arg := range p.args {
+		if b, ok := arg.([]byte); ok {
+			args[i] = map[string]interface{}{"_placeholder": true, "num": len(attachments)}
+			attachments = append(attachments, Frame{Mode: BinaryMode, Data: b})
+		} else {
+			args[i] = arg
+		}
+	}
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	kind := p.kind
+	header := ""
+	if len(attachments) > 0 {
+		if kind == socketIOEvent {
+			kind = socketIOBinaryEvent
+		} else {
+			kind = socketIOBinaryAck
+		}
+		header = strconv.Itoa(len(attachments)) + "-"
+	}
+	header = string(engineIOMessage) + strconv.Itoa(kind) + header + socketIONamespacePrefix(p.namespace)
+	if p.id >= 0 {
+		header += strconv.FormatInt(p.id, 10)
+	}
+	frames := []Frame{{Mode: TextMode, Data: append([]byte(header), payload...)}}
+	return append(frames, attachments...), nil
+}
+
+// Decodes a Socket.IO packet without the Engine.IO type. Returns the packet type, the
+// number of attachments and the event with unparsed arguments as first argument.
+func decodeSocketIOPacket(s string) (int, int, *SocketIOEvent, error) {
+	if len(s) == 0 || s[0] < '0' || s[0] > '6' {
+		return 0, 0, nil, errors.New("Invalid Socket.IO packet type.")
+	}
+	kind := int(s[0] - '0')
+	s = s[1:]
+	attachments := 0
+	if kind == socketIOBinaryEvent || kind == socketIOBinaryAck {
+		i := strings.IndexByte(s, '-')
+		if i < 0 {
+			return 0, 0, nil, errors.New("Binary Socket.IO packet without attachment count.")
+		}
+		n, err := strconv.Atoi(s[:i])
+		if err != nil || n < 0 || n > socketIOMaxAttachments {
+			return 0, 0, nil, errors.New("Invalid Socket.IO attachment count.")
+		}
+		attachments = n
+		s = s[i+1:]
+	}
+	ev := &SocketIOEvent{Namespace: socketIODefaultNamespace, id: -1}
+	if strings.HasPrefix(s, "/") {
+		i := strings.IndexByte(s, ',')
+		if i < 0 {
+			ev.Namespace, s = s, ""
+		} else {
+			ev.Namespace, s = s[:i], s[i+1:]
+		}
+		if strings.Contains(ev.Namespace, socketIOSeparator) {
+			return 0, 0, nil, errors.New("Invalid Socket.IO namespace.")
+		}
+	}
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i > 0 {
+		id, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		ev.id = id
+		s = s[i:]
+	}
+	if len(s) > 0 {
+		ev.Args = []json.RawMessage{json.RawMessage(s)}
+	}
+	return kind, attachments, ev, nil
+}
+
+// Replaces the placeholders of attachments in the raw JSON with base64 strings.
+func replaceSocketIOPlaceholders(raw json.RawMessage, attachments [][]byte) (json.RawMessage, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	var replace func(interface{}) interface{}
+	replace = func(v interface{}) interface{} {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			if placeholder, ok := t["_placeholder"].(bool); ok && placeholder {
+				if num, ok := t["num"].(float64); ok && int(num) >= 0 && int(num) < len(attachments) {
+					return base64.StdEncoding.EncodeToString(attachments[int(num)])
+				}
+			}
+			for k, e := range t {
+				t[k] = replace(e)
+			}
+		case []interface{}:
+			for i, e := range t {
+				t[i] = replace(e)
+			}
+		}
+		return v
+	}
+	return json.Marshal(replace(v))
+}
+
+// socketIOProtocol implements the packet encoding of Engine.IO v4 and Socket.IO v5.
+// Event names of namespaces other than the default namespace are prefixed with the
+// namespace and NUL.
+type socketIOProtocol struct {
+	sio *SocketIO
+}
+
+// Unpack decodes a text frame without binary attachments.
+func (p *socketIOProtocol) Unpack(data []byte) (string, interface{}, error) {
+	name, ev, attachments, err := p.unpackText(data)
+	if err != nil {
+		return "", nil, err
+	}
+	if attachments > 0 {
+		return "", nil, errors.New("Binary attachments require a connection.")
+	}
+	return name, ev, nil
+}
+
+// Decodes a text frame and returns event name, interstage product and number of attachments.
+func (p *socketIOProtocol) unpackText(data []byte) (string, interface{}, int, error) {
+	if len(data) == 0 {
+		return "", nil, 0, errors.New("Empty Engine.IO packet.")
+	}
+	switch data[0] {
+	case engineIOPing:
+		return socketIOPingEvent, string(data[1:]), 0, nil
+	case engineIOPong:
+		return socketIOPongEvent, string(data[1:]), 0, nil
+	case engineIOClose:
+		return socketIOCloseEvent, nil, 0, nil
+	case engineIONoop:
+		return socketIONoopEvent, nil, 0, nil
+	case engineIOMessage:
+	default:
+		return "", nil, 0, errors.New("Unsupported Engine.IO packet type.")
+	}
+	kind, attachments, ev, err := decodeSocketIOPacket(string(data[1:]))
+	if err != nil {
+		return "", nil, 0, err
+	}
+	switch kind {
+	case socketIOConnect:
+		return socketIOConnEvent, ev, 0, nil
+	case socketIODisconnect:
+		return socketIODiscEvent, ev, 0, nil
+	case socketIOAck, socketIOBinaryAck:
+		if len(ev.Args) > 0 {
+			var args []json.RawMessage
+			if err := json.Unmarshal(ev.Args[0], &args); err != nil {
+				return "", nil, 0, err
+			}
+			ev.Args = args
+		}
+		return socketIOAckEvent, ev, attachments, nil
+	case socketIOEvent, socketIOBinaryEvent:
+		var args []json.RawMessage
+		if len(ev.Args) == 0 || json.Unmarshal(ev.Args[0], &args) != nil || len(args) == 0 {
+			return "", nil, 0, errors.New("Socket.IO event without name.")
+		}
+		if err := json.Unmarshal(args[0], &ev.Name); err != nil {
+			return "", nil, 0, err
+		}
+		// Names containing NUL could address internal events or other namespaces.
+		if ev.Name == "" || strings.Contains(ev.Name, socketIOSeparator) {
+			return "", nil, 0, errors.New("Invalid Socket.IO event name.")
+		}
+		ev.Args = args[1:]
+		if ev.Namespace == socketIODefaultNamespace {
+			return ev.Name, ev, attachments, nil
+		}
+		return ev.Namespace + socketIOSeparator + ev.Name, ev, attachments, nil
+	}
+	return "", nil, 0, errors.New("Unsupported Socket.IO packet type.")
+}
+
+// UnpackFrame decodes text frames and collects binary attachments of the connection.
+func (p *socketIOProtocol) UnpackFrame(conn *Connection, mode int, data []byte) (string, interface{}, bool, error) {
+	session := p.sio.session(conn)
+	if session == nil {
+		return "", nil, false, errors.New("Unknown Socket.IO session.")
+	}
+	p.sio.lock.Lock()
+	defer p.sio.lock.Unlock()
+	if mode == BinaryMode {
+		if session.pending == nil {
+			return "", nil, false, errors.New("Unexpected binary attachment.")
+		}
+		ev := session.pending
+		ev.Attachments = append(ev.Attachments, data)
+		if len(ev.Attachments) < session.pendingCount {
+			return "", nil, false, nil
+		}
+		session.pending = nil
+		for i, arg := range ev.Args {
+			replaced, err := replaceSocketIOPlaceholders(arg, ev.Attachments)
+			if err != nil {
+				return "", nil, false, err
+			}
+			ev.Args[i] = replaced
+		}
+		if session.pendingKind == socketIOAck || ev.Name == "" {
+			return socketIOAckEvent, ev, true, nil
+		}
+		if ev.Namespace == socketIODefaultNamespace {
+			return ev.Name, ev, true, nil
+		}
+		return ev.Namespace + socketIOSeparator + ev.Name, ev, true, nil
+	}
+	name, unpacked, attachments, err := p.unpackText(data)
+	if err != nil {
+		return "", nil, false, err
+	}
+	if attachments > 0 {
+		session.pending = unpacked.(*SocketIOEvent)
+		session.pendingCount = attachments
+		session.pendingKind = socketIOEvent
+		if name == socketIOAckEvent {
+			session.pendingKind = socketIOAck
+		}
+		return "", nil, false, nil
+	}
+	return name, unpacked, true, nil
+}
+
+// Unmarshals the first argument of the event into the requested structure.
+func (_ *socketIOProtocol) Unmarshal(data interface{}, typePtr interface{}) error {
+	ev, ok := data.(*SocketIOEvent)
+	if !ok {
+		return errors.New("Socket.IO event expected.")
+	}
+	if len(ev.Args) == 0 {
+		return nil
+	}
+	return json.Unmarshal(ev.Args[0], typePtr)
+}
+
+// Packs data as event without binary attachments.
+func (p *socketIOProtocol) MarshalAndPack(name string, data interface{}) ([]byte, error) {
+	frames, err := p.pack(nil, name, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(frames) != 1 {
+		return nil, errors.New("Binary attachments require a connection.")
+	}
+	return frames[0].Data, nil
+}
+
+// Packs data as event, binary arguments are send as attachments and acknowledgement
+// callbacks are registered with the connection.
+func (p *socketIOProtocol) MarshalAndPackFrames(conn *Connection, name string, data interface{}) ([]Frame, error) {
+	return p.pack(conn, name, data)
+}
+
+func (p *socketIOProtocol) pack(conn *Connection, name string, data interface{}) ([]Frame, error) {
+	switch d := data.(type) {
+	case socketIORaw:
+		return []Frame{{Mode: TextMode, Data: []byte(d)}}, nil
+	case *socketIOOutgoing:
+		out := *d
+		out.id = -1
+		if d.kind == socketIOAck {
+			out.id = d.id
+		} else if d.ack != nil && conn != nil {
+			out.id = p.sio.registerAck(conn, d.ack)
+		}
+		return encodeSocketIOPacket(&out)
+	}
+	namespace, event := splitSocketIOEvent(name)
+	return encodeSocketIOPacket(&socketIOOutgoing{
+		kind:      socketIOEvent,
+		namespace: namespace,
+		id:        -1,
+		args:      append([]interface{}{event}, socketIOArguments(data)...),
+	})
+}
+
+// Return TextMode because Engine.IO packets are text, attachments use binary frames.
+func (_ *socketIOProtocol) GetReadMode() int {
+	return TextMode
+}
+
+// Return TextMode because Engine.IO packets are text, attachments use binary frames.
+func (_ *socketIOProtocol) GetWriteMode() int {
+	return TextMode
+}
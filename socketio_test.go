@@ -0,0 +1,166 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testUpload struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+// Returns a client socket connected to the main namespace of the Socket.IO server.
+func connectSocketIO(t *testing.T, sio *SocketIO) *websocket.Conn {
+	socket := dialTest(t, sio.Handler(), "/socket.io/?EIO=4&transport=websocket")
+	if open := readTest(t, socket); !strings.HasPrefix(open, `0{"sid":`) {
+		t.Fatalf("expected open packet, received %q", open)
+	}
+	writeTest(t, socket, "40")
+	if connect := readTest(t, socket); !strings.HasPrefix(connect, `40{"sid":`) {
+		t.Fatalf("expected connect packet, received %q", connect)
+	}
+	return socket
+}
+
+func TestSocketIOEvents(t *testing.T) {
+	router := NewRouter()
+	sio := NewSocketIO(router)
+	router.On("hello", func(conn *Connection, name *string) {
+		conn.Emit("answer", "hi "+*name)
+	})
+	socket := connectSocketIO(t, sio)
+
+	writeTest(t, socket, `42["hello","bob"]`)
+	if answer := readTest(t, socket); answer != `42["answer","hi bob"]` {
+		t.Fatalf("unexpected answer %q", answer)
+	}
+}
+
+func TestSocketIOBinary(t *testing.T) {
+	router := NewRouter()
+	sio := NewSocketIO(router)
+	router.On("upload", func(conn *Connection, data *testUpload) {
+		conn.Emit("stored", SocketIOArgs{data.Name, data.Data})
+	})
+	socket := connectSocketIO(t, sio)
+
+	writeTest(t, socket, `451-["upload",{"name":"f","data":{"_placeholder":true,"num":0}}]`)
+	if err := socket.WriteMessage(websocket.BinaryMessage, []byte("XYZ")); err != nil {
+		t.Fatalf("writing attachment failed: %v", err)
+	}
+	if header := readTest(t, socket); header != `451-["stored","f",{"_placeholder":true,"num":0}]` {
+		t.Fatalf("unexpected binary event %q", header)
+	}
+	if attachment := readTest(t, socket); attachment != "XYZ" {
+		t.Fatalf("unexpected attachment %q", attachment)
+	}
+}
+
+func TestSocketIONamespaceAck(t *testing.T) {
+	router := NewRouter()
+	sio := NewSocketIO(router)
+	acks := make(chan string, 1)
+	chat := sio.Of("/chat")
+	chat.On("msg", func(conn *Connection, data interface{}) {
+		data.(*SocketIOEvent).Ack("ok")
+		chat.EmitWithAck(conn, "question", 1, func(args []json.RawMessage) {
+			acks <- string(args[0])
+		})
+	})
+	socket := connectSocketIO(t, sio)
+
+	writeTest(t, socket, `40/chat,`)
+	if connect := readTest(t, socket); !strings.HasPrefix(connect, `40/chat,{"sid":`) {
+		t.Fatalf("expected connect packet of namespace, received %q", connect)
+	}
+	writeTest(t, socket, `42/chat,7["msg",1]`)
+	if ack := readTest(t, socket); ack != `43/chat,7["ok"]` {
+		t.Fatalf("expected ack, received %q", ack)
+	}
+	question := readTest(t, socket)
+	if !strings.HasPrefix(question, `42/chat,`) || !strings.HasSuffix(question, `["question",1]`) {
+		t.Fatalf("unexpected event %q", question)
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(question, `42/chat,`), `["question",1]`)
+	writeTest(t, socket, `43/chat,`+id+`["yes"]`)
+	select {
+	case ack := <-acks:
+		if ack != `"yes"` {
+			t.Fatalf("unexpected ack %q", ack)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ack callback not called")
+	}
+}
+
+func TestSocketIORejectsInternalEvents(t *testing.T) {
+	router := NewRouter()
+	sio := NewSocketIO(router)
+	router.On("hello", func(conn *Connection, name *string) {
+		conn.Emit("answer", "hi "+*name)
+	})
+	socket := connectSocketIO(t, sio)
+
+	writeTest(t, socket, `42["\u0000ping"]`)
+	writeTest(t, socket, `42["\u0000close"]`)
+	writeTest(t, socket, "42/chat\x00x,[\"hello\",\"eve\"]")
+	writeTest(t, socket, `42["hello","bob"]`)
+	if answer := readTest(t, socket); answer != `42["answer","hi bob"]` {
+		t.Fatalf("unexpected answer %q", answer)
+	}
+}
+
+func TestSocketIOAttachmentLimit(t *testing.T) {
+	router := NewRouter()
+	sio := NewSocketIO(router)
+	router.On("hello", func(conn *Connection, name *string) {
+		conn.Emit("answer", "hi "+*name)
+	})
+	socket := connectSocketIO(t, sio)
+
+	writeTest(t, socket, `4565-["hello","eve"]`)
+	for i := 0; i < 65; i++ {
+		if err := socket.WriteMessage(websocket.BinaryMessage, []byte("X")); err != nil {
+			t.Fatalf("writing attachment failed: %v", err)
+		}
+	}
+	writeTest(t, socket, `42["hello","bob"]`)
+	if answer := readTest(t, socket); answer != `42["answer","hi bob"]` {
+		t.Fatalf("unexpected answer %q", answer)
+	}
+}
+
+func TestSocketIOMaxPayload(t *testing.T) {
+	router := NewRouter()
+	sio := NewSocketIO(router)
+	if router.maxMessageSize != maxMessageSize {
+		t.Fatalf("expected maximum message size to be unchanged, got %d", router.maxMessageSize)
+	}
+	router.SetMaxMessageSize(1000000)
+	socket := dialTest(t, sio.Handler(), "/socket.io/?EIO=4&transport=websocket")
+	if open := readTest(t, socket); !strings.Contains(open, `"maxPayload":1000000`) {
+		t.Fatalf("expected advertised maxPayload, received %q", open)
+	}
+}
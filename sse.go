@@ -0,0 +1,392 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Event send by the SSE transport after the stream was opened, carrying the session ID.
+	sseSessionEvent = "$session"
+	// Event send by the HTTP fallback transports, carrying status code and reason of closed connections.
+	httpCloseEvent = "$close"
+)
+
+var (
+	// Removes line breaks from event names, which would break the event stream.
+	sseEventNameReplacer = strings.NewReplacer("\r", "", "\n", "")
+	// Normalizes the line breaks of data, which are CRLF, CR or LF in event streams.
+	sseLineReplacer = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+)
+
+// SSE serves connections of a router using Server-Sent Events and HTTP POST as fallback for
+// clients unable to establish WebSocket connections. The connections behave like WebSocket
+// connections, so handlers, rooms and the hub work transparently.
+//
+// The client opens the stream using GET (e.g. with an EventSource). The first event is
+// "$session" carrying the session ID as data. Every message is send as event named like the
+// golem event, the data is the frame packed by the protocol of the router, exactly as it would
+// be send using a WebSocket. Binary frames are base64 encoded. If the connection is closed a
+// "$close" event with {"code": <status code>, "reason": <reason>} is send.
+//
+// Messages are send by the client using POST to the same URL with the query parameter
+// session=<session ID>, the body is a single frame packed by the protocol of the router. The
+// Content-Type application/octet-stream marks binary frames. The response is send once the
+// message was handed over to the connection, which handles messages one after another, so
+// clients should wait for it before posting the next message to preserve the order of messages.
+// The response does not indicate that the message was handled already.
+type SSE struct {
+	// Associated router.
+	router *Router
+	// Open streams by session ID.
+	sessions map[string]*sseTransport
+	// Guards sessions.
+	lock sync.Mutex
+}
+
+// NewSSE creates the SSE fallback for the router.
+func NewSSE(router *Router) *SSE {
+	return &SSE{
+		router:   router,
+		sessions: make(map[string]*sseTransport),
+	}
+}
+
+// Handler creates a handler function serving event streams for GET requests and
+// incoming messages for POST requests.
+func (s *SSE) Handler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			s.serveStream(w, r)
+		case "POST":
+			s.servePost(w, r)
+		default:
+			http.Error(w, "Method not allowed", 405)
+		}
+	}
+}
+
+// Opens the event stream and serves the connection until it is closed.
+func (s *SSE) serveStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", 500)
+		return
+	}
+	r = withHandshakeState(r)
+	ticket, ok := s.router.accept(w, r)
+	if !ok {
+		return
+	}
+	defer ticket.release()
+	id, err := newSessionID()
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+
+	t := newSSETransport(w, flusher)
+	if err := t.writeEvent(sseSessionEvent, []byte(id)); err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.sessions[id] = t
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.sessions, id)
+		s.lock.Unlock()
+	}()
+
+	// Close the connection if the client goes away.
+	go func() {
+		select {
+		case <-r.Context().Done():
+			t.Close()
+		case <-t.done:
+		}
+	}()
+
+	s.router.ServeTransport(t, r)
+	// Wait for pending writes, the response writer must not be used after returning.
+	t.Close()
+}
+
+// Forwards a posted message to the connection of the session.
+func (s *SSE) servePost(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	t, ok := s.sessions[r.URL.Query().Get("session")]
+	s.lock.Unlock()
+	if !ok {
+		http.Error(w, "Unknown session", 404)
+		return
+	}
+	data, status := readFrameBody(r, t.limit())
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	mode := TextMode
+	if r.Header.Get("Content-Type") == "application/octet-stream" {
+		mode = BinaryMode
+	}
+	if !t.deliver(mode, data) {
+		http.Error(w, "Session closed", 410)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// Reads the body of a request carrying messages, returning a status code other
+// than zero if reading failed or the body exceeds the limit.
+func readFrameBody(r *http.Request, limit int64) ([]byte, int) {
+	var reader io.Reader = r.Body
+	if limit > 0 {
+		reader = io.LimitReader(r.Body, limit+1)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, 400
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		return nil, 413
+	}
+	return data, 0
+}
+
+// Creates a random session ID.
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Returns the data of the close event of the HTTP fallback transports.
+func closeEventData(code int, reason string) []byte {
+	data, _ := json.Marshal(struct {
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+	}{code, reason})
+	return data
+}
+
+// Reading side of the HTTP fallback transports, messages are posted by the client
+// and handed over to the reading connection.
+type httpInbound struct {
+	// Posted messages, handed over once the connection reads them.
+	inbound chan Frame
+	// Closed when the transport is closed.
+	done chan struct{}
+	once sync.Once
+	// Guards the settings below.
+	lock         sync.Mutex
+	readDeadline time.Time
+	readLimit    int64
+	pongHandler  func()
+}
+
+func newHTTPInbound() httpInbound {
+	return httpInbound{
+		inbound: make(chan Frame),
+		done:    make(chan struct{}),
+	}
+}
+
+// Hands the message over to the reading connection, returns false if the transport was closed.
+func (t *httpInbound) deliver(mode int, data []byte) bool {
+	select {
+	case t.inbound <- Frame{Mode: mode, Data: data}:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// Unblocks reading, returns false if it was already closed.
+func (t *httpInbound) closeInbound() (closed bool) {
+	t.once.Do(func() {
+		close(t.done)
+		closed = true
+	})
+	return
+}
+
+// Returns the read limit.
+func (t *httpInbound) limit() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.readLimit
+}
+
+// Calls the pong handler, the HTTP transports report activity of the client as pong.
+func (t *httpInbound) pong() {
+	t.lock.Lock()
+	h := t.pongHandler
+	t.lock.Unlock()
+	if h != nil {
+		h()
+	}
+}
+
+func (t *httpInbound) ReadFrame() (int, []byte, error) {
+	for {
+		t.lock.Lock()
+		deadline := t.readDeadline
+		t.lock.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			t.closeInbound()
+			return 0, nil, ErrTransportTimeout
+		}
+		timeout, stop := deadlineTimer(deadline)
+		select {
+		case frame := <-t.inbound:
+			stop()
+			return frame.Mode, frame.Data, nil
+		case <-t.done:
+			stop()
+			return 0, nil, ErrTransportClosed
+		case <-timeout: // The deadline might have been extended meanwhile.
+		}
+	}
+}
+
+func (t *httpInbound) SetReadDeadline(deadline time.Time) error {
+	t.lock.Lock()
+	t.readDeadline = deadline
+	t.lock.Unlock()
+	return nil
+}
+
+// SetWriteDeadline is not supported by the HTTP transports and ignored.
+func (t *httpInbound) SetWriteDeadline(deadline time.Time) error {
+	return nil
+}
+
+func (t *httpInbound) SetReadLimit(limit int64) {
+	t.lock.Lock()
+	t.readLimit = limit
+	t.lock.Unlock()
+}
+
+func (t *httpInbound) SetPongHandler(h func()) {
+	t.lock.Lock()
+	t.pongHandler = h
+	t.lock.Unlock()
+}
+
+// Transport writing to an event stream and reading messages posted to the session.
+type sseTransport struct {
+	httpInbound
+	// Response of the event stream.
+	w       http.ResponseWriter
+	flusher http.Flusher
+	// Serialises writes and prevents writing after the transport was closed.
+	writeLock sync.Mutex
+	closed    bool
+}
+
+func newSSETransport(w http.ResponseWriter, flusher http.Flusher) *sseTransport {
+	return &sseTransport{
+		httpInbound: newHTTPInbound(),
+		w:           w,
+		flusher:     flusher,
+	}
+}
+
+// Writes an event and flushes it to the client.
+func (t *sseTransport) writeEvent(event string, data []byte) error {
+	var buf bytes.Buffer
+	if event != "" {
+		buf.WriteString("event: " + sseEventNameReplacer.Replace(event) + "\n")
+	}
+	for _, line := range strings.Split(sseLineReplacer.Replace(string(data)), "\n") {
+		buf.WriteString("data: " + line + "\n")
+	}
+	buf.WriteString("\n")
+	return t.writeRaw(buf.Bytes())
+}
+
+// Writes to the event stream unless the transport was closed.
+func (t *sseTransport) writeRaw(data []byte) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	if t.closed {
+		return ErrTransportClosed
+	}
+	if _, err := t.w.Write(data); err != nil {
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+func (t *sseTransport) WriteFrame(mode int, data []byte) error {
+	return t.WriteEventFrame("", mode, data)
+}
+
+// WriteEventFrame writes the frame as event of the name, binary frames are base64 encoded.
+func (t *sseTransport) WriteEventFrame(event string, mode int, data []byte) error {
+	if mode == BinaryMode {
+		data = []byte(base64.StdEncoding.EncodeToString(data))
+	}
+	return t.writeEvent(event, data)
+}
+
+// WritePing writes a comment to keep the stream alive. Event streams cannot be answered,
+// so successfully writing is treated as pong.
+func (t *sseTransport) WritePing() error {
+	if err := t.writeRaw([]byte(": ping\n\n")); err != nil {
+		return err
+	}
+	t.pong()
+	return nil
+}
+
+func (t *sseTransport) WriteClose(code int, reason string) error {
+	return t.writeEvent(httpCloseEvent, closeEventData(code, reason))
+}
+
+// Close unblocks reading and waits for a pending write, afterwards nothing is written anymore.
+func (t *sseTransport) Close() error {
+	t.closeInbound()
+	t.writeLock.Lock()
+	t.closed = true
+	t.writeLock.Unlock()
+	return nil
+}
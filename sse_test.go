@@ -0,0 +1,122 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reads the next server-sent event and returns its name and data.
+func readSSE(t *testing.T, r *bufio.Reader) (string, string) {
+	t.Helper()
+	var event, data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event failed: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			data += line[len("data: "):]
+		}
+	}
+}
+
+func TestSSE(t *testing.T) {
+	router := NewRouter()
+	router.On("echo", func(conn *Connection, data *testMessage) {
+		conn.Emit("echo", data)
+	})
+	router.On("bye", func(conn *Connection) {
+		conn.CloseWithReason(4000, "Bye")
+	})
+	closed := make(chan bool, 1)
+	router.OnClose(func(conn *Connection) {
+		closed <- true
+	})
+	server := httptest.NewServer(http.HandlerFunc(NewSSE(router).Handler()))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("opening stream failed: %v", err)
+	}
+	defer res.Body.Close()
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+	events := bufio.NewReader(res.Body)
+	event, session := readSSE(t, events)
+	if event != "$session" || session == "" {
+		t.Fatalf("expected session event, received %q %q", event, session)
+	}
+	post := func(body string) int {
+		res, err := http.Post(server.URL+"?session="+session, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("posting failed: %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := post(`echo {"text":"hello"}`); status != 204 {
+		t.Fatalf("expected status 204, received %d", status)
+	}
+	if event, data := readSSE(t, events); event != "echo" || data != `echo {"text":"hello"}` {
+		t.Fatalf("unexpected event %q %q", event, data)
+	}
+	if status := post(strings.Repeat("x", 1000)); status != 413 {
+		t.Fatalf("expected status 413 for message exceeding limit, received %d", status)
+	}
+	post(`bye null`)
+	if event, data := readSSE(t, events); event != "$close" || data != `{"code":4000,"reason":"Bye"}` {
+		t.Fatalf("expected close event, received %q %q", event, data)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close callback not called")
+	}
+	if _, err := events.ReadString('\n'); err == nil {
+		t.Fatal("expected stream to end after close")
+	}
+	if status := post(`echo {}`); status != 404 {
+		t.Fatalf("expected status 404 for closed session, received %d", status)
+	}
+}
+
+func TestSSELineBreaks(t *testing.T) {
+	w := httptest.NewRecorder()
+	if err := newSSETransport(w, w).writeEvent("ec\rho\n", []byte("a\r\nb\rc\nd\r")); err != nil {
+		t.Fatalf("writing event failed: %v", err)
+	}
+	if expected := "event: echo\ndata: a\ndata: b\ndata: c\ndata: d\ndata: \n\n"; w.Body.String() != expected {
+		t.Fatalf("expected %q, written %q", expected, w.Body.String())
+	}
+}
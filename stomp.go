@@ -0,0 +1,668 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// STOMPSubprotocol is the WebSocket subprotocol name of STOMP 1.2.
+	STOMPSubprotocol = "v12.stomp"
+	// Client commands.
+	stompConnect     = "CONNECT"
+	stompStomp       = "STOMP"
+	stompSend        = "SEND"
+	stompSubscribe   = "SUBSCRIBE"
+	stompUnsubscribe = "UNSUBSCRIBE"
+	stompAck         = "ACK"
+	stompNack        = "NACK"
+	stompBegin       = "BEGIN"
+	stompCommit      = "COMMIT"
+	stompAbort       = "ABORT"
+	stompDisconnect  = "DISCONNECT"
+	// Server commands.
+	stompConnected = "CONNECTED"
+	stompMessage   = "MESSAGE"
+	stompReceipt   = "RECEIPT"
+	stompError     = "ERROR"
+	// Event names of commands other than SEND are prefixed with NUL, to not collide with the
+	// destinations of SEND frames. Destinations containing NUL are rejected for this reason.
+	stompCommandPrefix = "\x00"
+	// Event name of heart-beats.
+	stompHeartbeat = stompCommandPrefix + "HEARTBEAT"
+	// Default heart-beat intervals offered by the server.
+	stompSendHeartbeat    = 10 * time.Second
+	stompReceiveHeartbeat = 10 * time.Second
+)
+
+var (
+	stompHeaderEscaper   = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+	stompHeaderUnescaper = strings.NewReplacer("\\\\", "\\", "\\r", "\r", "\\n", "\n", "\\c", ":")
+)
+
+// STOMPFrame is a single frame of the STOMP protocol. Handlers taking interface{} as
+// data receive the frame of SEND commands directly.
+type STOMPFrame struct {
+	// Command of the frame, e.g. SEND.
+	Command string
+	// Headers of the frame, if a header is repeated only the first value is kept.
+	Headers map[string]string
+	// Body of the frame.
+	Body []byte
+}
+
+// Bytes serializes the frame. Headers are written in lexical order.
+func (f *STOMPFrame) Bytes() []byte {
+	escape := f.Command != stompConnect && f.Command != stompConnected
+	var buf bytes.Buffer
+	buf.WriteString(f.Command)
+	buf.WriteByte('\n')
+	keys := make([]string, 0, len(f.Headers))
+	for k := range f.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := f.Headers[k]
+		if escape {
+			k, v = stompHeaderEscaper.Replace(k), stompHeaderEscaper.Replace(v)
+		}
+		buf.WriteString(k)
+		buf.WriteByte(':')
+		buf.WriteString(v)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	buf.Write(f.Body)
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+// Parses a single frame, returns nil if the data only consists of heart-beats.
+func parseSTOMPFrame(data []byte) (*STOMPFrame, error) {
+	// Skip heart-beats preceding the frame.
+	for len(data) > 0 && (data[0] == '\n' || data[0] == '\r') {
+		data = data[1:]
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	readLine := func() (string, error) {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return "", errors.New("Unexpected end of STOMP frame.")
+		}
+		line := data[:i]
+		data = data[i+1:]
+		return strings.TrimSuffix(string(line), "\r"), nil
+	}
+	command, err := readLine()
+	if err != nil {
+		return nil, err
+	}
+	f := &STOMPFrame{
+		Command: command,
+		Headers: make(map[string]string),
+	}
+	escaped := command != stompConnect && command != stompConnected
+	for {
+		line, err := readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Malformed STOMP header " + line + ".")
+		}
+		k, v := kv[0], kv[1]
+		if escaped {
+			k, v = stompHeaderUnescaper.Replace(k), stompHeaderUnescaper.Replace(v)
+		}
+		if _, ok := f.Headers[k]; !ok { // Only the first occurrence counts.
+			f.Headers[k] = v
+		}
+	}
+	if cl, ok := f.Headers["content-length"]; ok {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 || n >= len(data) || data[n] != 0 {
+			return nil, errors.New("Invalid content-length of STOMP frame.")
+		}
+		f.Body = data[:n]
+	} else {
+		i := bytes.IndexByte(data, 0)
+		if i < 0 {
+			return nil, errors.New("STOMP frame is not NUL terminated.")
+		}
+		f.Body = data[:i]
+	}
+	return f, nil
+}
+
+// State of a single connection speaking STOMP.
+type stompSession struct {
+	// Flag whether the CONNECT frame was accepted.
+	connected bool
+	// Flag whether the connection is being closed.
+	closing bool
+	// Map of subscription IDs to their destinations.
+	subscriptions map[string]string
+	// Time the last frame or heart-beat was received.
+	lastSeen time.Time
+	// Closed to stop heart-beating.
+	stop chan bool
+}
+
+// STOMP adapts a router to STOMP 1.2 as used by stomp.js. SEND frames are dispatched
+// to the handlers registered with the destination as event name, subscriptions are
+// rooms of the associated room manager keyed by destination and every emit to such a
+// room is delivered as MESSAGE frame. The body of SEND frames is unmarshalled as JSON,
+// unless the handler accepts *[]byte or *string.
+type STOMP struct {
+	// Router the adapter is installed on.
+	router *Router
+	// Room manager holding one room per destination.
+	rooms *RoomManager
+	// Function verifying CONNECT frames.
+	connectFunc func(*Connection, *STOMPFrame) bool
+	// Heart-beat intervals offered by the server.
+	sendHeartbeat    time.Duration
+	receiveHeartbeat time.Duration
+	// Counter of message IDs.
+	messageID uint64
+	// State of active connections.
+	sessions map[*Connection]*stompSession
+	// Guards sessions.
+	lock sync.Mutex
+}
+
+// NewSTOMP installs the STOMP adapter on the router and returns it. The protocol of the
+// router is replaced and the room manager is used to manage the subscribers of destinations.
+func NewSTOMP(router *Router, rm *RoomManager) *STOMP {
+	s := &STOMP{
+		router:           router,
+		rooms:            rm,
+		connectFunc:      func(*Connection, *STOMPFrame) bool { return true }, // Login always allowed.
+		sendHeartbeat:    stompSendHeartbeat,
+		receiveHeartbeat: stompReceiveHeartbeat,
+		sessions:         make(map[*Connection]*stompSession),
+	}
+	router.SetProtocol(&stompProtocol{s})
+	router.callbacks[stompCommandPrefix+stompConnect] = s.handleConnect
+	router.callbacks[stompCommandPrefix+stompStomp] = s.handleConnect
+	router.callbacks[stompCommandPrefix+stompSubscribe] = s.handleSubscribe
+	router.callbacks[stompCommandPrefix+stompUnsubscribe] = s.handleUnsubscribe
+	router.callbacks[stompCommandPrefix+stompDisconnect] = s.handleDisconnect
+	router.callbacks[stompCommandPrefix+stompBegin] = s.handleTransaction
+	router.callbacks[stompCommandPrefix+stompCommit] = s.handleTransaction
+	router.callbacks[stompCommandPrefix+stompAbort] = s.handleTransaction
+	router.callbacks[stompCommandPrefix+stompAck] = func(*Connection, interface{}) {}
+	router.callbacks[stompCommandPrefix+stompNack] = func(*Connection, interface{}) {}
+	router.connectHooks = append(router.connectHooks, s.connected)
+	router.closeHooks = append(router.closeHooks, s.closed)
+	router.middleware = append(router.middleware, s.intercept)
+	return s
+}
+
+// OnConnect sets the callback verifying CONNECT frames, e.g. by their login and passcode headers.
+// If the function returns false an ERROR frame is send and the connection is closed.
+func (s *STOMP) OnConnect(callback func(*Connection, *STOMPFrame) bool) {
+	s.connectFunc = callback
+}
+
+// SetHeartbeat sets the heart-beat intervals the server offers to send and wants
+// to receive. A zero duration disables the respective direction.
+func (s *STOMP) SetHeartbeat(send, receive time.Duration) {
+	s.sendHeartbeat = send
+	s.receiveHeartbeat = receive
+}
+
+// Publish sends data as MESSAGE frame to all subscribers of the destination. It is
+// the same as emitting to the room of the destination using the destination as event.
+func (s *STOMP) Publish(destination string, data interface{}) {
+	s.rooms.Emit(destination, destination, data)
+}
+
+// Returns the session of the connection or nil if the connection is unknown.
+func (s *STOMP) session(conn *Connection) *stompSession {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sessions[conn]
+}
+
+func (s *STOMP) connected(conn *Connection, r *http.Request) {
+	s.lock.Lock()
+	s.sessions[conn] = &stompSession{
+		subscriptions: make(map[string]string),
+		lastSeen:      time.Now(),
+		stop:          make(chan bool),
+	}
+	s.lock.Unlock()
+}
+
+func (s *STOMP) closed(conn *Connection) {
+	s.lock.Lock()
+	session, ok := s.sessions[conn]
+	delete(s.sessions, conn)
+	s.lock.Unlock()
+	if !ok {
+		return
+	}
+	close(session.stop)
+	left := make(map[string]bool)
+	for _, destination := range session.subscriptions {
+		if !left[destination] {
+			left[destination] = true
+			s.rooms.Leave(destination, conn)
+		}
+	}
+}
+
+// Middleware tracking activity, rejecting frames of unconnected sessions and sending receipts.
+func (s *STOMP) intercept(next dispatchFunc) dispatchFunc {
+	return func(conn *Connection, name string, data interface{}) {
+		session := s.session(conn)
+		if session == nil {
+			return
+		}
+		s.lock.Lock()
+		session.lastSeen = time.Now()
+		connected, closing := session.connected, session.closing
+		s.lock.Unlock()
+		frame, _ := data.(*STOMPFrame)
+		if frame == nil || closing { // Heart-beat
+			return
+		}
+		if !connected && frame.Command != stompConnect && frame.Command != stompStomp {
+			s.fail(conn, frame, "Not connected")
+			return
+		}
+		next(conn, name, data)
+		receipt, ok := frame.Headers["receipt"]
+		if !ok || frame.Command == stompDisconnect {
+			return
+		}
+		s.lock.Lock()
+		closing = session.closing
+		s.lock.Unlock()
+		if !closing {
+			s.receipt(conn, receipt)
+		}
+	}
+}
+
+// Sends a RECEIPT frame without blocking the read pump. Clients wait for requested receipts,
+// so the connection is closed instead if the outgoing buffer is full.
+func (s *STOMP) receipt(conn *Connection, id string) {
+	if !conn.trySend(&message{
+		event: stompReceipt,
+		data:  &STOMPFrame{Command: stompReceipt, Headers: map[string]string{"receipt-id": id}},
+	}) {
+		conn.Close()
+	}
+}
+
+// Sends an ERROR frame and closes the connection.
+func (s *STOMP) fail(conn *Connection, frame *STOMPFrame, msg string) {
+	if session := s.session(conn); session != nil {
+		s.lock.Lock()
+		session.closing = true
+		s.lock.Unlock()
+	}
+	headers := map[string]string{"message": msg}
+	if frame != nil {
+		if receipt, ok := frame.Headers["receipt"]; ok {
+			headers["receipt-id"] = receipt
+		}
+	}
+	conn.trySend(&message{
+		event: stompError,
+		data:  &STOMPFrame{Command: stompError, Headers: headers},
+	})
+	conn.Close()
+}
+
+func (s *STOMP) handleConnect(conn *Connection, data interface{}) {
+	frame := data.(*STOMPFrame)
+	session := s.session(conn)
+	s.lock.Lock()
+	connected := session.connected
+	s.lock.Unlock()
+	if connected {
+		s.fail(conn, frame, "Already connected")
+		return
+	}
+	supported := false
+	for _, v := range strings.Split(frame.Headers["accept-version"], ",") {
+		if strings.TrimSpace(v) == "1.2" {
+			supported = true
+		}
+	}
+	if !supported {
+		s.fail(conn, frame, "Supported protocol versions are 1.2")
+		return
+	}
+	if !s.connectFunc(conn, frame) {
+		s.fail(conn, frame, "Authentication failed")
+		return
+	}
+
+	// Negotiate heart-beats, a side only heart-beats if both sides agree.
+	var cx, cy time.Duration
+	if hb := strings.Split(frame.Headers["heart-beat"], ","); len(hb) == 2 {
+		x, errX := strconv.Atoi(strings.TrimSpace(hb[0]))
+		y, errY := strconv.Atoi(strings.TrimSpace(hb[1]))
+		if errX != nil || errY != nil || x < 0 || y < 0 {
+			s.fail(conn, frame, "Invalid heart-beat header")
+			return
+		}
+		cx, cy = time.Duration(x)*time.Millisecond, time.Duration(y)*time.Millisecond
+	}
+	outgoing, incoming := time.Duration(0), time.Duration(0)
+	if s.sendHeartbeat > 0 && cy > 0 {
+		outgoing = maxDuration(s.sendHeartbeat, cy)
+	}
+	if s.receiveHeartbeat > 0 && cx > 0 {
+		incoming = maxDuration(s.receiveHeartbeat, cx)
+	}
+
+	s.lock.Lock()
+	session.connected = true
+	s.lock.Unlock()
+	conn.Emit(stompConnected, &STOMPFrame{
+		Command: stompConnected,
+		Headers: map[string]string{
+			"version":    "1.2",
+			"heart-beat": strconv.FormatInt(int64(s.sendHeartbeat/time.Millisecond), 10) + "," + strconv.FormatInt(int64(s.receiveHeartbeat/time.Millisecond), 10),
+			"server":     "golem",
+		},
+	})
+	if outgoing > 0 || incoming > 0 {
+		go s.heartbeat(conn, session, outgoing, incoming)
+	}
+}
+
+// Sends heart-beats and closes the connection if the client stops sending them.
+func (s *STOMP) heartbeat(conn *Connection, session *stompSession, outgoing, incoming time.Duration) {
+	var send, check <-chan time.Time
+	if outgoing > 0 {
+		ticker := time.NewTicker(outgoing)
+		defer ticker.Stop()
+		send = ticker.C
+	}
+	if incoming > 0 {
+		ticker := time.NewTicker(incoming)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	for {
+		select {
+		case <-send:
+			conn.trySend(&message{event: stompHeartbeat})
+		case <-check:
+			s.lock.Lock()
+			idle := time.Since(session.lastSeen)
+			s.lock.Unlock()
+			if idle > 2*incoming { // Tolerate delays up to a whole interval.
+				conn.Close()
+				return
+			}
+		case <-session.stop:
+			return
+		}
+	}
+}
+
+func (s *STOMP) handleSubscribe(conn *Connection, data interface{}) {
+	frame := data.(*STOMPFrame)
+	session := s.session(conn)
+	destination, id := frame.Headers["destination"], frame.Headers["id"]
+	if !validSTOMPDestination(destination) || id == "" {
+		s.fail(conn, frame, "SUBSCRIBE requires valid destination and id headers")
+		return
+	}
+	if ack, ok := frame.Headers["ack"]; ok && ack != "auto" {
+		s.fail(conn, frame, "Only ack mode auto is supported")
+		return
+	}
+	s.lock.Lock()
+	_, exists := session.subscriptions[id]
+	joined := false
+	for _, d := range session.subscriptions {
+		if d == destination {
+			joined = true
+			break
+		}
+	}
+	s.lock.Unlock()
+	if exists {
+		s.fail(conn, frame, "Subscription "+id+" already exists")
+		return
+	}
+	if !joined && !s.rooms.TryJoin(destination, conn) {
+		s.fail(conn, frame, "Not authorized to subscribe to "+destination)
+		return
+	}
+	s.lock.Lock()
+	session.subscriptions[id] = destination
+	s.lock.Unlock()
+}
+
+func (s *STOMP) handleUnsubscribe(conn *Connection, data interface{}) {
+	frame := data.(*STOMPFrame)
+	session := s.session(conn)
+	id := frame.Headers["id"]
+	s.lock.Lock()
+	destination, ok := session.subscriptions[id]
+	delete(session.subscriptions, id)
+	stillJoined := false
+	for _, d := range session.subscriptions {
+		if d == destination {
+			stillJoined = true
+			break
+		}
+	}
+	s.lock.Unlock()
+	if !ok {
+		s.fail(conn, frame, "Unknown subscription "+id)
+		return
+	}
+	if !stillJoined {
+		s.rooms.Leave(destination, conn)
+	}
+}
+
+func (s *STOMP) handleTransaction(conn *Connection, data interface{}) {
+	s.fail(conn, data.(*STOMPFrame), "Transactions are not supported")
+}
+
+func (s *STOMP) handleDisconnect(conn *Connection, data interface{}) {
+	frame := data.(*STOMPFrame)
+	session := s.session(conn)
+	s.lock.Lock()
+	session.closing = true
+	s.lock.Unlock()
+	if receipt, ok := frame.Headers["receipt"]; ok {
+		s.receipt(conn, receipt)
+	}
+	conn.Close()
+}
+
+// Returns the subscription IDs of the connection for the destination.
+func (s *STOMP) subscribers(conn *Connection, destination string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[conn]
+	if !ok {
+		return nil
+	}
+	ids := make([]string, 0, 1)
+	for id, d := range session.subscriptions {
+		if d == destination {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Returns the larger duration.
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// stompProtocol implements the framing of STOMP. SEND frames are unpacked using their
+// destination as event name, all other commands are handled by the adapter.
+type stompProtocol struct {
+	stomp *STOMP
+}
+
+// Unpack parses the frame and returns the event name and the frame as interstage product.
+func (_ *stompProtocol) Unpack(data []byte) (string, interface{}, error) {
+	frame, err := parseSTOMPFrame(data)
+	if err != nil {
+		return "", nil, err
+	}
+	if frame == nil {
+		return stompHeartbeat, nil, nil
+	}
+	if frame.Command == stompSend {
+		destination := frame.Headers["destination"]
+		if !validSTOMPDestination(destination) {
+			return "", nil, errors.New("SEND frame without valid destination.")
+		}
+		return destination, frame, nil
+	}
+	return stompCommandPrefix + frame.Command, frame, nil
+}
+
+// Unmarshals the body of the frame into the requested structure. Pointers to byte
+// slices and strings receive the raw body, everything else is unmarshalled as JSON.
+func (_ *stompProtocol) Unmarshal(data interface{}, typePtr interface{}) error {
+	frame := data.(*STOMPFrame)
+	switch ptr := typePtr.(type) {
+	case *[]byte:
+		*ptr = frame.Body
+		return nil
+	case *string:
+		*ptr = string(frame.Body)
+		return nil
+	}
+	return json.Unmarshal(frame.Body, typePtr)
+}
+
+// Packs frames as they are, heart-beats as EOL and any other data as MESSAGE frame without
+// subscription. Byte slices and strings are used as body directly, everything else is
+// marshalled as JSON.
+func (_ *stompProtocol) MarshalAndPack(name string, data interface{}) ([]byte, error) {
+	if name == stompHeartbeat {
+		return []byte{'\n'}, nil
+	}
+	if frame, ok := data.(*STOMPFrame); ok {
+		return frame.Bytes(), nil
+	}
+	frame, err := newSTOMPMessage(name, data)
+	if err != nil {
+		return nil, err
+	}
+	return frame.Bytes(), nil
+}
+
+// Packs one MESSAGE frame for every subscription of the receiving connection to the destination.
+// MESSAGE frames require the subscription header, so messages for connections without a
+// subscription to the destination are dropped.
+func (p *stompProtocol) MarshalAndPackFor(conn *Connection, name string, data interface{}) ([][]byte, error) {
+	if _, ok := data.(*STOMPFrame); ok || name == stompHeartbeat {
+		frame, err := p.MarshalAndPack(name, data)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{frame}, nil
+	}
+	ids := p.stomp.subscribers(conn, name)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	frame, err := newSTOMPMessage(name, data)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		frame.Headers["subscription"] = id
+		frame.Headers["message-id"] = strconv.FormatUint(atomic.AddUint64(&p.stomp.messageID, 1), 10)
+		frames = append(frames, frame.Bytes())
+	}
+	return frames, nil
+}
+
+// Returns whether the destination is not empty and does not contain NUL, which is reserved for
+// the event names of commands.
+func validSTOMPDestination(destination string) bool {
+	return destination != "" && !strings.ContainsRune(destination, 0)
+}
+
+// Creates a MESSAGE frame for the destination.
+func newSTOMPMessage(destination string, data interface{}) (*STOMPFrame, error) {
+	frame := &STOMPFrame{
+		Command: stompMessage,
+		Headers: map[string]string{"destination": destination},
+	}
+	switch d := data.(type) {
+	case []byte:
+		frame.Body = d
+		frame.Headers["content-type"] = "application/octet-stream"
+	case string:
+		frame.Body = []byte(d)
+		frame.Headers["content-type"] = "text/plain;charset=utf-8"
+	default:
+		body, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		frame.Body = body
+		frame.Headers["content-type"] = "application/json;charset=utf-8"
+	}
+	frame.Headers["content-length"] = strconv.Itoa(len(frame.Body))
+	return frame, nil
+}
+
+// Return TextMode because stomp.js transmits frames using the text mode of WebSockets.
+func (_ *stompProtocol) GetReadMode() int {
+	return TextMode
+}
+
+// Return TextMode because stomp.js transmits frames using the text mode of WebSockets.
+func (_ *stompProtocol) GetWriteMode() int {
+	return TextMode
+}
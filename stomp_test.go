@@ -0,0 +1,119 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"github.com/gorilla/websocket"
+	"strings"
+	"testing"
+)
+
+// Returns a client socket connected to the STOMP broker of the router.
+func connectSTOMP(t *testing.T, router *Router) *websocket.Conn {
+	socket := dialTest(t, router.Handler(), "/")
+	writeTest(t, socket, "CONNECT\naccept-version:1.2\nheart-beat:0,0\n\n\x00")
+	if connected := readTest(t, socket); !strings.HasPrefix(connected, "CONNECTED\n") || !strings.Contains(connected, "version:1.2\n") {
+		t.Fatalf("expected CONNECTED, received %q", connected)
+	}
+	return socket
+}
+
+func TestSTOMPSubscribeSend(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	s := NewSTOMP(router, rm)
+	router.On("/app/chat", func(conn *Connection, data *testMessage) {
+		s.Publish("/topic/chat", data)
+	})
+	socket := connectSTOMP(t, router)
+
+	writeTest(t, socket, "SUBSCRIBE\nid:sub-0\ndestination:/topic/chat\nreceipt:r1\n\n\x00")
+	if receipt := readTest(t, socket); receipt != "RECEIPT\nreceipt-id:r1\n\n\x00" {
+		t.Fatalf("expected RECEIPT, received %q", receipt)
+	}
+	writeTest(t, socket, "SEND\ndestination:/app/chat\ncontent-type:application/json\n\n{\"text\":\"hi\"}\x00")
+	msg := readTest(t, socket)
+	if !strings.HasPrefix(msg, "MESSAGE\n") || !strings.Contains(msg, "destination:/topic/chat\n") ||
+		!strings.Contains(msg, "subscription:sub-0\n") || !strings.HasSuffix(msg, "\n\n{\"text\":\"hi\"}\x00") {
+		t.Fatalf("unexpected MESSAGE %q", msg)
+	}
+}
+
+func TestSTOMPSubscriptionDenied(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	rm.SetRoomPolicy("/topic/secret", denyAll)
+	NewSTOMP(router, rm)
+	socket := connectSTOMP(t, router)
+
+	writeTest(t, socket, "SUBSCRIBE\nid:sub-0\ndestination:/topic/secret\n\n\x00")
+	if msg := readTest(t, socket); !strings.HasPrefix(msg, "ERROR\n") || !strings.Contains(msg, "message:Not authorized to subscribe to /topic/secret\n") {
+		t.Fatalf("expected ERROR, received %q", msg)
+	}
+}
+
+func TestSTOMPDuplicateSubscription(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	NewSTOMP(router, rm)
+	socket := connectSTOMP(t, router)
+
+	writeTest(t, socket, "SUBSCRIBE\nid:sub-0\ndestination:/topic/a\n\n\x00")
+	writeTest(t, socket, "SUBSCRIBE\nid:sub-0\ndestination:/topic/b\n\n\x00")
+	if msg := readTest(t, socket); !strings.Contains(msg, "message:Subscription sub-0 already exists\n") {
+		t.Fatalf("expected ERROR, received %q", msg)
+	}
+}
+
+func TestSTOMPDropsMessagesWithoutSubscription(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	NewSTOMP(router, rm)
+	router.On("/app/direct", func(conn *Connection, data *testMessage) {
+		conn.Emit("/topic/direct", data)
+	})
+	socket := connectSTOMP(t, router)
+
+	writeTest(t, socket, "SEND\ndestination:/app/direct\nreceipt:r1\n\n{\"text\":\"hi\"}\x00")
+	if msg := readTest(t, socket); msg != "RECEIPT\nreceipt-id:r1\n\n\x00" {
+		t.Fatalf("expected only RECEIPT, received %q", msg)
+	}
+}
+
+func TestSTOMPRejectsCommandDestinations(t *testing.T) {
+	router := NewRouter()
+	rm := NewRoomManager()
+	defer rm.Stop()
+	NewSTOMP(router, rm)
+	socket := connectSTOMP(t, router)
+
+	writeTest(t, socket, "SEND\ndestination:\x00DISCONNECT\nreceipt:r1\n\n\x00")
+	writeTest(t, socket, "SUBSCRIBE\nid:sub-0\ndestination:/topic/a\nreceipt:r2\n\n\x00")
+	if msg := readTest(t, socket); msg != "RECEIPT\nreceipt-id:r2\n\n\x00" {
+		t.Fatalf("expected SEND to command destination to be dropped, received %q", msg)
+	}
+	writeTest(t, socket, "SUBSCRIBE\nid:sub-1\ndestination:/topic/\x00b\n\n\x00")
+	if msg := readTest(t, socket); !strings.HasPrefix(msg, "ERROR\n") {
+		t.Fatalf("expected ERROR for destination containing NUL, received %q", msg)
+	}
+}
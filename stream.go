@@ -0,0 +1,445 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// Internal events of streams. Open, data and close are send by the writing side,
+	// ack and cancel by the reading side, the ID always belongs to the writing side.
+	streamOpenEvent   = "$stream:open"
+	streamDataEvent   = "$stream:data"
+	streamAckEvent    = "$stream:ack"
+	streamCloseEvent  = "$stream:close"
+	streamCancelEvent = "$stream:cancel"
+	// Maximum size of chunks send to the client.
+	streamChunkSize = 16 * 1024
+	// Default flow control window of streams.
+	streamWindowSize = 64 * 1024
+)
+
+var (
+	// ErrStreamCanceled is returned if the stream was canceled by the other side or the
+	// connection was closed.
+	ErrStreamCanceled = errors.New("Stream was canceled.")
+	// ErrStreamClosed is returned when writing to a closed stream.
+	ErrStreamClosed = errors.New("Stream is closed.")
+)
+
+// Message announcing a new stream.
+type streamOpen struct {
+	ID    uint64 `json:"id"`
+	Event string `json:"event"`
+}
+
+// Message carrying a chunk of a stream.
+type streamChunk struct {
+	ID   uint64 `json:"id"`
+	Data []byte `json:"data"`
+}
+
+// Message granting the writer additional window.
+type streamAck struct {
+	ID   uint64 `json:"id"`
+	Size int64  `json:"size"`
+}
+
+// Message closing or canceling a stream.
+type streamEnd struct {
+	ID uint64 `json:"id"`
+}
+
+// Streams of a single connection.
+type streamSet struct {
+	// Last ID used for outgoing streams.
+	lastID uint64
+	// Streams written by the server.
+	outgoing map[uint64]*Stream
+	// Streams written by the client.
+	incoming map[uint64]*streamReader
+	// Cancel functions of active streaming responses by request ID.
+	replies map[uint64]context.CancelFunc
+	// Guards all fields.
+	lock sync.Mutex
+}
+
+// Create empty set of streams.
+func newStreamSet() *streamSet {
+	return &streamSet{
+		outgoing: make(map[uint64]*Stream),
+		incoming: make(map[uint64]*streamReader),
+		replies:  make(map[uint64]context.CancelFunc),
+	}
+}
+
+// Cancel all streams, because the connection was closed.
+func (set *streamSet) cancelAll() {
+	set.lock.Lock()
+	outgoing, incoming, replies := set.outgoing, set.incoming, set.replies
+	set.outgoing = make(map[uint64]*Stream)
+	set.incoming = make(map[uint64]*streamReader)
+	set.replies = make(map[uint64]context.CancelFunc)
+	set.lock.Unlock()
+	for _, cancel := range replies {
+		cancel()
+	}
+	for _, s := range outgoing {
+		s.cancel()
+	}
+	for _, r := range incoming {
+		r.cancel()
+	}
+}
+
+// Stream is a stream of data written to the client, that is split into chunks and delivered
+// as events interleaved with all other events of the connection. The client grants a window
+// of bytes it is willing to buffer, writing blocks while the window is exhausted. Therefore
+// a stream should not be written by an event handler directly, but from its own goroutine.
+type Stream struct {
+	// Connection the stream belongs to.
+	conn *Connection
+	// ID of the stream.
+	id uint64
+	// Remaining window.
+	credit int64
+	// Flag whether the stream was closed.
+	closed bool
+	// Error ending the stream.
+	err error
+	// Guards all fields and signals changes of credit.
+	lock sync.Mutex
+	cond *sync.Cond
+}
+
+// OpenStream opens a stream of data to the client, which is delivered to the handler of the
+// specified event on the client side. The returned stream needs to be closed after writing.
+func (conn *Connection) OpenStream(event string) (io.WriteCloser, error) {
+	s := &Stream{
+		conn:   conn,
+		credit: conn.router.streamWindow,
+	}
+	s.cond = sync.NewCond(&s.lock)
+	conn.streams.lock.Lock()
+	conn.streams.lastID++
+	s.id = conn.streams.lastID
+	conn.streams.outgoing[s.id] = s
+	conn.streams.lock.Unlock()
+	if !conn.queue(&message{event: streamOpenEvent, data: &streamOpen{ID: s.id, Event: event}}) {
+		s.remove()
+		return nil, ErrStreamCanceled
+	}
+	return s, nil
+}
+
+// Write splits the data into chunks and queues them once the window allows it.
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		s.lock.Lock()
+		for s.credit <= 0 && !s.closed && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			s.lock.Unlock()
+			return written, s.err
+		}
+		if s.closed {
+			s.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+		n := int64(len(p))
+		if n > streamChunkSize {
+			n = streamChunkSize
+		}
+		if n > s.credit {
+			n = s.credit
+		}
+		s.credit -= n
+		s.lock.Unlock()
+
+		// Copy chunk, because it is marshalled after Write returned.
+		chunk := make([]byte, n)
+		copy(chunk, p[:n])
+		if !s.conn.queue(&message{event: streamDataEvent, data: s.conn.router.streamChunk(s.id, chunk)}) {
+			s.cancel()
+			return written, ErrStreamCanceled
+		}
+		written += int(n)
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close ends the stream, the client reads EOF after all chunks.
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	if s.closed || s.err != nil {
+		err := s.err
+		s.lock.Unlock()
+		return err
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	s.remove()
+	if !s.conn.queue(&message{event: streamCloseEvent, data: &streamEnd{ID: s.id}}) {
+		return ErrStreamCanceled
+	}
+	return nil
+}
+
+// Grant additional window.
+func (s *Stream) grant(size int64) {
+	s.lock.Lock()
+	s.credit += size
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// Fail pending and future writes.
+func (s *Stream) cancel() {
+	s.lock.Lock()
+	if s.err == nil {
+		s.err = ErrStreamCanceled
+	}
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// Remove stream from connection.
+func (s *Stream) remove() {
+	s.conn.streams.lock.Lock()
+	delete(s.conn.streams.outgoing, s.id)
+	s.conn.streams.lock.Unlock()
+}
+
+// Reading side of a stream written by the client.
+type streamReader struct {
+	// Connection the stream belongs to.
+	conn *Connection
+	// ID of the stream assigned by the client.
+	id uint64
+	// Received chunks, that were not read yet.
+	chunks [][]byte
+	// Number of buffered bytes.
+	buffered int64
+	// Number of read bytes, that were not acknowledged yet.
+	consumed int64
+	// Flag whether the client closed the stream.
+	eof bool
+	// Error ending the stream.
+	err error
+	// Guards all fields and signals new data.
+	lock sync.Mutex
+	cond *sync.Cond
+}
+
+// Read blocks until data is available, the stream was closed or canceled.
+func (r *streamReader) Read(p []byte) (int, error) {
+	r.lock.Lock()
+	for len(r.chunks) == 0 && !r.eof && r.err == nil {
+		r.cond.Wait()
+	}
+	if r.err != nil {
+		r.lock.Unlock()
+		return 0, r.err
+	}
+	if len(r.chunks) == 0 {
+		r.lock.Unlock()
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	if n == len(r.chunks[0]) {
+		r.chunks = r.chunks[1:]
+	} else {
+		r.chunks[0] = r.chunks[0][n:]
+	}
+	r.buffered -= int64(n)
+	r.consumed += int64(n)
+	ack := int64(0)
+	if r.consumed >= r.conn.router.streamWindow/2 { // Acknowledge in batches.
+		ack = r.consumed
+		r.consumed = 0
+	}
+	r.lock.Unlock()
+	if ack > 0 {
+		r.conn.queue(&message{event: streamAckEvent, data: &streamAck{ID: r.id, Size: ack}})
+	}
+	return n, nil
+}
+
+// Buffer chunk, returns false if the client exceeded the window.
+func (r *streamReader) push(chunk []byte) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.eof || r.err != nil {
+		return true
+	}
+	r.buffered += int64(len(chunk))
+	if r.buffered > r.conn.router.streamWindow {
+		return false
+	}
+	r.chunks = append(r.chunks, chunk)
+	r.cond.Broadcast()
+	return true
+}
+
+// Mark end of stream.
+func (r *streamReader) close() {
+	r.lock.Lock()
+	r.eof = true
+	r.cond.Broadcast()
+	r.lock.Unlock()
+}
+
+// Fail pending and future reads.
+func (r *streamReader) cancel() {
+	r.lock.Lock()
+	if r.err == nil {
+		r.err = ErrStreamCanceled
+	}
+	r.cond.Broadcast()
+	r.lock.Unlock()
+}
+
+// Returns the message carrying a chunk, packed natively if the protocol implements
+// StreamProtocol.
+func (router *Router) streamChunk(id uint64, chunk []byte) interface{} {
+	if p, ok := router.protocol.(StreamProtocol); ok {
+		return p.PackChunk(id, chunk)
+	}
+	return &streamChunk{ID: id, Data: chunk}
+}
+
+// Start handler of stream opened by the client in its own goroutine. Only events, whose callbacks
+// take io.Reader, accept streams. The reader is dispatched like any other message, so policies of
+// the event apply and the span of the handler continues the trace of the opening message.
+func (router *Router) handleStreamOpen(conn *Connection, data interface{}) {
+	open := &streamOpen{}
+	if router.protocol.Unmarshal(data, open) != nil {
+		return
+	}
+	if !router.streamEvents[open.Event] {
+		conn.trySend(&message{event: streamCancelEvent, data: &streamEnd{ID: open.ID}})
+		return
+	}
+	r := &streamReader{
+		conn: conn,
+		id:   open.ID,
+	}
+	r.cond = sync.NewCond(&r.lock)
+	conn.streams.lock.Lock()
+	_, exists := conn.streams.incoming[open.ID]
+	if !exists {
+		conn.streams.incoming[open.ID] = r
+	}
+	conn.streams.lock.Unlock()
+	if exists {
+		conn.trySend(&message{event: streamCancelEvent, data: &streamEnd{ID: open.ID}})
+		return
+	}
+	traceParent := traceParentOf(conn.Context())
+	go func() {
+		router.traceHandle(conn, open.Event, traceParent, 0, r)
+		// Cancel the stream if the handler returned before reading everything.
+		conn.streams.lock.Lock()
+		_, active := conn.streams.incoming[open.ID]
+		delete(conn.streams.incoming, open.ID)
+		conn.streams.lock.Unlock()
+		r.lock.Lock()
+		done := r.eof && len(r.chunks) == 0
+		r.lock.Unlock()
+		if active && !done {
+			r.cancel()
+			conn.trySend(&message{event: streamCancelEvent, data: &streamEnd{ID: open.ID}})
+		}
+	}()
+}
+
+// Returns incoming stream by ID or nil.
+func (router *Router) incomingStream(conn *Connection, id uint64) *streamReader {
+	conn.streams.lock.Lock()
+	defer conn.streams.lock.Unlock()
+	return conn.streams.incoming[id]
+}
+
+// Returns outgoing stream by ID or nil.
+func (router *Router) outgoingStream(conn *Connection, id uint64) *Stream {
+	conn.streams.lock.Lock()
+	defer conn.streams.lock.Unlock()
+	return conn.streams.outgoing[id]
+}
+
+func (router *Router) handleStreamData(conn *Connection, data interface{}) {
+	chunk := &streamChunk{}
+	native := false
+	if p, ok := router.protocol.(StreamProtocol); ok {
+		chunk.ID, chunk.Data, native = p.UnpackChunk(data)
+	}
+	if !native && router.protocol.Unmarshal(data, chunk) != nil {
+		return
+	}
+	r := router.incomingStream(conn, chunk.ID)
+	if r == nil {
+		return
+	}
+	if !r.push(chunk.Data) { // Window exceeded.
+		conn.streams.lock.Lock()
+		delete(conn.streams.incoming, chunk.ID)
+		conn.streams.lock.Unlock()
+		r.cancel()
+		conn.trySend(&message{event: streamCancelEvent, data: &streamEnd{ID: chunk.ID}})
+	}
+}
+
+func (router *Router) handleStreamAck(conn *Connection, data interface{}) {
+	ack := &streamAck{}
+	if router.protocol.Unmarshal(data, ack) != nil || ack.Size <= 0 {
+		return
+	}
+	if s := router.outgoingStream(conn, ack.ID); s != nil {
+		s.grant(ack.Size)
+	}
+}
+
+func (router *Router) handleStreamClose(conn *Connection, data interface{}) {
+	end := &streamEnd{}
+	if router.protocol.Unmarshal(data, end) != nil {
+		return
+	}
+	if r := router.incomingStream(conn, end.ID); r != nil {
+		r.close()
+	}
+}
+
+func (router *Router) handleStreamCancel(conn *Connection, data interface{}) {
+	end := &streamEnd{}
+	if router.protocol.Unmarshal(data, end) != nil {
+		return
+	}
+	if s := router.outgoingStream(conn, end.ID); s != nil {
+		s.remove()
+		s.cancel()
+	}
+}
@@ -0,0 +1,163 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"encoding/json"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamUpload(t *testing.T) {
+	router := NewRouter()
+	uploaded := make(chan string, 1)
+	router.On("upload", func(conn *Connection, r io.Reader) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("reading upload failed: %v", err)
+		}
+		uploaded <- string(data)
+	})
+	socket := dialTest(t, router.Handler(), "/")
+
+	writeTest(t, socket, `$stream:open {"id":1,"event":"upload"}`)
+	writeTest(t, socket, `$stream:data {"id":1,"data":"aGVsbG8="}`)
+	writeTest(t, socket, `$stream:data {"id":1,"data":"IHdvcmxk"}`)
+	writeTest(t, socket, `$stream:close {"id":1}`)
+	select {
+	case data := <-uploaded:
+		if data != "hello world" {
+			t.Fatalf("expected hello world, received %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("upload not received")
+	}
+}
+
+func TestStreamDownload(t *testing.T) {
+	router := NewRouter()
+	router.SetMaxMessageSize(1 << 20)
+	size := 3*streamWindowSize + 100
+	router.On("download", func(conn *Connection) {
+		go func() {
+			w, err := conn.OpenStream("file")
+			if err != nil {
+				t.Errorf("opening stream failed: %v", err)
+				return
+			}
+			w.Write([]byte(strings.Repeat("x", size)))
+			w.Close()
+		}()
+	})
+	socket := dialTest(t, router.Handler(), "/")
+
+	writeTest(t, socket, `download null`)
+	if msg := readTest(t, socket); msg != `$stream:open {"id":1,"event":"file"}` {
+		t.Fatalf("expected stream to be opened, received %q", msg)
+	}
+	total := 0
+	for {
+		msg := readTest(t, socket)
+		if msg == `$stream:close {"id":1}` {
+			break
+		}
+		var chunk streamChunk
+		if !strings.HasPrefix(msg, streamDataEvent+" ") || json.Unmarshal([]byte(msg[len(streamDataEvent)+1:]), &chunk) != nil {
+			t.Fatalf("expected chunk, received %q", msg)
+		}
+		if len(chunk.Data) > streamChunkSize {
+			t.Fatalf("chunk of %d bytes exceeds chunk size", len(chunk.Data))
+		}
+		total += len(chunk.Data)
+		// Without acknowledgements the writer blocks once the window is exhausted.
+		writeTest(t, socket, `$stream:ack {"id":1,"size":`+strconv.Itoa(len(chunk.Data))+`}`)
+	}
+	if total != size {
+		t.Fatalf("expected %d bytes, received %d", size, total)
+	}
+}
+
+func TestStreamOpenRequiresReader(t *testing.T) {
+	router := NewRouter()
+	router.On("echo", func(conn *Connection, data *testMessage) {
+		conn.Emit("echo", data)
+	})
+	socket := dialTest(t, router.Handler(), "/")
+
+	writeTest(t, socket, `$stream:open {"id":1,"event":"echo"}`)
+	if answer := readTest(t, socket); answer != `$stream:cancel {"id":1}` {
+		t.Fatalf("expected stream to be canceled, received %q", answer)
+	}
+	writeTest(t, socket, `echo {"text":"hi"}`)
+	if answer := readTest(t, socket); answer != `echo {"text":"hi"}` {
+		t.Fatalf("unexpected answer %q", answer)
+	}
+}
+
+func TestStreamOpenPolicy(t *testing.T) {
+	router := NewRouter()
+	errs := make(chan error, 2)
+	router.OnError(func(conn *Connection, err error) {
+		errs <- err
+	})
+	router.On("upload", func(conn *Connection, r io.Reader) {
+		t.Error("denied stream handled")
+	}, denyAll)
+	socket := dialTest(t, router.Handler(), "/")
+
+	writeTest(t, socket, `$stream:open {"id":1,"event":"upload"}`)
+	if answer := readTest(t, socket); answer != `$stream:cancel {"id":1}` {
+		t.Fatalf("expected stream to be canceled, received %q", answer)
+	}
+	<-errs
+	select {
+	case err := <-errs:
+		t.Fatalf("expected stream to be authorized once, second error %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStreamTrace(t *testing.T) {
+	router, exporter := tracedRouter()
+	router.On("upload", func(conn *Connection, r io.Reader) {
+		io.ReadAll(r)
+	})
+	client := connectMemory(t, router)
+
+	client.WriteFrame(TextMode, []byte(`$trace {"traceparent":"`+testTraceParent+`","event":"$stream:open","data":{"id":1,"event":"upload"}}`))
+	client.WriteFrame(TextMode, []byte(`$stream:close {"id":1}`))
+	spans := waitSpans(t, exporter, 3)
+	var open, upload *tracetest.SpanStub
+	for i := range spans {
+		switch spans[i].Name {
+		case streamOpenEvent:
+			open = &spans[i]
+		case "upload":
+			upload = &spans[i]
+		}
+	}
+	if open == nil || upload == nil || upload.Parent.SpanID() != open.SpanContext.SpanID() ||
+		upload.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("expected span of stream to continue the trace of the opening message, recorded %v", spans)
+	}
+}
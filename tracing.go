@@ -0,0 +1,135 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+const (
+	// Name of the tracer routers obtain from the tracer provider.
+	tracerName = "github.com/trevex/golem"
+	// Name of the span of WebSocket handshakes.
+	handshakeSpanName = "golem.handshake"
+	// Prefix of the names of spans of emitted messages.
+	emitSpanPrefix = "emit "
+	// Event wrapping messages carrying a trace context, see DefaultJSONProtocol.UnpackTrace.
+	traceEvent = "$trace"
+)
+
+var (
+	// Propagator of the W3C trace context used for handshake requests and incoming messages.
+	tracePropagator = propagation.TraceContext{}
+	// Attribute keys of spans.
+	eventKey  = attribute.Key("golem.event")
+	sizeKey   = attribute.Key("golem.message.size")
+	reasonKey = attribute.Key("golem.reject.reason")
+)
+
+// SetTracerProvider enables tracing using the provided OpenTelemetry tracer provider, nil disables
+// tracing again. By default tracing is disabled. It should be called before the router serves connections.
+// Spans are recorded for:
+//   - WebSocket handshakes of the Handler, continuing the trace context of the request headers.
+//   - Each incoming message named by its event, for the time its callback runs. Events without
+//     callback share one span name like their metrics.
+//   - Messages emitted by callbacks, see Connection.Context.
+//
+// Clients can continue a trace by sending a W3C traceparent in the envelope of a message, if the
+// protocol supports it, see TraceProtocol. Spans of messages are linked to the span of the
+// handshake of their connection.
+func (router *Router) SetTracerProvider(provider trace.TracerProvider) {
+	if provider == nil {
+		router.tracer = nil
+		return
+	}
+	router.tracer = provider.Tracer(tracerName)
+}
+
+// Starts the span of a handshake, continuing the trace context of the request headers. The returned
+// request carries the span, which is a no-op span if tracing is disabled.
+func (router *Router) traceHandshake(r *http.Request) (*http.Request, trace.Span) {
+	if router.tracer == nil {
+		return r, trace.SpanFromContext(context.Background())
+	}
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := router.tracer.Start(ctx, handshakeSpanName,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.method", r.Method), attribute.String("http.target", r.URL.Path)))
+	return r.WithContext(ctx), span
+}
+
+// Counts a rejected connection request and marks the span of the handshake as failed.
+func (router *Router) rejected(r *http.Request, reason string) {
+	router.metrics.rejected(reason)
+	if router.tracer != nil {
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(reasonKey.String(reason))
+		span.SetStatus(codes.Error, "Connection rejected")
+	}
+}
+
+// Dispatches an unpacked message of the specified size, recording a span named by the event if tracing
+// is enabled, which continues the trace of the traceparent if valid. The context of the span is the
+// context of the connection meanwhile.
+func (router *Router) traceHandle(conn *Connection, name string, traceParent string, size int, data interface{}) {
+	if router.tracer == nil {
+		router.handle(conn, name, data)
+		return
+	}
+	ctx := context.Background()
+	if traceParent != "" { // Continues the trace of the client, invalid ones are ignored.
+		ctx = tracePropagator.Extract(ctx, propagation.MapCarrier{"traceparent": traceParent})
+	}
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(eventKey.String(name), sizeKey.Int(size)),
+	}
+	if conn.handshake.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: conn.handshake}))
+	}
+	ctx, span := router.tracer.Start(ctx, router.eventLabel(name), opts...)
+	conn.setContext(ctx)
+	router.handle(conn, name, data)
+	conn.resetContext(ctx)
+	span.End()
+}
+
+// Returns the traceparent of the span carried by the context, which is empty without span.
+func traceParentOf(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	return carrier["traceparent"]
+}
+
+// Starts the span of a message emitted in the context, which is a no-op span if tracing is disabled
+// or the context carries no span.
+func (router *Router) traceEmit(ctx context.Context, event string) trace.Span {
+	if router.tracer == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+		return trace.SpanFromContext(context.Background())
+	}
+	_, span := router.tracer.Start(ctx, emitSpanPrefix+router.eventLabel(event),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(eventKey.String(event)))
+	return span
+}
@@ -0,0 +1,117 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+	"time"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// Returns a router recording spans in the returned exporter.
+func tracedRouter() (*Router, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	router := NewRouter()
+	router.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	router.On("echo", func(conn *Connection, data *testMessage) {
+		conn.Emit("echo", data)
+	})
+	return router, exporter
+}
+
+// Returns the recorded spans once n spans ended, as handling may end after the answer was sent.
+func waitSpans(t *testing.T, exporter *tracetest.InMemoryExporter, n int) tracetest.SpanStubs {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); len(exporter.GetSpans()) < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d spans, recorded %v", n, exporter.GetSpans())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return exporter.GetSpans()
+}
+
+func TestTraceEnvelope(t *testing.T) {
+	router, exporter := tracedRouter()
+	client := connectMemory(t, router)
+
+	client.WriteFrame(TextMode, []byte(`$trace {"traceparent":"`+testTraceParent+`","event":"echo","data":{"text":"hi"}}`))
+	if answer := readMemory(t, client); answer != `echo {"text":"hi"}` {
+		t.Fatalf("unexpected answer %q", answer)
+	}
+	spans := waitSpans(t, exporter, 2)
+	emit, handle := spans[0], spans[1]
+	if handle.Name != "echo" || handle.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		handle.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("expected span of event to continue the trace, recorded %q %v", handle.Name, handle.SpanContext)
+	}
+	if emit.Name != "emit echo" || emit.Parent.SpanID() != handle.SpanContext.SpanID() {
+		t.Fatalf("expected span of emit to be child of event, recorded %q", emit.Name)
+	}
+}
+
+func TestTraceWithoutParent(t *testing.T) {
+	router, exporter := tracedRouter()
+	client := connectMemory(t, router)
+
+	client.WriteFrame(TextMode, []byte(`echo {"text":"hi"}`))
+	readMemory(t, client)
+	spans := waitSpans(t, exporter, 2)
+	if spans[1].Name != "echo" || spans[1].Parent.IsValid() {
+		t.Fatalf("expected span of event to start a new trace, recorded %v", spans)
+	}
+}
+
+func TestTraceUnknownEvent(t *testing.T) {
+	router, exporter := tracedRouter()
+	client := connectMemory(t, router)
+
+	client.WriteFrame(TextMode, []byte(`unknown-1234 {}`))
+	client.WriteFrame(TextMode, []byte(`echo {"text":"hi"}`))
+	readMemory(t, client)
+	spans := waitSpans(t, exporter, 3)
+	if spans[0].Name != unknownEventLabel {
+		t.Fatalf("expected span of unregistered event to be named %s, recorded %v", unknownEventLabel, spans)
+	}
+}
+
+func TestBinaryTraceParent(t *testing.T) {
+	p := NewBinaryFrameProtocol()
+	packed, err := p.MarshalAndPack("chat", &BinaryFrame{
+		Flags:       BinaryFlagTraceParent | BinaryFlagMessageID,
+		ID:          7,
+		TraceParent: testTraceParent,
+		Payload:     []byte(`{"text":"hi"}`),
+	})
+	if err != nil {
+		t.Fatalf("packing frame failed: %v", err)
+	}
+	name, data, err := p.Unpack(packed)
+	if err != nil {
+		t.Fatalf("unpacking frame failed: %v", err)
+	}
+	name, data, traceParent := p.UnpackTrace(name, data)
+	frame, ok := data.(*BinaryFrame)
+	if name != "chat" || traceParent != testTraceParent || !ok || frame.ID != 7 || string(frame.Payload) != `{"text":"hi"}` {
+		t.Fatalf("unexpected frame %q %q %+v", name, traceParent, data)
+	}
+}
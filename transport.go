@@ -0,0 +1,393 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of frames buffered by each direction of an in-memory transport.
+	memoryTransportBuffer = 64
+)
+
+var (
+	// ErrTransportClosed is returned by transports, that were closed locally or by the peer.
+	ErrTransportClosed = errors.New("Transport closed.")
+	// ErrTransportTimeout is returned if a read or write deadline was exceeded.
+	ErrTransportTimeout = errors.New("Transport deadline exceeded.")
+	// ErrReadLimit is returned if an incoming frame exceeds the read limit.
+	ErrReadLimit = errors.New("Read limit exceeded.")
+)
+
+// Transport is the frame based connection a Connection reads from and writes to.
+// The gorilla/websocket implementation is used by the Handler of the router, other
+// implementations can be served using ServeTransport. The modes of frames are
+// TextMode and BinaryMode. Reading and writing happen in separate goroutines, but
+// there is never more than one concurrent reader and one concurrent writer.
+type Transport interface {
+	// ReadFrame blocks until the next data frame arrives and returns its mode and data.
+	// If the peer closed the connection a *CloseError should be returned.
+	ReadFrame() (int, []byte, error)
+	// WriteFrame writes a data frame of the specified mode.
+	WriteFrame(mode int, data []byte) error
+	// WritePing sends a ping, the peer is expected to respond with a pong,
+	// which is reported using the pong handler.
+	WritePing() error
+	// WriteClose sends a close frame with the status code and reason. If code
+	// is zero the close frame does not carry a status.
+	WriteClose(code int, reason string) error
+	// Close closes the transport immediately and unblocks pending reads.
+	Close() error
+	// SetReadDeadline sets the deadline for reading, a zero value means no deadline.
+	SetReadDeadline(t time.Time) error
+	// SetWriteDeadline sets the deadline for writing, a zero value means no deadline.
+	SetWriteDeadline(t time.Time) error
+	// SetReadLimit sets the maximum size of incoming frames.
+	SetReadLimit(limit int64)
+	// SetPongHandler sets the function called for every pong received while reading.
+	SetPongHandler(h func())
+}
+
+// CloseError is returned by ReadFrame if the peer closed the connection with a close frame.
+type CloseError struct {
+	// Status code of the close frame or zero if no status was send.
+	Code int
+	// Reason of the close frame.
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return "Connection closed with code " + strconv.Itoa(e.Code) + ": " + e.Text
+}
+
+// Optional interface of transports supporting per message compression.
+type compressionTransport interface {
+	EnableWriteCompression(enable bool)
+	SetCompressionLevel(level int) error
+}
+
+// Optional interface of transports, that are able to write shared messages prepared once.
+type preparedTransport interface {
+	WritePreparedMessage(msg *websocket.PreparedMessage) error
+}
+
+// Optional interface of transports, that label frames with the name of the event, e.g. to
+// deliver them as named events.
+type eventTransport interface {
+	WriteEventFrame(event string, mode int, data []byte) error
+}
+
+/*
+ * gorilla/websocket
+ */
+
+// Transport using a gorilla/websocket connection.
+type webSocketTransport struct {
+	socket *websocket.Conn
+}
+
+// NewWebSocketTransport wraps an established gorilla/websocket connection, so it can
+// be served using ServeTransport. It is used by the Handler of the router.
+func NewWebSocketTransport(socket *websocket.Conn) Transport {
+	return &webSocketTransport{socket: socket}
+}
+
+// Converts the mode to the message type of gorilla/websocket.
+func webSocketMessageType(mode int) int {
+	if mode == BinaryMode {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+func (t *webSocketTransport) ReadFrame() (int, []byte, error) {
+	messageType, data, err := t.socket.ReadMessage()
+	if err != nil {
+		if ce, ok := err.(*websocket.CloseError); ok {
+			code := ce.Code
+			if code == websocket.CloseNoStatusReceived {
+				code = 0
+			}
+			return 0, nil, &CloseError{Code: code, Text: ce.Text}
+		}
+		return 0, nil, err
+	}
+	if messageType == websocket.BinaryMessage {
+		return BinaryMode, data, nil
+	}
+	return TextMode, data, nil
+}
+
+func (t *webSocketTransport) WriteFrame(mode int, data []byte) error {
+	return t.socket.WriteMessage(webSocketMessageType(mode), data)
+}
+
+func (t *webSocketTransport) WritePing() error {
+	return t.socket.WriteMessage(websocket.PingMessage, []byte{})
+}
+
+func (t *webSocketTransport) WriteClose(code int, reason string) error {
+	if code == 0 {
+		return t.socket.WriteMessage(websocket.CloseMessage, []byte{})
+	}
+	return t.socket.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+}
+
+func (t *webSocketTransport) Close() error {
+	return t.socket.Close()
+}
+
+func (t *webSocketTransport) SetReadDeadline(deadline time.Time) error {
+	return t.socket.SetReadDeadline(deadline)
+}
+
+func (t *webSocketTransport) SetWriteDeadline(deadline time.Time) error {
+	return t.socket.SetWriteDeadline(deadline)
+}
+
+func (t *webSocketTransport) SetReadLimit(limit int64) {
+	t.socket.SetReadLimit(limit)
+}
+
+func (t *webSocketTransport) SetPongHandler(h func()) {
+	t.socket.SetPongHandler(func(string) error {
+		h()
+		return nil
+	})
+}
+
+func (t *webSocketTransport) EnableWriteCompression(enable bool) {
+	t.socket.EnableWriteCompression(enable)
+}
+
+func (t *webSocketTransport) SetCompressionLevel(level int) error {
+	return t.socket.SetCompressionLevel(level)
+}
+
+func (t *webSocketTransport) WritePreparedMessage(msg *websocket.PreparedMessage) error {
+	return t.socket.WritePreparedMessage(msg)
+}
+
+/*
+ * In-memory
+ */
+
+// Kinds of frames exchanged by in-memory transports.
+const (
+	memoryDataFrame = iota
+	memoryPingFrame
+	memoryPongFrame
+	memoryCloseFrame
+)
+
+// Frame exchanged by in-memory transports.
+type memoryFrame struct {
+	kind   int
+	mode   int
+	data   []byte
+	code   int
+	reason string
+}
+
+// MemoryTransport is one end of an in-memory connection created by NewMemoryTransportPair.
+// Pings are answered automatically by the reading side, like browsers do. Each direction
+// buffers a limited number of frames, afterwards writing blocks until the peer reads or
+// the write deadline is exceeded.
+type MemoryTransport struct {
+	// The other end of the connection.
+	peer *MemoryTransport
+	// Frames written by the peer.
+	frames chan memoryFrame
+	// Closed if either end was closed.
+	done chan struct{}
+	// Shared by both ends to close done only once.
+	once *sync.Once
+	// Closed by Timeout.
+	timeout     chan struct{}
+	timeoutOnce sync.Once
+	// Guards the settings below.
+	lock          sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readLimit     int64
+	pongHandler   func()
+}
+
+// NewMemoryTransportPair creates both ends of an in-memory connection, e.g. serving one
+// end using ServeTransport and using the other one as client in tests.
+func NewMemoryTransportPair() (*MemoryTransport, *MemoryTransport) {
+	done := make(chan struct{})
+	once := &sync.Once{}
+	a := &MemoryTransport{frames: make(chan memoryFrame, memoryTransportBuffer), done: done, once: once, timeout: make(chan struct{})}
+	b := &MemoryTransport{frames: make(chan memoryFrame, memoryTransportBuffer), done: done, once: once, timeout: make(chan struct{})}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+// Returns a channel firing at the deadline or nil if the deadline is zero, and a function
+// releasing the timer.
+func deadlineTimer(deadline time.Time) (<-chan time.Time, func()) {
+	if deadline.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, func() { timer.Stop() }
+}
+
+// ReadFrame returns the next data frame, answers pings and reports pongs while waiting.
+// Exceeding the read deadline or limit closes the transport.
+func (t *MemoryTransport) ReadFrame() (int, []byte, error) {
+	for {
+		t.lock.Lock()
+		deadline, limit := t.readDeadline, t.readLimit
+		t.lock.Unlock()
+
+		var frame memoryFrame
+		select {
+		case frame = <-t.frames: // Deliver buffered frames before reporting the close.
+		default:
+			timeout, stop := deadlineTimer(deadline)
+			select {
+			case frame = <-t.frames:
+			case <-t.done:
+				stop()
+				return 0, nil, ErrTransportClosed
+			case <-timeout:
+				t.Close()
+				return 0, nil, ErrTransportTimeout
+			case <-t.timeout:
+				stop()
+				t.Close()
+				return 0, nil, ErrTransportTimeout
+			}
+			stop()
+		}
+
+		switch frame.kind {
+		case memoryDataFrame:
+			if limit > 0 && int64(len(frame.data)) > limit {
+				t.Close()
+				return 0, nil, ErrReadLimit
+			}
+			return frame.mode, frame.data, nil
+		case memoryPingFrame:
+			select {
+			case t.peer.frames <- memoryFrame{kind: memoryPongFrame}:
+			case <-t.done:
+			}
+		case memoryPongFrame:
+			t.lock.Lock()
+			h := t.pongHandler
+			t.lock.Unlock()
+			if h != nil {
+				h()
+			}
+		case memoryCloseFrame:
+			return 0, nil, &CloseError{Code: frame.code, Text: frame.reason}
+		}
+	}
+}
+
+// Delivers the frame to the peer, waiting at most until the write deadline.
+func (t *MemoryTransport) send(frame memoryFrame) error {
+	select {
+	case <-t.done:
+		return ErrTransportClosed
+	default:
+	}
+	t.lock.Lock()
+	deadline := t.writeDeadline
+	t.lock.Unlock()
+	timeout, stop := deadlineTimer(deadline)
+	defer stop()
+	select {
+	case t.peer.frames <- frame:
+		return nil
+	case <-t.done:
+		return ErrTransportClosed
+	case <-timeout:
+		return ErrTransportTimeout
+	}
+}
+
+// WriteFrame sends a copy of the data to the peer.
+func (t *MemoryTransport) WriteFrame(mode int, data []byte) error {
+	return t.send(memoryFrame{kind: memoryDataFrame, mode: mode, data: append([]byte(nil), data...)})
+}
+
+// WritePing sends a ping, which the peer answers while reading.
+func (t *MemoryTransport) WritePing() error {
+	return t.send(memoryFrame{kind: memoryPingFrame})
+}
+
+// WriteClose sends a close frame, which is returned as *CloseError by ReadFrame of the peer.
+func (t *MemoryTransport) WriteClose(code int, reason string) error {
+	return t.send(memoryFrame{kind: memoryCloseFrame, code: code, reason: reason})
+}
+
+// Timeout lets pending and future reads of this end fail as if the read deadline was exceeded,
+// e.g. to simulate a missing pong in tests.
+func (t *MemoryTransport) Timeout() {
+	t.timeoutOnce.Do(func() {
+		close(t.timeout)
+	})
+}
+
+// Close closes both ends of the connection.
+func (t *MemoryTransport) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+	})
+	return nil
+}
+
+// SetReadDeadline sets the read deadline, which is evaluated whenever reading starts waiting.
+func (t *MemoryTransport) SetReadDeadline(deadline time.Time) error {
+	t.lock.Lock()
+	t.readDeadline = deadline
+	t.lock.Unlock()
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline.
+func (t *MemoryTransport) SetWriteDeadline(deadline time.Time) error {
+	t.lock.Lock()
+	t.writeDeadline = deadline
+	t.lock.Unlock()
+	return nil
+}
+
+// SetReadLimit sets the maximum size of incoming frames, zero disables the limit.
+func (t *MemoryTransport) SetReadLimit(limit int64) {
+	t.lock.Lock()
+	t.readLimit = limit
+	t.lock.Unlock()
+}
+
+// SetPongHandler sets the function called for every pong received while reading.
+func (t *MemoryTransport) SetPongHandler(h func()) {
+	t.lock.Lock()
+	t.pongHandler = h
+	t.lock.Unlock()
+}
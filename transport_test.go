@@ -0,0 +1,130 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Connects a memory transport to the router and returns the end of the client.
+func connectMemory(t *testing.T, router *Router) *MemoryTransport {
+	client, server := NewMemoryTransportPair()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeTransport(server, httptest.NewRequest("GET", "/", nil))
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+// Reads the next frame of a memory transport, failing the test if none arrives within a second.
+func readMemory(t *testing.T, client *MemoryTransport) string {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := client.ReadFrame()
+	if err != nil {
+		t.Fatalf("reading failed: %v", err)
+	}
+	return string(data)
+}
+
+func TestMemoryTransport(t *testing.T) {
+	router := NewRouter()
+	router.On("echo", func(conn *Connection, data *testMessage) {
+		conn.Emit("echo", data)
+	})
+	router.On("bye", func(conn *Connection) {
+		conn.CloseWithReason(4000, "Bye")
+	})
+	closed := make(chan bool, 1)
+	router.OnClose(func(conn *Connection) {
+		closed <- true
+	})
+	client := connectMemory(t, router)
+
+	client.WriteFrame(TextMode, []byte(`echo {"text":"hello"}`))
+	if answer := readMemory(t, client); answer != `echo {"text":"hello"}` {
+		t.Fatalf("unexpected answer %q", answer)
+	}
+	client.WriteFrame(TextMode, []byte(`bye null`))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := client.ReadFrame()
+	if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != 4000 || closeErr.Text != "Bye" {
+		t.Fatalf("expected close with code 4000, received %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close callback not called")
+	}
+}
+
+func TestMemoryTransportDeadline(t *testing.T) {
+	client, server := NewMemoryTransportPair()
+	defer client.Close()
+	server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := server.ReadFrame(); err != ErrTransportTimeout {
+		t.Fatalf("expected read to time out, received %v", err)
+	}
+	if err := client.WriteFrame(TextMode, []byte("x")); err == nil {
+		t.Fatal("expected write to fail after the peer timed out")
+	}
+}
+
+func TestMemoryTransportReadLimit(t *testing.T) {
+	client, server := NewMemoryTransportPair()
+	defer client.Close()
+	server.SetReadLimit(4)
+	client.WriteFrame(TextMode, []byte("too long"))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := server.ReadFrame(); err != ErrReadLimit {
+		t.Fatalf("expected read limit to be exceeded, received %v", err)
+	}
+}
+
+func TestMemoryTransportPing(t *testing.T) {
+	client, server := NewMemoryTransportPair()
+	defer client.Close()
+	pongs := make(chan bool, 1)
+	client.SetPongHandler(func() {
+		pongs <- true
+	})
+	go func() {
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		if _, data, err := server.ReadFrame(); err == nil { // Answers the ping first.
+			server.WriteFrame(TextMode, data)
+		}
+	}()
+	client.WritePing()
+	client.WriteFrame(TextMode, []byte("x"))
+	if data := readMemory(t, client); data != "x" {
+		t.Fatalf("expected x, received %q", data)
+	}
+	select {
+	case <-pongs:
+	default:
+		t.Fatal("pong handler not called")
+	}
+}
@@ -0,0 +1,348 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Validator is implemented by data types of callbacks, that validate themselves. Validate is
+// called after the struct tags of the type were validated successfully. The "validate" tag of
+// fields declares rules separated by commas:
+//     Name  string   `json:"name" validate:"required,min=3,max=32"`
+//     Code  string   `validate:"len=4,regexp=^[A-Z0-9]+$"`
+//     Color string   `validate:"oneof=red green blue"`
+//     Items []*Item  `validate:"max=10"`
+// The rules are:
+//   - required: the field must not be the zero value or nil.
+//   - min, max: numbers must be in range, strings, slices and maps must have a length in range.
+//   - len: strings, slices and maps must have the length.
+//   - regexp: strings must match the regular expression, which needs to be the last rule.
+//   - oneof: strings and numbers must be one of the values separated by spaces.
+// Nested structs, also in slices, are validated as well including their Validate method.
+// On panics if a rule is malformed.
+type Validator interface {
+	Validate() error
+}
+
+// FieldError describes a field of the data of an event, that failed validation.
+type FieldError struct {
+	// Path of the field using the JSON names of the fields, e.g. "items[2].name".
+	Field string `json:"field"`
+	// Failed rule, e.g. "required", or "validate" if the Validate method of a nested struct
+	// returned an error.
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Error describes the field and its failed rule.
+func (e FieldError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// ValidationError is reported to the error callback if the data of an event failed validation.
+// The message is discarded instead of being passed to the callback.
+type ValidationError struct {
+	Event string
+	// Fields, that failed validation of their struct tags or nested Validate methods.
+	Fields []FieldError
+	// Error returned by the Validate method of the data, nil if fields failed validation.
+	Err error
+}
+
+// Error describes the failed fields or the error returned by Validate.
+func (e *ValidationError) Error() string {
+	if e.Err != nil {
+		return "Invalid data of event " + e.Event + ": " + e.Err.Error()
+	}
+	fields := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		fields[i] = field.Error()
+	}
+	return "Invalid data of event " + e.Event + ": " + strings.Join(fields, ", ") + "."
+}
+
+// Rule of a validated field.
+type validationRule struct {
+	name string
+	arg  string
+	// Parsed argument of min, max and len.
+	number float64
+	// Compiled argument of regexp.
+	re *regexp.Regexp
+	// Split argument of oneof.
+	options []string
+}
+
+// Validated field of a struct.
+type fieldValidation struct {
+	index    int
+	name     string
+	required bool
+	rules    []validationRule
+}
+
+// Validated fields of a struct type.
+type structValidation struct {
+	fields []fieldValidation
+}
+
+var (
+	// Parsed struct tags by struct type.
+	validations     = make(map[reflect.Type]*structValidation)
+	validationsLock sync.RWMutex
+)
+
+// Returns the type with pointers dereferenced.
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// Returns whether the kind is a number.
+func isNumber(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Float64
+}
+
+// Returns whether the kind has a length.
+func hasLength(kind reflect.Kind) bool {
+	return kind == reflect.String || kind == reflect.Slice || kind == reflect.Array || kind == reflect.Map
+}
+
+// Returns the validation of the struct type, parsing its "validate" tags on first use. Panics if
+// a rule is malformed, see Validator.
+func validationOf(t reflect.Type) *structValidation {
+	validationsLock.RLock()
+	v, ok := validations[t]
+	validationsLock.RUnlock()
+	if ok {
+		return v
+	}
+	validationsLock.Lock()
+	defer validationsLock.Unlock()
+	return parseValidation(t)
+}
+
+// Parses the struct type, validationsLock needs to be held.
+func parseValidation(t reflect.Type) *structValidation {
+	if v, ok := validations[t]; ok {
+		return v
+	}
+	v := &structValidation{}
+	validations[t] = v // Registered before parsing fields to support recursive types.
+	parsed := false
+	defer func() {
+		if !parsed { // Malformed rule panicked, so the type is checked again on next use.
+			delete(validations, t)
+		}
+	}()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" { // Unexported.
+			continue
+		}
+		f := fieldValidation{index: i, name: field.Name}
+		if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			f.name = name
+		}
+		kind := indirectType(field.Type).Kind()
+		tag := field.Tag.Get("validate")
+		for tag != "" {
+			var rule string
+			if strings.HasPrefix(tag, "regexp=") {
+				rule, tag = tag, ""
+			} else if i := strings.Index(tag, ","); i >= 0 {
+				rule, tag = tag[:i], tag[i+1:]
+			} else {
+				rule, tag = tag, ""
+			}
+			r := validationRule{name: rule}
+			if i := strings.Index(rule, "="); i >= 0 {
+				r.name, r.arg = rule[:i], rule[i+1:]
+			}
+			valid := true
+			switch r.name {
+			case "required":
+				f.required = true
+				continue
+			case "min", "max", "len":
+				var err error
+				r.number, err = strconv.ParseFloat(r.arg, 64)
+				valid = err == nil && (hasLength(kind) || (r.name != "len" && isNumber(kind)))
+			case "regexp":
+				var err error
+				r.re, err = regexp.Compile(r.arg)
+				valid = err == nil && kind == reflect.String
+			case "oneof":
+				r.options = strings.Fields(r.arg)
+				valid = len(r.options) > 0 && (kind == reflect.String || isNumber(kind))
+			default:
+				valid = false
+			}
+			if !valid {
+				panic("Invalid validation rule " + rule + " of field " + t.String() + "." + field.Name + ".")
+			}
+			f.rules = append(f.rules, r)
+		}
+		elem := indirectType(field.Type)
+		if elem.Kind() == reflect.Slice || elem.Kind() == reflect.Array {
+			elem = indirectType(elem.Elem())
+		}
+		if elem.Kind() == reflect.Struct {
+			parseValidation(elem)
+		}
+		if f.required || len(f.rules) > 0 || elem.Kind() == reflect.Struct {
+			v.fields = append(v.fields, f)
+		}
+	}
+	parsed = true
+	return v
+}
+
+// Validates the struct value and appends the failed fields to errs.
+func (v *structValidation) validate(value reflect.Value, path string, errs []FieldError) []FieldError {
+	for _, f := range v.fields {
+		name := f.name
+		if path != "" {
+			name = path + "." + name
+		}
+		field := value.Field(f.index)
+		if f.required && field.IsZero() {
+			errs = append(errs, FieldError{Field: name, Rule: "required", Message: "is required"})
+			continue
+		}
+		for field.Kind() == reflect.Ptr || field.Kind() == reflect.Interface {
+			if field.IsNil() {
+				break
+			}
+			field = field.Elem()
+		}
+		if (field.Kind() == reflect.Ptr || field.Kind() == reflect.Interface) && field.IsNil() {
+			continue // Optional and missing.
+		}
+		for _, r := range f.rules {
+			if message := r.check(field); message != "" {
+				errs = append(errs, FieldError{Field: name, Rule: r.name, Message: message})
+			}
+		}
+		switch field.Kind() {
+		case reflect.Struct:
+			errs = validateNested(field, name, errs)
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < field.Len(); i++ {
+				errs = validateNested(field.Index(i), name+"["+strconv.Itoa(i)+"]", errs)
+			}
+		}
+	}
+	return errs
+}
+
+// Validates a nested struct including its Validate method, ignores other values.
+func validateNested(value reflect.Value, path string, errs []FieldError) []FieldError {
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return errs
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return errs
+	}
+	count := len(errs)
+	errs = validationOf(value.Type()).validate(value, path, errs)
+	if len(errs) == count && value.CanAddr() {
+		if validator, ok := value.Addr().Interface().(Validator); ok {
+			if err := validator.Validate(); err != nil {
+				errs = append(errs, FieldError{Field: path, Rule: "validate", Message: err.Error()})
+			}
+		}
+	}
+	return errs
+}
+
+// Checks the rule, returns the message describing the failure or an empty string.
+func (r *validationRule) check(value reflect.Value) string {
+	switch r.name {
+	case "min", "max", "len":
+		n, length := 0.0, hasLength(value.Kind())
+		switch {
+		case value.Kind() == reflect.String:
+			n = float64(utf8.RuneCountInString(value.String()))
+		case length:
+			n = float64(value.Len())
+		case value.Kind() >= reflect.Int && value.Kind() <= reflect.Int64:
+			n = float64(value.Int())
+		case value.Kind() >= reflect.Uint && value.Kind() <= reflect.Uintptr:
+			n = float64(value.Uint())
+		default:
+			n = value.Float()
+		}
+		prefix := "must be "
+		if length {
+			prefix = "must have a length of "
+		}
+		switch {
+		case r.name == "min" && n < r.number:
+			return prefix + "at least " + r.arg
+		case r.name == "max" && n > r.number:
+			return prefix + "at most " + r.arg
+		case r.name == "len" && n != r.number:
+			return prefix + r.arg
+		}
+	case "regexp":
+		if !r.re.MatchString(value.String()) {
+			return "must match " + r.arg
+		}
+	case "oneof":
+		s := fmt.Sprint(value.Interface())
+		for _, option := range r.options {
+			if s == option {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(r.options, ", ")
+	}
+	return ""
+}
+
+// Validates the data of the event unmarshalled for a callback. Reports the failure to the error
+// callback and returns false if the data is invalid.
+func (router *Router) validate(conn *Connection, event string, data reflect.Value) bool {
+	if value := data.Elem(); value.Kind() == reflect.Struct {
+		if errs := validationOf(value.Type()).validate(value, "", nil); len(errs) > 0 {
+			router.reportError(conn, &ValidationError{Event: event, Fields: errs})
+			return false
+		}
+	}
+	if validator, ok := data.Interface().(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			router.reportError(conn, &ValidationError{Event: event, Err: err})
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+/*
+
+   Copyright 2013 Niklas Voss
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package golem
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testItem struct {
+	Name string `json:"name" validate:"required,regexp=^[a-z]+$"`
+}
+
+type testAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+func (a *testAddress) Validate() error {
+	if a.City == "nowhere" {
+		return errors.New("unknown city")
+	}
+	return nil
+}
+
+type testProfile struct {
+	Name     string       `json:"name" validate:"required,min=3,max=5"`
+	Age      *int         `json:"age" validate:"required,min=0,max=130"`
+	Code     string       `json:"code" validate:"len=2"`
+	Color    string       `json:"color" validate:"oneof=red green"`
+	N        int          `validate:"oneof=1 2 3"`
+	Items    []*testItem  `json:"items" validate:"max=2"`
+	Address  testAddress  `json:"address"`
+	Optional *testAddress `json:"optional"`
+}
+
+type testCount struct {
+	X int
+}
+
+func (c *testCount) Validate() error {
+	if c.X < 0 {
+		return errors.New("negative")
+	}
+	return nil
+}
+
+// Returns a router validating the events, reporting errors and calling back handled events.
+func validatingRouter() (*Router, chan error, chan bool) {
+	router := NewRouter()
+	router.SetErrorEvent("error")
+	errs := make(chan error, 1)
+	router.OnError(func(conn *Connection, err error) {
+		errs <- err
+	})
+	handled := make(chan bool, 1)
+	router.On("profile", func(conn *Connection, data *testProfile) {
+		handled <- true
+	})
+	router.On("count", func(conn *Connection, data *testCount) {
+		handled <- true
+	})
+	return router, errs, handled
+}
+
+func TestValidationFields(t *testing.T) {
+	router, errs, handled := validatingRouter()
+	client := connectMemory(t, router)
+
+	client.WriteFrame(TextMode, []byte(`profile {"name":"abcd","age":0,"code":"xy","color":"red","N":2,"items":[{"name":"a"}],"address":{"city":"x"}}`))
+	select {
+	case <-handled:
+	case err := <-errs:
+		t.Fatalf("valid data rejected: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("valid data not handled")
+	}
+
+	client.WriteFrame(TextMode, []byte(`profile {"name":"ab","code":"xyz","color":"blue","N":5,"items":[{"name":"a"},{"name":"B"},{}],"address":{"city":"nowhere"},"optional":{}}`))
+	err, ok := (<-errs).(*ValidationError)
+	if !ok {
+		t.Fatalf("expected validation error, received %v", err)
+	}
+	rules := map[string]string{}
+	for _, field := range err.Fields {
+		rules[field.Field] = field.Rule
+	}
+	expected := map[string]string{
+		"name": "min", "age": "required", "code": "len", "color": "oneof", "N": "oneof", "items": "max",
+		"items[1].name": "regexp", "items[2].name": "required", "address": "validate", "optional.city": "required",
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("expected failed fields %v, received %v", expected, rules)
+	}
+	for field, rule := range expected {
+		if rules[field] != rule {
+			t.Fatalf("expected field %s to fail rule %s, received %v", field, rule, rules)
+		}
+	}
+	msg := readMemory(t, client)
+	if !strings.HasPrefix(msg, "error ") {
+		t.Fatalf("expected error event, received %q", msg)
+	}
+	var data struct {
+		Event  string       `json:"event"`
+		Fields []FieldError `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(msg[len("error "):]), &data); err != nil || data.Event != "profile" || len(data.Fields) != len(expected) {
+		t.Fatalf("unexpected error event %q", msg)
+	}
+	select {
+	case <-handled:
+		t.Fatal("invalid data handled")
+	default:
+	}
+}
+
+func TestValidationMethod(t *testing.T) {
+	router, errs, handled := validatingRouter()
+	client := connectMemory(t, router)
+
+	client.WriteFrame(TextMode, []byte(`count {"X":-1}`))
+	if err, ok := (<-errs).(*ValidationError); !ok || err.Err == nil || err.Error() != "Invalid data of event count: negative" {
+		t.Fatalf("expected error of Validate, received %v", err)
+	}
+	client.WriteFrame(TextMode, []byte(`count {"X":1}`))
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("valid data not handled")
+	}
+}
+
+func TestValidationMalformedTag(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected malformed struct tag to panic on registration")
+		}
+	}()
+	NewRouter().On("malformed", func(conn *Connection, data *struct {
+		A int `validate:"regexp=x"`
+	}) {
+	})
+}